@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+
+	//Internal
+	"fileshare/internal/envelope"
+	"fileshare/internal/models"
+	"fileshare/internal/storage"
+)
+
+// runCommand runs one of the admin commands given on the command line instead of the web server.
+func (app *application) runCommand(args []string) error {
+	switch args[0] {
+	case "rotate-keys":
+		return app.rotateKeys(args[1:])
+	case "verify-blobs":
+		return app.verifyBlobs(args[1:])
+	case "link-sso":
+		return app.linkAccount("link-sso", models.SourceSSO, args[1:])
+	case "link-ldap":
+		return app.linkAccount("link-ldap", models.SourceLDAP, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// rotateKeys re-wraps every file's data key with a new master key, and those of the chunks of uploads
+// still in progress, the contents are not touched. Stop the web nodes, run it, then set MASTER_KEY in
+// the .env file to the new key before starting them again.
+func (app *application) rotateKeys(args []string) error {
+	fs := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	newKeyHex := fs.String("new-key", "", "New hex encoded master key, e.g. from `openssl rand -hex 32`")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	newKey, err := envelope.ParseMasterKey(*newKeyHex)
+	if err != nil {
+		return err
+	}
+
+	n, err := app.sharedFile.RewrapKeys(func(wrappedKey []byte) ([]byte, error) {
+		dataKey, err := app.masterKey.Unwrap(wrappedKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return newKey.Wrap(dataKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("Master key rotated", "keys", n)
+
+	return nil
+}
+
+// verifyBlobs reads back every version of every stored file and checks it against the size and
+// checksum taken when it was uploaded. Anything missing or corrupt is logged and the command fails,
+// so it can be run from cron and looked at when it does. Files from before checksums were taken can
+// only be checked for being there and decrypting.
+func (app *application) verifyBlobs(args []string) error {
+	fs := flag.NewFlagSet("verify-blobs", flag.ContinueOnError)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	versions, err := app.sharedFile.AllVersions()
+	if err != nil {
+		return err
+	}
+
+	var verified, unchecked, missing, corrupt int
+
+	for _, v := range versions {
+		err := app.verifyBlob(v)
+
+		switch {
+		case err == nil && v.Checksum == "":
+			unchecked++
+		case err == nil:
+			verified++
+		case errors.Is(err, storage.ErrNotFound):
+			missing++
+			app.logger.Error("Stored file is missing", "file", v.FileId, "version", v.Version, "name", v.DocName,
+				"key", v.StorageKey)
+		case errors.Is(err, errCorrupt), errors.Is(err, envelope.ErrDecrypt):
+			corrupt++
+			app.logger.Error("Stored file is corrupt", "file", v.FileId, "version", v.Version, "name", v.DocName,
+				"key", v.StorageKey, "error", err)
+		default:
+			return fmt.Errorf("checking file %d version %d: %w", v.FileId, v.Version, err)
+		}
+	}
+
+	app.logger.Info("Stored files checked", "verified", verified, "no checksum", unchecked, "missing", missing,
+		"corrupt", corrupt)
+
+	if missing+corrupt > 0 {
+		return fmt.Errorf("%d stored files are missing or corrupt", missing+corrupt)
+	}
+
+	return nil
+}
+
+// verifyBlob reads one version of a file back from storage, checking it's all there.
+func (app *application) verifyBlob(v models.FileVersion) error {
+	f, _, err := app.openStored(v.StorageKey, v.WrappedKey)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(io.Discard, newVerifyingReader(f, v.Size, v.Checksum))
+
+	return err
+}
+
+// linkAccount lets someone that already has an account sign in to it with single sign-on
+// (link-sso) or the directory (link-ldap), which only sign in to accounts they made otherwise. From
+// then on it's managed there like those are, its password, passkeys and magic links here stop working
+// and its roles follow the provider or directory. Only link an account once it's certain the user
+// there with that email is the same person.
+func (app *application) linkAccount(command, source string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	email := fs.String("email", "", "Email of the account to link")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	user, err := app.users.GetByEmail(*email)
+	if err != nil {
+		return fmt.Errorf("no account for %q: %w", *email, err)
+	}
+
+	if err = app.users.SetSource(user.ID, source); err != nil {
+		return err
+	}
+
+	// There's no request to take who did it and where from, it was someone with the .env file.
+	err = app.auditLog.Insert(models.AuditEvent{Action: models.AuditUserEdit, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(user.ID), Detail: fmt.Sprintf("%s, was %q", command, user.Source)})
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("Account linked", "email", user.Email, "source", source)
+
+	return nil
+}
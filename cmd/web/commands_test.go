@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models/mocks"
+)
+
+func TestVerifyBlobs(t *testing.T) {
+	app := newTestApplication(t)
+	files := app.sharedFile.(*mocks.SharedFileModel)
+
+	for _, content := range []string{"first file", "second file", "third file"} {
+		stored, err := app.storeFile(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = files.Insert(stored.sharedFile(content+".txt"), 7); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := app.runCommand([]string{"verify-blobs"})
+	assert.Equal(t, err, nil)
+
+	// One goes missing and another is overwritten.
+	if err = app.storage.Delete(files.Inserted[0].StorageKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = app.storage.Put(files.Inserted[2].StorageKey, strings.NewReader("something else")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.runCommand([]string{"verify-blobs"})
+	assert.Equal(t, err.Error(), "2 stored files are missing or corrupt")
+}
@@ -6,3 +6,6 @@ const isAuthenticatedContextKey = contextKey("isAuthenticated")
 const isAdminContextKey = contextKey("isAdmin")
 const isUserContextKey = contextKey("isUser")
 const isGuestContextKey = contextKey("isGuest")
+const sharedFileContextKey = contextKey("sharedFile")
+const shareContextKey = contextKey("share")
+const uploadPolicyContextKey = contextKey("uploadPolicy")
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	//Internal
+	"fileshare/internal/models"
+	"fileshare/internal/validator"
+)
+
+// expiredFiles shows admins what the janitor would remove on its next run, without removing anything.
+func (app *application) expiredFiles(w http.ResponseWriter, r *http.Request) {
+	expired, err := app.reapExpired(true)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.SharedFiles = expired
+
+	app.render(w, r, http.StatusOK, "expired.gohtml", data)
+}
+
+// expiredFilesPost runs the janitor now instead of waiting for it.
+func (app *application) expiredFilesPost(w http.ResponseWriter, r *http.Request) {
+	removed, err := app.reapExpired(false)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Removed %d expired files", len(removed)))
+
+	http.Redirect(w, r, "/admin/expired", http.StatusSeeOther)
+}
+
+// auditPageSize is how many events the audit page shows, the CSV export has all of them.
+const auditPageSize = 500
+
+// auditFilterForm is the filter at the top of the audit page, it's sent as a query string so the
+// page can be bookmarked and the CSV link can pass it on. Dates are YYYY-MM-DD and both ends are
+// included.
+type auditFilterForm struct {
+	User                string `form:"user"`
+	File                string `form:"file"`
+	From                string `form:"from"`
+	To                  string `form:"to"`
+	validator.Validator `form:"-"`
+}
+
+// filter checks the form and turns it into a models.AuditFilter.
+func (form *auditFilterForm) filter() models.AuditFilter {
+	filter := models.AuditFilter{
+		Email:  strings.TrimSpace(form.User),
+		Target: strings.TrimSpace(form.File),
+	}
+
+	if form.From != "" {
+		from, err := time.Parse(time.DateOnly, form.From)
+		form.CheckField(err == nil, "from", "This field must be a date")
+		filter.From = from
+	}
+
+	if form.To != "" {
+		to, err := time.Parse(time.DateOnly, form.To)
+		form.CheckField(err == nil, "to", "This field must be a date")
+		if err == nil {
+			filter.To = to.Add(24*time.Hour - time.Second)
+		}
+	}
+
+	return filter
+}
+
+// CSVLink is the link to download the events the form picks out as a CSV file.
+func (form auditFilterForm) CSVLink() string {
+	q := url.Values{}
+	for k, v := range map[string]string{"user": form.User, "file": form.File, "from": form.From, "to": form.To} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	return "/admin/audit.csv?" + q.Encode()
+}
+
+// auditEvents decodes the filter from the query string and looks up the events it picks out, the
+// form comes back with any errors on it and no events.
+func (app *application) auditEvents(r *http.Request, limit int) (auditFilterForm, []models.AuditEvent, error) {
+	var form auditFilterForm
+
+	if err := app.formDecoder.Decode(&form, r.URL.Query()); err != nil {
+		form.AddNonFieldError("The filter couldn't be read")
+		return form, nil, nil
+	}
+
+	filter := form.filter()
+	filter.Limit = limit
+
+	if !form.Valid() {
+		return form, nil, nil
+	}
+
+	events, err := app.auditLog.List(filter)
+
+	return form, events, err
+}
+
+// auditLogView shows admins who did what, newest first.
+func (app *application) auditLogView(w http.ResponseWriter, r *http.Request) {
+	form, events, err := app.auditEvents(r, auditPageSize)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = form
+	data.AuditEvents = events
+
+	status := http.StatusOK
+	if !form.Valid() {
+		status = http.StatusUnprocessableEntity
+	}
+
+	app.render(w, r, status, "audit.gohtml", data)
+}
+
+// auditLogCSV sends the events the filter picks out as a CSV file, for keeping or for a spreadsheet.
+func (app *application) auditLogCSV(w http.ResponseWriter, r *http.Request) {
+	form, events, err := app.auditEvents(r, 0)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !form.Valid() {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/csv; charset=utf-8")
+	h.Set("Content-Disposition", contentDisposition(fmt.Sprintf("audit-%s.csv", time.Now().UTC().Format(time.DateOnly))))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Time", "Action", "User ID", "User", "IP", "User Agent", "Target Type", "Target", "Detail"})
+
+	for _, e := range events {
+		cw.Write([]string{
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			e.Action,
+			strconv.Itoa(e.ActorId),
+			csvSafe(e.ActorEmail),
+			e.IP,
+			csvSafe(e.UserAgent),
+			e.TargetType,
+			csvSafe(e.Target),
+			csvSafe(e.Detail),
+		})
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		app.logger.Error("Error sending audit log", "error", err.Error())
+	}
+}
+
+// csvSafe stops a value someone typed in (a file name, say) being run as a formula when the CSV is
+// opened in a spreadsheet.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// policyForm is the upload policy as admins edit it, the lists are typed in separated by commas or
+// spaces and the sizes are in MB, blank or 0 for no limit.
+type policyForm struct {
+	AllowedExtensions   string `form:"allowed_extensions"`
+	BlockedExtensions   string `form:"blocked_extensions"`
+	AllowedTypes        string `form:"allowed_types"`
+	BlockedTypes        string `form:"blocked_types"`
+	GuestMaxSize        string `form:"guest_max_size"`
+	UserMaxSize         string `form:"user_max_size"`
+	AdminMaxSize        string `form:"admin_max_size"`
+	validator.Validator `form:"-"`
+}
+
+// newPolicyForm fills the form in from a saved policy.
+func newPolicyForm(p models.UploadPolicy) policyForm {
+	mb := func(n int64) string {
+		if n <= 0 {
+			return ""
+		}
+		return strconv.FormatInt(n>>20, 10)
+	}
+
+	return policyForm{
+		AllowedExtensions: strings.Join(p.AllowedExtensions, ", "),
+		BlockedExtensions: strings.Join(p.BlockedExtensions, ", "),
+		AllowedTypes:      strings.Join(p.AllowedTypes, ", "),
+		BlockedTypes:      strings.Join(p.BlockedTypes, ", "),
+		GuestMaxSize:      mb(p.GuestMaxSize),
+		UserMaxSize:       mb(p.UserMaxSize),
+		AdminMaxSize:      mb(p.AdminMaxSize),
+	}
+}
+
+// mimePatternRX is a MIME type without parameters, or a whole family of them like image/*.
+var mimePatternRX = regexp.MustCompile(`^[a-z0-9][a-z0-9!#$&^_.+-]*/([a-z0-9][a-z0-9!#$&^_.+-]*|\*)$`)
+
+// policy checks the form and turns it into a models.UploadPolicy.
+func (form *policyForm) policy() models.UploadPolicy {
+	extensions := func(key, value string) []string {
+		var exts []string
+		for _, ext := range policyList(value) {
+			ext = strings.TrimPrefix(ext, ".")
+			form.CheckField(ext != "" && !strings.ContainsAny(ext, "./\\"), key, fmt.Sprintf("%q isn't a file extension", ext))
+			if !slices.Contains(exts, ext) {
+				exts = append(exts, ext)
+			}
+		}
+		return exts
+	}
+
+	types := func(key, value string) []string {
+		list := policyList(value)
+		for _, t := range list {
+			form.CheckField(validator.Matches(t, mimePatternRX), key, fmt.Sprintf("%q isn't a file type like application/pdf or image/*", t))
+		}
+		return list
+	}
+
+	size := func(key, value string) int64 {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return 0
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		form.CheckField(err == nil && n >= 0 && n <= math.MaxInt64>>20, key, "This field must be a whole number of MB")
+		return n << 20
+	}
+
+	return models.UploadPolicy{
+		AllowedExtensions: extensions("allowed_extensions", form.AllowedExtensions),
+		BlockedExtensions: extensions("blocked_extensions", form.BlockedExtensions),
+		AllowedTypes:      types("allowed_types", form.AllowedTypes),
+		BlockedTypes:      types("blocked_types", form.BlockedTypes),
+		GuestMaxSize:      size("guest_max_size", form.GuestMaxSize),
+		UserMaxSize:       size("user_max_size", form.UserMaxSize),
+		AdminMaxSize:      size("admin_max_size", form.AdminMaxSize),
+	}
+}
+
+// policyList splits a list typed into the policy form, lower cased with duplicates dropped.
+func policyList(value string) []string {
+	var list []string
+	for _, item := range strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		if !slices.Contains(list, item) {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// uploadPolicyView shows admins what can be uploaded and lets them change it.
+func (app *application) uploadPolicyView(w http.ResponseWriter, r *http.Request) {
+	policy, err := app.uploadPolicy.Get()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = newPolicyForm(policy)
+
+	app.render(w, r, http.StatusOK, "policy.gohtml", data)
+}
+
+func (app *application) uploadPolicyPost(w http.ResponseWriter, r *http.Request) {
+	var form policyForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	policy := form.policy()
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "policy.gohtml", data)
+		return
+	}
+
+	if err := app.uploadPolicy.Update(policy); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Upload policy saved")
+
+	http.Redirect(w, r, "/admin/policy", http.StatusSeeOther)
+}
+
+type securityForm struct {
+	RequireAdminTwoFactor bool `form:"requireAdminTwoFactor"`
+}
+
+// securityPolicyView shows admins how people have to sign in and lets them change it.
+func (app *application) securityPolicyView(w http.ResponseWriter, r *http.Request) {
+	policy, err := app.securityPolicy.Get()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = securityForm{RequireAdminTwoFactor: policy.RequireAdminTwoFactor}
+
+	app.render(w, r, http.StatusOK, "security.gohtml", data)
+}
+
+func (app *application) securityPolicyPost(w http.ResponseWriter, r *http.Request) {
+	var form securityForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.securityPolicy.Update(models.SecurityPolicy{RequireAdminTwoFactor: form.RequireAdminTwoFactor}); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Security policy saved")
+
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
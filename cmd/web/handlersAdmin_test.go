@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+)
+
+func TestAuditLog(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// A failed login is recorded against the email that was tried.
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{
+		"email":      {"foo@bar.com"},
+		"password":   {"wrong"},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+	code, _, _ := ts.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	code, _, _ = ts.get(t, "/files/view/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+
+	// Recipients can't see the log.
+	code, _, _ = ts.get(t, "/admin/audit")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	audit := app.auditLog.(*mocks.AuditModel)
+	assert.Equal(t, strings.Join(audit.Actions(), " "), "login-failed login view")
+	assert.Equal(t, audit.Events[0].ActorEmail, "foo@bar.com")
+	assert.Equal(t, audit.Events[0].IP, "127.0.0.1")
+	assert.Equal(t, audit.Events[2].ActorId, 3)
+	assert.Equal(t, audit.Events[2].Target, mocks.FileToken)
+
+	ts.login(t, "admin@example.com", "pa$$word")
+
+	code, _, body = ts.get(t, "/admin/audit?file="+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Big Important Document")
+	assert.StringContains(t, body, "/admin/audit.csv?file="+mocks.FileToken)
+
+	code, _, _ = ts.get(t, "/admin/audit?from=yesterday")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	code, header, body := ts.get(t, "/admin/audit.csv?user=foo@bar.com")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, header.Get("Content-Type"), "text/csv; charset=utf-8")
+	assert.StringContains(t, header.Get("Content-Disposition"), "attachment; filename=\"audit-")
+
+	lines := strings.Split(body, "\n")
+	assert.Equal(t, len(lines), 4)
+	assert.StringContains(t, lines[0], "Time,Action,User ID,User")
+	assert.StringContains(t, lines[1], ",view,3,foo@bar.com,127.0.0.1,")
+}
+
+func TestCSVSafe(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "Plain", value: "report.pdf", want: "report.pdf"},
+		{name: "Empty", value: "", want: ""},
+		{name: "Formula", value: "=HYPERLINK(\"x\")", want: "'=HYPERLINK(\"x\")"},
+		{name: "Plus", value: "+1 report", want: "'+1 report"},
+		{name: "At", value: "@SUM(A1)", want: "'@SUM(A1)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, csvSafe(tt.value), tt.want)
+		})
+	}
+}
+
+func TestAuditUserDelete(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "admin@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/users/")
+	form := url.Values{"csrf_token": {extractCSRFToken(t, body)}}
+
+	code, _, _ := ts.postForm(t, "/user/delete/2", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	events, err := app.auditLog.List(models.AuditFilter{Target: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Action, models.AuditUserDelete)
+	assert.Equal(t, events[0].ActorEmail, "admin@example.com")
+}
+
+func TestUploadPolicy(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Only admins can see or change the policy.
+	ts.login(t, "Abar@example.com", "pa$$word")
+	code, _, _ := ts.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	ts.login(t, "admin@example.com", "pa$$word")
+
+	code, _, body := ts.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, `value="exe, com, scr, bat, cmd, msi, vbs, ps1"`)
+	assert.StringContains(t, body, `name="user_max_size" value="2048"`)
+
+	tests := []struct {
+		name      string
+		form      url.Values
+		wantCode  int
+		wantBody  string
+		wantSaved models.UploadPolicy
+	}{
+		{
+			name: "Valid",
+			form: url.Values{
+				"allowed_extensions": {".PDF, docx\njpg pdf"},
+				"blocked_types":      {"application/x-msdownload image/*"},
+				"guest_max_size":     {"10"},
+				"user_max_size":      {""},
+				"admin_max_size":     {"0"},
+			},
+			wantCode: http.StatusSeeOther,
+			wantSaved: models.UploadPolicy{
+				AllowedExtensions: []string{"pdf", "docx", "jpg"},
+				BlockedTypes:      []string{"application/x-msdownload", "image/*"},
+				GuestMaxSize:      10 << 20,
+			},
+		},
+		{
+			name:     "Bad Extension",
+			form:     url.Values{"blocked_extensions": {"tar.gz"}},
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "&#34;tar.gz&#34; isn&#39;t a file extension",
+		},
+		{
+			name:     "Bad Type",
+			form:     url.Values{"allowed_types": {"pdf"}},
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "&#34;pdf&#34; isn&#39;t a file type like application/pdf or image/*",
+		},
+		{
+			name:     "Bad Size",
+			form:     url.Values{"guest_max_size": {"-1"}},
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This field must be a whole number of MB",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, body := ts.get(t, "/admin/policy")
+			tt.form.Set("csrf_token", extractCSRFToken(t, body))
+
+			code, _, body := ts.postForm(t, "/admin/policy", tt.form)
+			assert.Equal(t, code, tt.wantCode)
+			assert.StringContains(t, body, tt.wantBody)
+
+			if tt.wantCode == http.StatusSeeOther {
+				saved, err := app.uploadPolicy.Get()
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, strings.Join(saved.AllowedExtensions, ","), strings.Join(tt.wantSaved.AllowedExtensions, ","))
+				assert.Equal(t, strings.Join(saved.BlockedExtensions, ","), strings.Join(tt.wantSaved.BlockedExtensions, ","))
+				assert.Equal(t, strings.Join(saved.BlockedTypes, ","), strings.Join(tt.wantSaved.BlockedTypes, ","))
+				assert.Equal(t, saved.GuestMaxSize, tt.wantSaved.GuestMaxSize)
+				assert.Equal(t, saved.UserMaxSize, tt.wantSaved.UserMaxSize)
+				assert.Equal(t, saved.AdminMaxSize, tt.wantSaved.AdminMaxSize)
+			}
+		})
+	}
+}
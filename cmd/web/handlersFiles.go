@@ -3,27 +3,140 @@ package main
 import (
 	"errors"
 	"fmt"
-	"github.com/google/safeopen"
 	"io"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	//Internal
 	"fileshare/internal/models"
+	"fileshare/internal/storage"
 	"fileshare/internal/validator"
 )
 
+// maxRecipients is how many people one upload can be shared with.
+const maxRecipients = 50
+
+// maxDownloadLimit is the biggest download limit a sender can set, 0 means no limit at all.
+const maxDownloadLimit = 1000
+
+// recipientFields are the name and email fields for who a file goes to, on both the create and the
+// edit forms.
+type recipientFields struct {
+	RecipientNames  []string `form:"recipientName"`
+	RecipientEmails []string `form:"recipientEmail"`
+}
+
 type fileCreateForm struct {
+	recipientFields
 	DocName             string `form:"docName"`
-	RecipientUserName   string `form:"recipientName"`
-	RecipientEmail      string `form:"recipientEmail"`
 	SenderUserName      string `form:"senderName"`
 	SenderEmail         string `form:"senderEmail"`
 	Expires             int    `form:"expires"`
+	MaxDownloads        int    `form:"maxDownloads"`
 	validator.Validator `form:"-"`
 }
 
+// validate checks the fields of the create form, the file itself is checked by the handlers.
+func (form *fileCreateForm) validate() {
+	form.checkRecipients(&form.Validator)
+	form.CheckField(validator.NotBlank(form.SenderUserName),
+		"senderName", "This field cannot be blank")
+	form.CheckField(validator.Matches(form.SenderEmail, validator.EmailRX),
+		"senderEmail", "This field must be a valid email address")
+	form.CheckField(validator.NotBlank(form.SenderEmail),
+		"senderEmail", "This field cannot be blank")
+	form.CheckField(validator.PermittedValue(form.Expires, 1, 7, 365),
+		"expires", "This field must equal 1, 7 or 365")
+	form.CheckField(form.MaxDownloads >= 0 && form.MaxDownloads <= maxDownloadLimit,
+		"maxDownloads", fmt.Sprintf("This field must be between 0 (no limit) and %d", maxDownloadLimit))
+}
+
+// checkRecipients adds any problems with the recipient fields to v.
+func (form recipientFields) checkRecipients(v *validator.Validator) {
+	recipients, paired := form.recipients()
+
+	v.CheckField(paired, "recipientName", "Each recipient needs a name and an email address")
+	v.CheckField(len(recipients) > 0,
+		"recipientEmail", "This field cannot be blank")
+	v.CheckField(len(recipients) <= maxRecipients,
+		"recipientEmail", fmt.Sprintf("A file can be shared with at most %d people", maxRecipients))
+	for _, r := range recipients {
+		v.CheckField(validator.Matches(r.Email, validator.EmailRX),
+			"recipientEmail", "This field must be a valid email address")
+	}
+}
+
+// recipients works out who the file is going to. The name and email fields come in pairs, one pair
+// per row on the page, and each field can also hold a comma separated list so more than one person
+// can be added without JavaScript. Anyone listed twice is only kept once. It reports false if a row
+// doesn't have as many names as emails.
+func (form recipientFields) recipients() ([]models.Recipient, bool) {
+	var (
+		recipients []models.Recipient
+		paired     = true
+		seen       = map[string]bool{}
+	)
+
+	for i := range max(len(form.RecipientNames), len(form.RecipientEmails)) {
+		names := splitList(form.RecipientNames, i)
+		emails := splitList(form.RecipientEmails, i)
+
+		if len(names) != len(emails) {
+			paired = false
+			continue
+		}
+
+		for j, email := range emails {
+			if seen[strings.ToLower(email)] {
+				continue
+			}
+			seen[strings.ToLower(email)] = true
+
+			recipients = append(recipients, models.Recipient{Name: names[j], Email: email})
+		}
+	}
+
+	return recipients, paired
+}
+
+// RecipientRows is the name and email fields as they were sent, paired up for showing the form
+// again. There is always at least one row.
+func (form recipientFields) RecipientRows() []models.Recipient {
+	rows := make([]models.Recipient, max(len(form.RecipientNames), len(form.RecipientEmails), 1))
+
+	for i := range rows {
+		if i < len(form.RecipientNames) {
+			rows[i].Name = form.RecipientNames[i]
+		}
+		if i < len(form.RecipientEmails) {
+			rows[i].Email = form.RecipientEmails[i]
+		}
+	}
+
+	return rows
+}
+
+// splitList splits the i'th value of a repeated field on commas, leaving out blanks.
+func splitList(values []string, i int) []string {
+	if i >= len(values) {
+		return nil
+	}
+
+	var list []string
+
+	for _, item := range strings.Split(values[i], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
 // home Want to show a different page for guest, admin, regular users and non-authenticated users.
 // All users get authenticated, so we need to filter on guest and admin to limit views, also to not
 // show duplicate home pages.
@@ -93,30 +206,35 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) fileView(w http.ResponseWriter, r *http.Request) {
-	/*if !app.isAuthenticated(r) {
-		data := app.newTemplateData(r)
-		app.render(w, r, http.StatusOK, "home.gohtml", data)
-		return
-	}*/
+	sharedF := app.sharedFileFromContext(r)
 
-	id, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil || id < 1 {
-		http.NotFound(w, r)
-		return
-	}
+	email := app.sessionManager.GetString(r.Context(), "authenticatedUserEmail")
 
-	sharedF, err := app.sharedFile.Get(id)
+	versions, err := app.sharedFile.Versions(sharedF.Id)
 	if err != nil {
-		if errors.Is(err, models.ErrNoRecord) {
-			http.NotFound(w, r)
-		} else {
-			app.serverError(w, r, err)
-		}
+		app.serverError(w, r, err)
 		return
 	}
 
 	data := app.newTemplateData(r)
 	data.SharedFile = sharedF
+	data.FileVersions = versions
+	data.CanManage = sharedF.CanDelete(email, app.isAdmin(r))
+
+	// Show the other files it was uploaded with as well.
+	if sharedF.ShareToken != "" {
+		files, err := app.sharedFile.GetShare(sharedF.ShareToken)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, r, err)
+			return
+		}
+
+		data.ShareToken = sharedF.ShareToken
+		data.SharedFiles = app.viewableFiles(r, files)
+	}
+
+	app.audit(r, models.AuditEvent{Action: models.AuditView, TargetType: models.AuditTargetFile,
+		Target: sharedF.Token, Detail: sharedF.DocName})
 
 	app.render(w, r, http.StatusOK, "view.gohtml", data)
 }
@@ -128,10 +246,19 @@ func (app *application) fileCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Start the sender off as the logged-in user, that's who can see the file afterwards.
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserID"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
 	data := app.newTemplateData(r)
 
 	data.Form = fileCreateForm{
-		Expires: 365,
+		Expires:        365,
+		SenderUserName: user.Name,
+		SenderEmail:    user.Email,
 	}
 	app.render(w, r, http.StatusOK, "create.gohtml", data)
 }
@@ -145,33 +272,36 @@ func (app *application) fileCreatePost(w http.ResponseWriter, r *http.Request) {
 
 	var form fileCreateForm
 
+	policy := app.uploadPolicyFromContext(r)
+
 	if err := app.decodePostForm(r, &form); err != nil {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	file, fHeader, err := r.FormFile("uploadFile")
-	if err != nil {
-		app.logger.Error("Handler Error: ", err.Error(), "error")
+	var fHeaders []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		fHeaders = r.MultipartForm.File["uploadFile"]
+	}
+
+	if len(fHeaders) == 0 {
+		app.logger.Error("Handler Error: ", http.ErrMissingFile.Error(), "error")
 		data := app.newTemplateData(r)
 		data.Form = form
 		app.render(w, r, http.StatusUnsupportedMediaType, "create.gohtml", data)
+		return
 	}
 
-	defer file.Close()
+	form.validate()
+	form.CheckField(len(fHeaders) <= maxShareFiles,
+		"uploadFile", fmt.Sprintf("At most %d files can be sent at once", maxShareFiles))
 
-	form.CheckField(validator.NotBlank(form.RecipientUserName),
-		"recipientName", "This field cannot be blank")
-	form.CheckField(validator.NotBlank(form.RecipientEmail),
-		"recipientEmail", "This field cannot be blank")
-	form.CheckField(validator.Matches(form.RecipientEmail, validator.EmailRX),
-		"recipientEmail", "This field must be a valid email address")
-	form.CheckField(validator.NotBlank(form.SenderUserName),
-		"senderName", "This field cannot be blank")
-	form.CheckField(validator.Matches(form.SenderEmail, validator.EmailRX),
-		"senderEmail", "This field must be a valid email address")
-	form.CheckField(validator.NotBlank(form.SenderEmail),
-		"senderEmail", "This field cannot be blank")
+	for _, fHeader := range fHeaders {
+		if err := app.checkUploadedFile(r, &form.Validator, policy, fHeader); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
 
 	if !form.Valid() {
 		data := app.newTemplateData(r)
@@ -180,85 +310,677 @@ func (app *application) fileCreatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	password := app.RandPasswordGen(15)
-
-	//If there are no errors let's copy the file
-	if fHeader.Size > 0 {
-		f, _ := safeopen.CreateAt("./uploads/", fHeader.Filename)
-		defer f.Close()
+	//If there are no errors let's encrypt the files and hand them to the storage backend, they are
+	//stored under random keys and the original names are only kept as metadata on the files rows
+	files := make([]models.SharedFile, 0, len(fHeaders))
 
-		_, err := io.Copy(f, file)
+	for _, fHeader := range fHeaders {
+		stored, err := app.storeUploadedFile(fHeader)
 		if err != nil {
+			app.removeStoredFiles(files)
+			app.serverError(w, r, err)
 			return
 		}
+
+		files = append(files, stored.sharedFile(fHeader.Filename))
 	}
 
-	//Insert(docName, senderUserName, senderEmail, recipientUserName, recipientEmail,
-	//		password string, expiresAt int) (int, error)
-	id, err := app.sharedFile.Insert(fHeader.Filename, form.SenderUserName, form.SenderEmail, form.RecipientUserName,
-		form.RecipientEmail, password, form.Expires)
+	path, err := app.shareFiles(r, form, files)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	app.logger.Info("File uploaded", "id: ", id)
+	app.sessionManager.Put(r.Context(), "flash", uploadedFlash(files))
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
 
-	//Let's send some mail
-	if err = app.config.SendMail(form.RecipientUserName, form.SenderUserName, form.RecipientEmail,
-		form.SenderEmail, fHeader.Filename, password); err != nil {
-		app.serverError(w, r, err)
+// uploadedFlash is the message for the sender once files are uploaded, which says if the virus
+// scanner stopped any of them being sent.
+func uploadedFlash(files []models.SharedFile) string {
+	var rejected int
+	for _, f := range files {
+		if f.Rejected != "" {
+			rejected++
+		}
 	}
-	app.logger.Info("Email sent! ", "email: ", form.RecipientEmail)
 
-	// Insert(name, email, password string, admin, user, guest, disabled bool) error
-	if err := app.users.Insert(form.RecipientUserName, form.RecipientEmail, password, false, false,
-		true, false); err != nil {
-		if errors.Is(err, models.ErrDuplicateEmail) {
-			app.sessionManager.Put(r.Context(), "flash", "Email address is already in use, no new account created")
-		} else {
-			app.serverError(w, r, err)
+	switch {
+	case rejected == 0:
+		return "File successfully uploaded!"
+	case rejected == len(files):
+		return "The virus scanner found a problem with your upload, it was not sent"
+	default:
+		return fmt.Sprintf("The virus scanner found a problem with %d of the files, they were not sent", rejected)
+	}
+}
+
+// checkUpload adds an error for the uploadFile field to v if policy doesn't let the current user
+// upload a file called name of size bytes. head is the start of its content for sniffing the type,
+// which is only checked when there is one.
+func (app *application) checkUpload(r *http.Request, v *validator.Validator, policy models.UploadPolicy,
+	name string, size int64, head []byte) {
+	v.CheckField(policy.AllowsExtension(name), "uploadFile",
+		fmt.Sprintf("%s can't be uploaded, that kind of file isn't allowed", name))
+
+	if head != nil {
+		contentType, _, _ := strings.Cut(sniffType(head), ";")
+		v.CheckField(policy.AllowsType(contentType), "uploadFile",
+			fmt.Sprintf("%s can't be uploaded, %s files aren't allowed", name, contentType))
+	}
+
+	limit := policy.MaxSize(app.isAdmin(r), app.isUser(r))
+	v.CheckField(limit == 0 || size <= limit, "uploadFile",
+		fmt.Sprintf("%s is too big, files can be at most %s", name, humanSize(limit)))
+}
+
+// checkUploadedFile is checkUpload for one of the files from a multipart form.
+func (app *application) checkUploadedFile(r *http.Request, v *validator.Validator, policy models.UploadPolicy,
+	fHeader *multipart.FileHeader) error {
+	file, err := fHeader.Open()
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	app.checkUpload(r, v, policy, fHeader.Filename, fHeader.Size, head[:n])
+
+	return nil
+}
+
+// storeUploadedFile scans and stores one of the files from a multipart form.
+func (app *application) storeUploadedFile(fHeader *multipart.FileHeader) (storedFile, error) {
+	file, err := fHeader.Open()
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	defer file.Close()
+
+	return app.storeScannedFile(file)
+}
+
+// storedKeys returns the storage keys of the content of every version of f, which all need removing
+// along with it.
+func (app *application) storedKeys(f models.SharedFile) ([]string, error) {
+	versions, err := app.sharedFile.Versions(f.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{f.StorageKey}
+	for _, v := range versions {
+		if !slices.Contains(keys, v.StorageKey) {
+			keys = append(keys, v.StorageKey)
+		}
+	}
+
+	return keys, nil
+}
+
+// removeStoredFiles cleans up files that were stored but never made it into the database.
+func (app *application) removeStoredFiles(files []models.SharedFile) {
+	for _, f := range files {
+		app.removeStored(f.StorageKey)
+	}
+}
+
+// shareFiles records stored uploads and lets each recipient know about them, creating a guest account
+// for anyone that doesn't have one yet. Files uploaded together are grouped into a share. Files the
+// virus scanner rejected are recorded but the recipients aren't told about them, the sender is. It
+// returns the path of the page for the file, or the share, and is used by both the plain form post
+// and resumable uploads.
+func (app *application) shareFiles(r *http.Request, form fileCreateForm, files []models.SharedFile) (string, error) {
+	recipients, _ := form.recipients()
+
+	var docNames, cleanNames []string
+
+	for i := range files {
+		files[i].SenderName = form.SenderUserName
+		files[i].SenderEmail = form.SenderEmail
+		files[i].Recipients = recipients
+		files[i].MaxDownloads = form.MaxDownloads
+		docNames = append(docNames, files[i].DocName)
+
+		if files[i].Rejected == "" {
+			cleanNames = append(cleanNames, files[i].DocName)
+		}
+	}
+
+	var path, targetType, target string
+
+	if len(files) == 1 {
+		token, err := app.sharedFile.Insert(files[0], form.Expires)
+		if err != nil {
+			return "", err
+		}
+
+		app.logger.Info("File uploaded", "filename", files[0].DocName, "recipients", len(recipients))
+		app.audit(r, models.AuditEvent{Action: models.AuditUpload, TargetType: models.AuditTargetFile,
+			Target: token, Detail: files[0].DocName})
+		path = "/files/view/" + token
+		targetType, target = models.AuditTargetFile, token
+	} else {
+		token, err := app.sharedFile.InsertShare(files, form.Expires)
+		if err != nil {
+			return "", err
 		}
+
+		app.logger.Info("Share uploaded", "files", len(files), "recipients", len(recipients))
+		app.audit(r, models.AuditEvent{Action: models.AuditUpload, TargetType: models.AuditTargetShare,
+			Target: token, Detail: strings.Join(docNames, ", ")})
+		path = "/shares/view/" + token
+		targetType, target = models.AuditTargetShare, token
+	}
+
+	for _, f := range files {
+		if f.Rejected != "" {
+			app.rejectedUpload(r, f, targetType, target)
+		}
+	}
+
+	// Nobody can see any of it, not even the sender
+	if len(cleanNames) == 0 {
+		return "/", nil
+	}
+
+	if err := app.inviteRecipients(recipients, form.SenderUserName, form.SenderEmail, cleanNames, path); err != nil {
+		return "", err
 	}
 
-	app.logger.Info("User created! ", "user: ", form.RecipientEmail)
+	return path, nil
+}
+
+// rejectedUpload records that the virus scanner rejected a file, uploaded as or to the given audit
+// target, and tells whoever sent it. Problems telling them are only logged.
+func (app *application) rejectedUpload(r *http.Request, f models.SharedFile, targetType, target string) {
+	app.logger.Warn("Upload rejected by virus scanner", "filename", f.DocName, "signature", f.Rejected,
+		"key", f.StorageKey)
+	app.audit(r, models.AuditEvent{Action: models.AuditRejected, TargetType: targetType, Target: target,
+		Detail: f.DocName + ": " + f.Rejected})
+
+	if err := app.config.SendRejectedNotice(f.SenderName, f.SenderEmail, f.DocName, f.Rejected); err != nil {
+		app.logger.Error("Error sending rejected notice", "filename", f.DocName, "error", err.Error())
+	}
+}
+
+// inviteRecipients emails each recipient a link to path, where the files named docNames are, creating
+// a guest account for anyone that doesn't have one yet. See recipientLink for who gets a magic link.
+func (app *application) inviteRecipients(recipients []models.Recipient, senderName, senderEmail string,
+	docNames []string, path string) error {
+	for _, recipient := range recipients {
+		// Recipients without an account get a guest one. Its password is random and never sent
+		// anywhere, guests sign in with the magic links they are emailed.
+		// Insert(name, email, password string, admin, user, guest, disabled bool) error
+		err := app.users.Insert(recipient.Name, recipient.Email, app.RandPasswordGen(32), false, false,
+			true, false)
+		if err == nil {
+			app.logger.Info("User created! ", "user: ", recipient.Email)
+		} else if !errors.Is(err, models.ErrDuplicateEmail) {
+			return err
+		}
+
+		user, err := app.users.GetByEmail(recipient.Email)
+		if err != nil {
+			return err
+		}
+
+		link, err := app.recipientLink(user, path)
+		if err != nil {
+			return err
+		}
 
-	app.sessionManager.Put(r.Context(), "flash", "File successfully uploaded!")
-	http.Redirect(w, r, fmt.Sprintf("/files/view/%d", id), http.StatusSeeOther)
+		//Let's send some mail
+		if err := app.config.SendMail(recipient.Name, senderName, recipient.Email,
+			senderEmail, strings.Join(docNames, ", "), link); err != nil {
+			return err
+		}
+		app.logger.Info("Email sent! ", "email: ", recipient.Email)
+	}
+
+	return nil
 }
 
+// downloadTimeout replaces the server's WriteTimeout for a download, with more on top for a big file
+// so it can be sent at downloadRate (in bytes a second).
+const (
+	downloadTimeout = 10 * time.Minute
+	downloadRate    = 256 << 10
+)
+
 func (app *application) fileDownload(w http.ResponseWriter, r *http.Request) {
 	if !app.isAuthenticated(r) {
 		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
 
-	file := r.PathValue("file")
-	http.ServeFile(w, r, "./uploads/"+file)
+	sharedF := app.sharedFileFromContext(r)
+
+	app.serveSharedFile(w, r, sharedF, sharedF.CreatedAt)
 }
 
-func (app *application) fileDelete(w http.ResponseWriter, r *http.Request) {
+// fileDownloadVersion downloads an older version of a file. It counts as a download of the file the
+// same as the latest does.
+func (app *application) fileDownloadVersion(w http.ResponseWriter, r *http.Request) {
 	if !app.isAuthenticated(r) {
 		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
 
-	id, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil || id < 1 {
+	sharedF := app.sharedFileFromContext(r)
+
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version < 1 {
 		http.NotFound(w, r)
+		return
 	}
 
-	if err := app.sharedFile.Remove(id); err != nil {
+	v, err := app.sharedFile.GetVersion(sharedF.Id, version)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.NotFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	sharedF.Version = v.Version
+	sharedF.DocName = v.DocName
+	sharedF.StorageKey = v.StorageKey
+	sharedF.WrappedKey = v.WrappedKey
+	sharedF.ContentType = v.ContentType
+	sharedF.Size = v.Size
+	sharedF.Checksum = v.Checksum
+
+	app.serveSharedFile(w, r, sharedF, v.UploadedAt)
+}
+
+// serveSharedFile sends the content of sharedF and records the download, modTime is when that
+// content was uploaded.
+func (app *application) serveSharedFile(w http.ResponseWriter, r *http.Request, sharedF models.SharedFile,
+	modTime time.Time) {
+	f, _, err := app.openSharedFile(sharedF)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			http.NotFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	// ServeContent takes care of Range, If-Range and the other conditional headers using the ETag
+	// and modification time. A stored file never changes, so its key makes a good ETag.
+	h := w.Header()
+	h.Set("Content-Type", fileContentType(sharedF.DocName, sharedF.ContentType))
+	h.Set("Content-Disposition", contentDisposition(sharedF.DocName))
+	h.Set("ETag", fmt.Sprintf(`"%s"`, sharedF.StorageKey))
+	h.Set("Cache-Control", "private")
+	h.Set("X-Content-Type-Options", "nosniff")
+	setDigest(h, sharedF.Checksum)
+
+	// A file with a download limit is only ever sent whole, otherwise the rest of it could be
+	// fetched over and over with range requests that aren't counted, or a counted download could
+	// end up as an empty 304.
+	if sharedF.MaxDownloads > 0 {
+		for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+			r.Header.Del(name)
+		}
+	}
+
+	// Count a download when someone starts from the beginning, picking up a download where it
+	// left off with a range request is still the same download.
+	if r.Method == http.MethodGet && startsAtZero(r.Header.Get("Range")) {
+		email := app.sessionManager.GetString(r.Context(), "authenticatedUserEmail")
+		first, err := app.sharedFile.RecordDownload(sharedF.Id, email)
+		if err != nil {
+			// Someone else got the last download between loading the file and now
+			if errors.Is(err, models.ErrDownloadLimit) {
+				http.NotFound(w, r)
+			} else {
+				app.serverError(w, r, err)
+			}
+			return
+		}
+
+		app.audit(r, models.AuditEvent{Action: models.AuditDownload, TargetType: models.AuditTargetFile,
+			Target: sharedF.Token, Detail: sharedF.DocName})
+
+		if first {
+			app.background(func() {
+				app.notifySender([]models.SharedFile{sharedF}, email, "/files/view/"+sharedF.Token)
+			})
+		}
+	}
+
+	timeout := downloadTimeout + time.Duration(sharedF.Size/downloadRate)*time.Second
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout)); err != nil {
 		app.serverError(w, r, err)
+		return
 	}
 
-	file := fmt.Sprintf("./uploads/" + r.PathValue("file"))
+	content := newVerifyingReader(f, sharedF.Size, sharedF.Checksum)
+	http.ServeContent(w, r, sharedF.DocName, modTime, content)
 
-	if err := os.Remove(file); err != nil {
-		app.logger.Info("Error removing file", "error", err)
-	} else {
-		app.logger.Info("File removed", "filename", r.FormValue("DocName"))
+	if content.corrupt {
+		// The headers have gone already, so all that can be done is to cut the connection and leave
+		// the client with a download it can tell is incomplete.
+		app.logger.Error("Stored file doesn't match its checksum", "file", sharedF.Id, "version", sharedF.Version,
+			"key", sharedF.StorageKey)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// notifySender emails the sender of files that the recipient with email has downloaded them for the
+// first time, unless they have turned that off. linkPath is the page to see them on. The files all
+// have the same sender, one email covers a whole share. Senders without an account aren't emailed
+// as they'd have no way to turn it off. It's run in the background, problems are only logged, they're
+// no reason to hold up the download.
+func (app *application) notifySender(files []models.SharedFile, email, linkPath string) {
+	if len(files) == 0 {
+		return
+	}
+
+	sharedF := files[0]
+
+	sender, err := app.users.GetByEmail(sharedF.SenderEmail)
+	if err != nil {
+		if !errors.Is(err, models.ErrNoRecord) {
+			app.logger.Error("Error looking up sender", "file", sharedF.Id, "error", err.Error())
+		}
+		return
+	}
+
+	if !sender.NotifyDownloads || sender.Disabled {
+		return
+	}
+
+	recipient := models.Recipient{Name: email, Email: email}
+	for _, r := range sharedF.Recipients {
+		if strings.EqualFold(r.Email, email) {
+			recipient = r
+		}
+	}
+
+	docNames := make([]string, len(files))
+	for i, f := range files {
+		docNames[i] = f.DocName
+	}
+
+	err = app.config.SendDownloadNotice(sharedF.SenderName, sender.Email, recipient.Name, recipient.Email,
+		strings.Join(docNames, ", "), linkPath)
+	if err != nil {
+		app.logger.Error("Error sending download notice", "file", sharedF.Id, "error", err.Error())
+	}
+}
+
+// startsAtZero reports whether a Range header asks for the start of the file, which it does when
+// there isn't one at all.
+func startsAtZero(rangeHeader string) bool {
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+type fileExtendForm struct {
+	Days                int `form:"days"`
+	validator.Validator `form:"-"`
+}
+
+// fileExtend pushes back when a file expires, for a file in a share the whole share is extended.
+func (app *application) fileExtend(w http.ResponseWriter, r *http.Request) {
+	sharedF := app.sharedFileFromContext(r)
+
+	var form fileExtendForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.PermittedValue(form.Days, 1, 7, 365), "days", "This field must equal 1, 7 or 365")
+
+	if !form.Valid() {
+		app.clientError(w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := app.sharedFile.Extend(sharedF.Id, form.Days); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("File extended", "file", sharedF.Id, "days", form.Days)
+	app.audit(r, models.AuditEvent{Action: models.AuditEdit, TargetType: models.AuditTargetFile,
+		Target: sharedF.Token, Detail: fmt.Sprintf("extended by %d days", form.Days)})
+
+	app.sessionManager.Put(r.Context(), "flash", "Expiry extended")
+	http.Redirect(w, r, "/files/view/"+sharedF.Token, http.StatusSeeOther)
+}
+
+// fileEditForm changes a file after it has been sent. The recipients and expiry apply to the whole
+// share when the file is in one, a new file only replaces this one. Expires is 0 to leave it alone,
+// otherwise it's days from now. Revoke takes the file away from everyone straight away.
+type fileEditForm struct {
+	recipientFields
+	Expires             int  `form:"expires"`
+	Revoke              bool `form:"revoke"`
+	validator.Validator `form:"-"`
+}
+
+func (form *fileEditForm) validate() {
+	// Nothing else matters when it's all going
+	if form.Revoke {
+		return
+	}
+
+	form.checkRecipients(&form.Validator)
+	form.CheckField(validator.PermittedValue(form.Expires, 0, 1, 7, 365),
+		"expires", "This field must equal 1, 7 or 365")
+}
+
+func (app *application) fileEdit(w http.ResponseWriter, r *http.Request) {
+	sharedF := app.sharedFileFromContext(r)
+
+	var form fileEditForm
+	for _, r := range sharedF.Recipients {
+		form.RecipientNames = append(form.RecipientNames, r.Name)
+		form.RecipientEmails = append(form.RecipientEmails, r.Email)
+	}
+
+	data := app.newTemplateData(r)
+	data.SharedFile = sharedF
+	data.Form = form
+
+	app.render(w, r, http.StatusOK, "edit.gohtml", data)
+}
+
+func (app *application) fileEditPost(w http.ResponseWriter, r *http.Request) {
+	sharedF := app.sharedFileFromContext(r)
+
+	var form fileEditForm
+
+	policy := app.uploadPolicyFromContext(r)
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.validate()
+
+	var fHeaders []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		fHeaders = r.MultipartForm.File["uploadFile"]
+	}
+	form.CheckField(len(fHeaders) <= 1, "uploadFile", "Only one file can replace this one")
+
+	if len(fHeaders) == 1 && !form.Revoke {
+		if err := app.checkUploadedFile(r, &form.Validator, policy, fHeaders[0]); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.SharedFile = sharedF
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "edit.gohtml", data)
+		return
+	}
+
+	// Everything but the content applies to every file in the share
+	files := []models.SharedFile{sharedF}
+	path := "/files/view/" + sharedF.Token
+
+	if sharedF.ShareToken != "" {
+		share, err := app.sharedFile.GetShare(sharedF.ShareToken)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, r, err)
+			return
+		}
+		if len(share) > 0 {
+			files = share
+			path = "/shares/view/" + sharedF.ShareToken
+		}
+	}
+
+	if form.Revoke {
+		// DATETIME columns round to the second, so it's gone from this second on
+		for _, f := range files {
+			f.Expires = time.Now().Truncate(time.Second)
+			if err := app.sharedFile.Update(f); err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+
+		app.logger.Info("File revoked", "file", sharedF.Id, "files", len(files))
+		app.audit(r, models.AuditEvent{Action: models.AuditEdit, TargetType: models.AuditTargetFile,
+			Target: sharedF.Token, Detail: "revoked"})
+
+		app.sessionManager.Put(r.Context(), "flash", "Access revoked")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	var replacement *storedFile
+	if len(fHeaders) == 1 {
+		stored, err := app.storeUploadedFile(fHeaders[0])
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		// There's no row to keep an infected replacement in quarantine with, so it goes straight away
+		if stored.Rejected != "" {
+			app.removeStored(stored.StorageKey)
+
+			rejected := stored.sharedFile(fHeaders[0].Filename)
+			rejected.SenderName = sharedF.SenderName
+			rejected.SenderEmail = sharedF.SenderEmail
+			app.rejectedUpload(r, rejected, models.AuditTargetFile, sharedF.Token)
+
+			form.AddFieldError("uploadFile", "The virus scanner found a problem with this file")
+
+			data := app.newTemplateData(r)
+			data.SharedFile = sharedF
+			data.Form = form
+			app.render(w, r, http.StatusUnprocessableEntity, "edit.gohtml", data)
+			return
+		}
+
+		replacement = &stored
+	}
+
+	recipients, _ := form.recipients()
+
+	var added []models.Recipient
+	for _, recipient := range recipients {
+		if !sharedF.IsRecipient(recipient.Email) {
+			added = append(added, recipient)
+		}
+	}
+
+	docNames := make([]string, len(files))
+
+	for i, f := range files {
+		f.Recipients = recipients
+		if form.Expires > 0 {
+			f.Expires = time.Now().AddDate(0, 0, form.Expires)
+		}
+		if f.Id == sharedF.Id && replacement != nil {
+			f.DocName = fHeaders[0].Filename
+			f.StorageKey = replacement.StorageKey
+			f.WrappedKey = replacement.WrappedKey
+			f.ContentType = replacement.ContentType
+			f.Size = replacement.Size
+			f.Checksum = replacement.Checksum
+		}
+
+		if err := app.sharedFile.Update(f); err != nil {
+			if replacement != nil {
+				app.removeStoredFiles([]models.SharedFile{replacement.sharedFile("")})
+			}
+			app.serverError(w, r, err)
+			return
+		}
+
+		docNames[i] = f.DocName
+	}
+
+	if err := app.inviteRecipients(added, sharedF.SenderName, sharedF.SenderEmail, docNames, path); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("File edited", "file", sharedF.Id, "recipients", len(recipients), "added", len(added),
+		"replaced", replacement != nil)
+	app.audit(r, models.AuditEvent{Action: models.AuditEdit, TargetType: models.AuditTargetFile,
+		Target: sharedF.Token, Detail: strings.Join(docNames, ", ")})
+
+	app.sessionManager.Put(r.Context(), "flash", "File updated")
+	http.Redirect(w, r, "/files/view/"+sharedF.Token, http.StatusSeeOther)
+}
+
+func (app *application) fileDelete(w http.ResponseWriter, r *http.Request) {
+	if !app.isAuthenticated(r) {
+		app.clientError(w, http.StatusUnauthorized)
+		return
+	}
+
+	sharedF := app.sharedFileFromContext(r)
+
+	// The versions go with the row, so find where their content is first
+	keys, err := app.storedKeys(sharedF)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.sharedFile.Remove(sharedF.Id); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditEvent{Action: models.AuditDelete, TargetType: models.AuditTargetFile,
+		Target: sharedF.Token, Detail: sharedF.DocName})
+
+	for _, key := range keys {
+		if err := app.storage.Delete(key); err != nil {
+			app.logger.Info("Error removing file", "key", key, "error", err)
+		}
 	}
+	app.logger.Info("File removed", "filename", sharedF.DocName, "versions", len(keys))
 
 	app.sessionManager.Put(r.Context(), "flash", "File successfully deleted!")
 	http.Redirect(w, r, fmt.Sprintf("/"), http.StatusSeeOther)
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
 )
 
 func TestPing(t *testing.T) {
@@ -19,7 +29,6 @@ func TestPing(t *testing.T) {
 	assert.Equal(t, body, "OK")
 }
 
-// This is broken due to not being logged in
 func TestFileView(t *testing.T) {
 	// Create a new instance of our application struct which uses the mocked
 	// dependencies.
@@ -29,6 +38,10 @@ func TestFileView(t *testing.T) {
 	ts := newTestServer(t, app.routes())
 	defer ts.Close()
 
+	// Files can only be viewed by the people they were shared between, so
+	// sign in as the sender of the mock file.
+	ts.login(t, "Abar@example.com", "pa$$word")
+
 	// Set up some table-driven tests to check the responses sent by our
 	// application for different URLs.
 	tests := []struct {
@@ -38,33 +51,28 @@ func TestFileView(t *testing.T) {
 		wantBody string
 	}{
 		{
-			name:     "Valid ID",
-			urlPath:  "/files/view/1",
+			name:     "Valid Token",
+			urlPath:  "/files/view/" + mocks.FileToken,
 			wantCode: http.StatusOK,
 			wantBody: "Abar@example.com",
 		},
 		{
-			name:     "Non-existent ID",
-			urlPath:  "/files/view/2",
+			name:     "Non-existent Token",
+			urlPath:  "/files/view/" + mocks.NewToken,
 			wantCode: http.StatusNotFound,
 		},
 		{
-			name:     "Negative ID",
-			urlPath:  "/files/view/-1",
-			wantCode: http.StatusNotFound,
-		},
-		{
-			name:     "Decimal ID",
-			urlPath:  "/files/view/1.23",
+			name:     "Numeric ID",
+			urlPath:  "/files/view/1",
 			wantCode: http.StatusNotFound,
 		},
 		{
-			name:     "String ID",
+			name:     "String Token",
 			urlPath:  "/files/view/foo",
 			wantCode: http.StatusNotFound,
 		},
 		{
-			name:     "Empty ID",
+			name:     "Empty Token",
 			urlPath:  "/files/view/",
 			wantCode: http.StatusNotFound,
 		},
@@ -83,6 +91,835 @@ func TestFileView(t *testing.T) {
 	}
 }
 
+func TestFileAccess(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        string
+		viewCode     int
+		downloadCode int
+		deleteCode   int
+	}{
+		{
+			name:         "Sender",
+			email:        "Abar@example.com",
+			viewCode:     http.StatusOK,
+			downloadCode: http.StatusOK,
+			deleteCode:   http.StatusSeeOther,
+		},
+		{
+			name:         "Recipient",
+			email:        "foo@bar.com",
+			viewCode:     http.StatusOK,
+			downloadCode: http.StatusOK,
+			deleteCode:   http.StatusNotFound,
+		},
+		{
+			name:         "Admin",
+			email:        "admin@example.com",
+			viewCode:     http.StatusOK,
+			downloadCode: http.StatusOK,
+			deleteCode:   http.StatusSeeOther,
+		},
+		{
+			name:         "Other User",
+			email:        "alice@example.com",
+			viewCode:     http.StatusNotFound,
+			downloadCode: http.StatusNotFound,
+			deleteCode:   http.StatusNotFound,
+		},
+		{
+			name:         "Anonymous",
+			viewCode:     http.StatusSeeOther,
+			downloadCode: http.StatusSeeOther,
+			deleteCode:   http.StatusSeeOther,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			err := app.storage.Put("0123456789abcdef0123456789abcdef", strings.NewReader("file contents"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			if tt.email != "" {
+				ts.login(t, tt.email, "pa$$word")
+			}
+
+			code, _, _ := ts.get(t, "/files/view/"+mocks.FileToken)
+			assert.Equal(t, code, tt.viewCode)
+
+			code, _, body := ts.get(t, "/files/download/"+mocks.FileToken)
+			assert.Equal(t, code, tt.downloadCode)
+			if code == http.StatusOK {
+				assert.Equal(t, body, "file contents")
+			}
+
+			code, _, _ = ts.get(t, "/files/delete/"+mocks.FileToken)
+			assert.Equal(t, code, tt.deleteCode)
+		})
+	}
+}
+
+func TestFileDownload(t *testing.T) {
+	app := newTestApplication(t)
+
+	err := app.storage.Put("0123456789abcdef0123456789abcdef", strings.NewReader("file contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	code, header, body := ts.request(t, http.MethodGet, "/files/download/"+mocks.FileToken, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, "file contents")
+	assert.Equal(t, header.Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equal(t, header.Get("Content-Disposition"),
+		`attachment; filename="Big Important Document"; filename*=UTF-8''Big%20Important%20Document`)
+	assert.Equal(t, header.Get("Accept-Ranges"), "bytes")
+	assert.Equal(t, header.Get("Repr-Digest"), "sha-256=:e7b596R6Y+aEklrzYIwFntzDceuBGIxIyXFIlvsQkf0=:")
+	assert.Equal(t, header.Get("Digest"), "SHA-256=e7b596R6Y+aEklrzYIwFntzDceuBGIxIyXFIlvsQkf0=")
+
+	etag := header.Get("ETag")
+	assert.Equal(t, etag, `"0123456789abcdef0123456789abcdef"`)
+	assert.Equal(t, header.Get("Last-Modified") != "", true)
+
+	// Only downloads from the start count towards the recipient's downloads.
+	files := app.sharedFile.(*mocks.SharedFileModel)
+	assert.Equal(t, len(files.Downloaded), 1)
+	assert.Equal(t, files.Downloaded[0], "foo@bar.com")
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "Range",
+			header:   http.Header{"Range": {"bytes=5-12"}},
+			wantCode: http.StatusPartialContent,
+			wantBody: "contents",
+		},
+		{
+			name:     "If-Range Matches",
+			header:   http.Header{"Range": {"bytes=0-3"}, "If-Range": {etag}},
+			wantCode: http.StatusPartialContent,
+			wantBody: "file",
+		},
+		{
+			name:     "If-Range Stale",
+			header:   http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"something else"`}},
+			wantCode: http.StatusOK,
+			wantBody: "file contents",
+		},
+		{
+			name:     "Unsatisfiable Range",
+			header:   http.Header{"Range": {"bytes=100-"}},
+			wantCode: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:     "Not Modified",
+			header:   http.Header{"If-None-Match": {etag}},
+			wantCode: http.StatusNotModified,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.request(t, http.MethodGet, "/files/download/"+mocks.FileToken, tt.header, nil)
+
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantBody != "" {
+				assert.Equal(t, body, tt.wantBody)
+			}
+		})
+	}
+
+	// Of those, "If-Range Matches", "If-Range Stale" and "Not Modified" started from the beginning.
+	assert.Equal(t, len(files.Downloaded), 4)
+}
+
+func TestFileDownloadSlow(t *testing.T) {
+	app := newTestApplication(t)
+
+	err := app.storage.Put("0123456789abcdef0123456789abcdef", strings.NewReader("file contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sending the file takes longer than the server's WriteTimeout.
+	app.storage = &slowStorage{Backend: app.storage, delay: 300 * time.Millisecond}
+
+	ts := newTimeoutTestServer(t, app.routes(), 200*time.Millisecond)
+	defer ts.Close()
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	code, _, body := ts.request(t, http.MethodGet, "/files/download/"+mocks.FileToken, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, "file contents")
+}
+
+func TestFileDownloadCorrupt(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The same size as what was uploaded but not the same content.
+	err := app.storage.Put("0123456789abcdef0123456789abcdef", strings.NewReader("file CONTENTS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	// A range of it can't be checked so it's sent.
+	code, _, body := ts.request(t, http.MethodGet, "/files/download/"+mocks.FileToken,
+		http.Header{"Range": {"bytes=0-3"}}, nil)
+	assert.Equal(t, code, http.StatusPartialContent)
+	assert.Equal(t, body, "file")
+
+	// The whole thing is cut off rather than passed off as the file that was uploaded.
+	rs, err := ts.Client().Get(ts.URL + "/files/download/" + mocks.FileToken)
+	if err == nil {
+		_, err = io.ReadAll(rs.Body)
+		rs.Body.Close()
+	}
+	assert.Equal(t, err != nil, true)
+}
+
+func TestFileDownloadLimit(t *testing.T) {
+	app := newTestApplication(t)
+
+	err := app.storage.Put("66666666666666666666666666666666", strings.NewReader("file contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	code, _, body := ts.get(t, "/files/view/"+mocks.LimitedFileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Downloads: 0 of 1")
+
+	// A file with a limit ignores ranges, it's always sent whole and counted.
+	code, _, body = ts.request(t, http.MethodGet, "/files/download/"+mocks.LimitedFileToken,
+		http.Header{"Range": {"bytes=5-"}}, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, "file contents")
+
+	// After that it's gone.
+	code, _, _ = ts.get(t, "/files/download/"+mocks.LimitedFileToken)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _, _ = ts.get(t, "/files/view/"+mocks.LimitedFileToken)
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestDownloadNotice(t *testing.T) {
+	app := newTestApplication(t)
+
+	err := app.storage.Put("0123456789abcdef0123456789abcdef", strings.NewReader("file contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// The sender sees nobody has downloaded it yet.
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/")
+	assert.StringContains(t, body, "Not yet")
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	// Only the first download by a recipient is worth an email.
+	for range 2 {
+		code, _, _ := ts.get(t, "/files/download/"+mocks.FileToken)
+		assert.Equal(t, code, http.StatusOK)
+	}
+
+	app.tasks.Wait()
+
+	config := app.config.(*mocks.ServerConfigModel)
+	assert.Equal(t, strings.Join(config.Notices, "\n"), "Abar@example.com: foo@bar.com downloaded Big Important Document")
+
+	// Senders can turn them off.
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body = ts.get(t, "/user/update/")
+	assert.StringContains(t, body, `name="notifyDownloads"`)
+
+	code, header, _ := ts.postForm(t, "/user/notifications", url.Values{"csrf_token": {extractCSRFToken(t, body)}})
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/update/")
+
+	sender, err := app.users.GetByEmail("Abar@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sender.NotifyDownloads, false)
+}
+
+// slowMail is the mock mail settings with a mail server that doesn't answer download notices until
+// release is closed.
+type slowMail struct {
+	*mocks.ServerConfigModel
+	release chan struct{}
+}
+
+func (m slowMail) SendDownloadNotice(sName, sEmail, rName, rEmail, fName, linkPath string) error {
+	<-m.release
+	return m.ServerConfigModel.SendDownloadNotice(sName, sEmail, rName, rEmail, fName, linkPath)
+}
+
+func TestDownloadNoticeSlowMail(t *testing.T) {
+	app := newTestApplication(t)
+
+	config := slowMail{&mocks.ServerConfigModel{}, make(chan struct{})}
+	app.config = config
+
+	err := app.storage.Put("0123456789abcdef0123456789abcdef", strings.NewReader("file contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	// The download doesn't wait for the email to the sender.
+	code, _, body := ts.get(t, "/files/download/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, "file contents")
+
+	close(config.release)
+	app.tasks.Wait()
+
+	assert.Equal(t, len(config.Notices), 1)
+}
+
+func TestFileExtend(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Recipients can't extend a file.
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/view/"+mocks.FileToken)
+	form := url.Values{"days": {"7"}, "csrf_token": {extractCSRFToken(t, body)}}
+
+	code, _, _ := ts.postForm(t, "/files/extend/"+mocks.FileToken, form)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body = ts.get(t, "/files/view/"+mocks.FileToken)
+	assert.StringContains(t, body, "/files/extend/"+mocks.FileToken)
+
+	form.Set("csrf_token", extractCSRFToken(t, body))
+
+	form.Set("days", "30")
+	code, _, _ = ts.postForm(t, "/files/extend/"+mocks.FileToken, form)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	form.Set("days", "7")
+	code, header, _ := ts.postForm(t, "/files/extend/"+mocks.FileToken, form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/files/view/"+mocks.FileToken)
+
+	files := app.sharedFile.(*mocks.SharedFileModel)
+	assert.Equal(t, files.Extended[1], 7)
+}
+
+func TestFileEdit(t *testing.T) {
+	app := newTestApplication(t)
+
+	err := app.storage.Put("0123456789abcdef0123456789abcdef", strings.NewReader("file contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Only the sender and admins can edit.
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	code, _, _ := ts.get(t, "/files/edit/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	code, _, body := ts.get(t, "/files/edit/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, `value="foo@bar.com"`)
+
+	// Swap the recipient for someone new and replace the content.
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	for k, v := range map[string]string{
+		"csrf_token":     extractCSRFToken(t, body),
+		"recipientName":  "Alice Jones",
+		"recipientEmail": "alice@example.com",
+		"expires":        "7",
+	} {
+		mw.WriteField(k, v)
+	}
+
+	fw, err := mw.CreateFormFile("uploadFile", "v2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "new contents")
+	mw.Close()
+
+	header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+
+	code, rsHeader, _ := ts.request(t, http.MethodPost, "/files/edit/"+mocks.FileToken, header, &buf)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, rsHeader.Get("Location"), "/files/view/"+mocks.FileToken)
+
+	// The file is in a share, so both files in it were updated but only this one was replaced.
+	updated := app.sharedFile.(*mocks.SharedFileModel).Updated
+	assert.Equal(t, len(updated), 2)
+	assert.Equal(t, updated[0].DocName, "v2.txt")
+	assert.Equal(t, updated[0].RecipientNames(), "Alice Jones")
+	assert.Equal(t, updated[0].Expires.After(time.Now().AddDate(0, 0, 6)), true)
+	assert.Equal(t, updated[1].DocName, "Appendix.txt")
+	assert.Equal(t, updated[1].RecipientNames(), "Alice Jones")
+
+	// The old content is kept as the previous version, and only the new recipient was sent a link.
+	_, err = app.storage.Stat("0123456789abcdef0123456789abcdef")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, updated[0].Size, int64(12))
+	assert.Equal(t, updated[0].Checksum, "6a5f63424a0c878f3b23b7a85dd453523605762e73f536f968f874e57f565d7e")
+
+	links := app.config.(*mocks.ServerConfigModel).Links
+	assert.Equal(t, len(links), 1)
+
+	f, _, err := app.openSharedFile(updated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "new contents")
+}
+
+func TestFileEditRevoke(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/edit/"+mocks.FileToken)
+	form := url.Values{"revoke": {"true"}, "csrf_token": {extractCSRFToken(t, body)}}
+
+	code, header, _ := ts.postForm(t, "/files/edit/"+mocks.FileToken, form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/")
+
+	updated := app.sharedFile.(*mocks.SharedFileModel).Updated
+	assert.Equal(t, len(updated), 2)
+	for _, f := range updated {
+		assert.Equal(t, f.Expires.After(time.Now()), false)
+		assert.Equal(t, f.RecipientNames(), "Susan Smith")
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	app := newTestApplication(t)
+
+	for key, content := range map[string]string{
+		"0123456789abcdef0123456789abcdef": "file contents",
+		"11111111111111111111111111111111": "draft contents",
+	} {
+		if err := app.storage.Put(key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	// The recipient gets the latest by default and can see what it replaced.
+	code, _, body := ts.get(t, "/files/view/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "2 (latest)")
+	assert.StringContains(t, body, "Draft Document.txt")
+	assert.StringContains(t, body, "14 B")
+	assert.StringContains(t, body, "5f26f4490e0380380ff36f1a56076163597ddf52cad6549da9800feef0deaa34")
+	assert.StringContains(t, body, "/files/download/"+mocks.FileToken+"/1")
+
+	code, _, body = ts.get(t, "/files/download/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, "file contents")
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+		wantBody string
+		wantName string
+	}{
+		{
+			name:     "Old Version",
+			urlPath:  "/files/download/" + mocks.FileToken + "/1",
+			wantCode: http.StatusOK,
+			wantBody: "draft contents",
+			wantName: "Draft Document.txt",
+		},
+		{
+			name:     "Latest Version",
+			urlPath:  "/files/download/" + mocks.FileToken + "/2",
+			wantCode: http.StatusOK,
+			wantBody: "file contents",
+			wantName: "Big Important Document",
+		},
+		{
+			name:     "Missing Version",
+			urlPath:  "/files/download/" + mocks.FileToken + "/3",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "Bad Version",
+			urlPath:  "/files/download/" + mocks.FileToken + "/foo",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "Another File",
+			urlPath:  "/files/download/" + mocks.ShareFileToken + "/1",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header, body := ts.request(t, http.MethodGet, tt.urlPath, nil, nil)
+
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, body, tt.wantBody)
+				assert.StringContains(t, header.Get("Content-Disposition"), tt.wantName)
+			}
+		})
+	}
+
+	// Deleting the file removes every version.
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	code, _, _ = ts.get(t, "/files/delete/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	objects, err := app.storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(objects), 0)
+}
+
+func TestFileCreateScanned(t *testing.T) {
+	tests := []struct {
+		name            string
+		files           map[string]string
+		scanErr         error
+		wantCode        int
+		wantLocation    string
+		wantRejected    []string
+		wantLinks       int
+		wantFlash       string
+		wantInserted    int
+		wantQuarantined int
+	}{
+		{
+			name:         "Clean",
+			files:        map[string]string{"one.txt": "first file"},
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/files/view/" + mocks.NewToken,
+			wantLinks:    1,
+			wantFlash:    "File successfully uploaded!",
+			wantInserted: 1,
+		},
+		{
+			name:            "Infected",
+			files:           map[string]string{"eicar.txt": eicar},
+			wantCode:        http.StatusSeeOther,
+			wantLocation:    "/",
+			wantRejected:    []string{"Abar@example.com: eicar.txt rejected for Eicar-Test-Signature"},
+			wantFlash:       "The virus scanner found a problem with your upload, it was not sent",
+			wantInserted:    1,
+			wantQuarantined: 1,
+		},
+		{
+			name:            "Partly Infected",
+			files:           map[string]string{"one.txt": "first file", "eicar.txt": "x" + eicar},
+			wantCode:        http.StatusSeeOther,
+			wantLocation:    "/shares/view/" + mocks.NewToken,
+			wantRejected:    []string{"Abar@example.com: eicar.txt rejected for Eicar-Test-Signature"},
+			wantLinks:       1,
+			wantFlash:       "The virus scanner found a problem with 1 of the files, they were not sent",
+			wantInserted:    2,
+			wantQuarantined: 1,
+		},
+		{
+			name:     "Scanner Down",
+			files:    map[string]string{"one.txt": "first file"},
+			scanErr:  errors.New("connection refused"),
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.scanner = &testScanner{err: tt.scanErr}
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, "Abar@example.com", "pa$$word")
+
+			_, _, body := ts.get(t, "/files/create")
+
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+
+			for k, v := range map[string]string{
+				"csrf_token":     extractCSRFToken(t, body),
+				"recipientName":  "Susan Smith",
+				"recipientEmail": "foo@bar.com",
+				"senderName":     "Cheryl Smith",
+				"senderEmail":    "Abar@example.com",
+				"expires":        "7",
+			} {
+				mw.WriteField(k, v)
+			}
+
+			for name, content := range tt.files {
+				fw, err := mw.CreateFormFile("uploadFile", name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.WriteString(fw, content)
+			}
+			mw.Close()
+
+			header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+
+			code, rsHeader, _ := ts.request(t, http.MethodPost, "/files/create", header, &buf)
+			assert.Equal(t, code, tt.wantCode)
+			assert.Equal(t, rsHeader.Get("Location"), tt.wantLocation)
+
+			inserted := app.sharedFile.(*mocks.SharedFileModel).Inserted
+			assert.Equal(t, len(inserted), tt.wantInserted)
+
+			// Rejected files are kept in quarantine, nothing is left behind when the scan fails.
+			objects, err := app.storage.List("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, len(objects), tt.wantInserted)
+
+			quarantined, err := app.storage.List(quarantinePrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, len(quarantined), tt.wantQuarantined)
+
+			for _, f := range inserted {
+				assert.Equal(t, strings.HasPrefix(f.StorageKey, quarantinePrefix), f.Rejected != "")
+			}
+
+			// The sender hears about rejected files, the recipient only gets a link to clean ones.
+			config := app.config.(*mocks.ServerConfigModel)
+			assert.Equal(t, strings.Join(config.Notices, "|"), strings.Join(tt.wantRejected, "|"))
+			assert.Equal(t, len(config.Links), tt.wantLinks)
+
+			if tt.wantRejected != nil {
+				assert.Equal(t, slices.Contains(app.auditLog.(*mocks.AuditModel).Actions(), models.AuditRejected), true)
+			}
+
+			if tt.wantFlash != "" {
+				_, _, body = ts.get(t, "/user/update/")
+				assert.StringContains(t, body, tt.wantFlash)
+			}
+		})
+	}
+}
+
+func TestFileEditScanned(t *testing.T) {
+	app := newTestApplication(t)
+	app.scanner = &testScanner{}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/edit/"+mocks.FileToken)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	for k, v := range map[string]string{
+		"csrf_token":     extractCSRFToken(t, body),
+		"recipientName":  "Susan Smith",
+		"recipientEmail": "foo@bar.com",
+	} {
+		mw.WriteField(k, v)
+	}
+
+	fw, err := mw.CreateFormFile("uploadFile", "eicar.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, eicar)
+	mw.Close()
+
+	header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+
+	code, _, body := ts.request(t, http.MethodPost, "/files/edit/"+mocks.FileToken, header, &buf)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "The virus scanner found a problem with this file")
+
+	// Nothing was changed or kept.
+	assert.Equal(t, len(app.sharedFile.(*mocks.SharedFileModel).Updated), 0)
+
+	objects, err := app.storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(objects), 0)
+
+	assert.Equal(t, len(app.config.(*mocks.ServerConfigModel).Notices), 1)
+}
+
+func TestFileCreateFormRecipients(t *testing.T) {
+	tests := []struct {
+		name       string
+		names      []string
+		emails     []string
+		wantNames  string
+		wantCount  int
+		wantPaired bool
+	}{
+		{
+			name:       "One",
+			names:      []string{"Susan Smith"},
+			emails:     []string{"foo@bar.com"},
+			wantNames:  "Susan Smith",
+			wantCount:  1,
+			wantPaired: true,
+		},
+		{
+			name:       "Repeated Fields",
+			names:      []string{"Susan Smith", "Alice Jones", ""},
+			emails:     []string{"foo@bar.com", "alice@example.com", ""},
+			wantNames:  "Susan Smith, Alice Jones",
+			wantCount:  2,
+			wantPaired: true,
+		},
+		{
+			name:       "Comma Separated",
+			names:      []string{"Susan Smith, Alice Jones"},
+			emails:     []string{"foo@bar.com,alice@example.com"},
+			wantNames:  "Susan Smith, Alice Jones",
+			wantCount:  2,
+			wantPaired: true,
+		},
+		{
+			name:       "Duplicate Email",
+			names:      []string{"Susan Smith", "Susan"},
+			emails:     []string{"foo@bar.com", "FOO@bar.com"},
+			wantNames:  "Susan Smith",
+			wantCount:  1,
+			wantPaired: true,
+		},
+		{
+			name:       "Missing Name",
+			names:      []string{"Susan Smith"},
+			emails:     []string{"foo@bar.com", "alice@example.com"},
+			wantNames:  "Susan Smith",
+			wantCount:  1,
+			wantPaired: false,
+		},
+		{
+			name:       "None",
+			wantCount:  0,
+			wantPaired: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := recipientFields{RecipientNames: tt.names, RecipientEmails: tt.emails}
+
+			recipients, paired := form.recipients()
+			assert.Equal(t, len(recipients), tt.wantCount)
+			assert.Equal(t, paired, tt.wantPaired)
+			assert.Equal(t, models.SharedFile{Recipients: recipients}.RecipientNames(), tt.wantNames)
+		})
+	}
+}
+
+func TestInviteRecipients(t *testing.T) {
+	app := newTestApplication(t)
+
+	recipients := []models.Recipient{
+		{Name: "Susan Smith", Email: "foo@bar.com"},
+		{Name: "Admin", Email: "admin@example.com"},
+		{Name: "Cheryl Smith", Email: "Abar@example.com"},
+		{Name: "Nobody", Email: "new@example.com"},
+	}
+
+	err := app.inviteRecipients(recipients, "Cheryl Smith", "Abar@example.com", []string{"report.pdf"},
+		"/files/view/"+mocks.FileToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Guests, and anyone new who gets a guest account, are sent a magic link. Admins and staff are
+	// only sent the file's page, a link in an email mustn't sign anyone in to their accounts.
+	links := app.config.(*mocks.ServerConfigModel).Links
+	assert.Equal(t, len(links), 4)
+	assert.StringContains(t, links[0], "/user/magic/")
+	assert.Equal(t, links[1], "/files/view/"+mocks.FileToken)
+	assert.Equal(t, links[2], "/files/view/"+mocks.FileToken)
+	assert.StringContains(t, links[3], "/user/magic/")
+
+	id, path, err := app.loginTokens.Consume(strings.TrimPrefix(links[0], "/user/magic/"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, id, 3)
+	assert.Equal(t, path, "/files/view/"+mocks.FileToken)
+}
+
 func TestUserSignup(t *testing.T) {
 	// Create the application struct containing our mocked dependencies and set
 	// up the test server for running an end-to-end test.
@@ -101,3 +938,181 @@ func TestUserSignup(t *testing.T) {
 	t.Logf("CSRF token is: %q", csrfToken)
 
 }
+
+func TestFileCreatePolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    *models.UploadPolicy
+		login     string
+		fileName  string
+		content   string
+		wantCode  int
+		wantBody  string
+		wantFlash string
+	}{
+		{
+			name:     "Allowed",
+			fileName: "notes.txt",
+			content:  "some notes",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Blocked Extension",
+			fileName: "setup.exe",
+			content:  "some notes",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "setup.exe can&#39;t be uploaded, that kind of file isn&#39;t allowed",
+		},
+		{
+			name:     "Program In Disguise",
+			fileName: "report.pdf",
+			content:  windowsProgram(),
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "report.pdf can&#39;t be uploaded, application/x-msdownload files aren&#39;t allowed",
+		},
+		{
+			name:     "Not Allowed",
+			policy:   &models.UploadPolicy{AllowedExtensions: []string{"pdf"}},
+			fileName: "notes.txt",
+			content:  "some notes",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "notes.txt can&#39;t be uploaded, that kind of file isn&#39;t allowed",
+		},
+		{
+			name:     "Type Not Allowed",
+			policy:   &models.UploadPolicy{AllowedTypes: []string{"image/*"}},
+			fileName: "photo.png",
+			content:  "%PDF-1.7\n",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "photo.png can&#39;t be uploaded, application/pdf files aren&#39;t allowed",
+		},
+		{
+			name:     "Too Big",
+			policy:   &models.UploadPolicy{UserMaxSize: 1 << 10},
+			fileName: "notes.txt",
+			content:  strings.Repeat("x", 2<<10),
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "notes.txt is too big, files can be at most 1.0 KiB",
+		},
+		{
+			name:      "Far Too Big",
+			policy:    &models.UploadPolicy{UserMaxSize: 1 << 10},
+			fileName:  "notes.txt",
+			content:   strings.Repeat("x", 2*multipartOverhead),
+			wantCode:  http.StatusSeeOther,
+			wantFlash: "That&#39;s too much to upload, files can be at most 1.0 KiB",
+		},
+		{
+			name:     "Admin Limit",
+			policy:   &models.UploadPolicy{UserMaxSize: 1 << 10},
+			login:    "admin@example.com",
+			fileName: "notes.txt",
+			content:  strings.Repeat("x", 2<<10),
+			wantCode: http.StatusSeeOther,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			if tt.policy != nil {
+				app.uploadPolicy.Update(*tt.policy)
+			}
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			login := tt.login
+			if login == "" {
+				login = "Abar@example.com"
+			}
+			ts.login(t, login, "pa$$word")
+
+			_, _, body := ts.get(t, "/files/create")
+
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+
+			for k, v := range map[string]string{
+				"csrf_token":     extractCSRFToken(t, body),
+				"recipientName":  "Susan Smith",
+				"recipientEmail": "foo@bar.com",
+				"senderName":     "Cheryl Smith",
+				"senderEmail":    login,
+				"expires":        "7",
+			} {
+				mw.WriteField(k, v)
+			}
+
+			fw, err := mw.CreateFormFile("uploadFile", tt.fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(fw, tt.content)
+			mw.Close()
+
+			header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+
+			code, _, body := ts.request(t, http.MethodPost, "/files/create", header, &buf)
+			assert.Equal(t, code, tt.wantCode)
+			assert.StringContains(t, body, tt.wantBody)
+
+			// Nothing that breaks the policy is stored.
+			objects, err := app.storage.List("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, len(objects) == 1, tt.wantCode == http.StatusSeeOther && tt.wantFlash == "")
+
+			// When the body is too big to read the user is sent back to the form.
+			if tt.wantFlash != "" {
+				_, _, body = ts.get(t, "/files/create")
+				assert.StringContains(t, body, tt.wantFlash)
+			}
+		})
+	}
+}
+
+func TestFileCreateSlowUpload(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The form takes longer to arrive than the server's ReadTimeout.
+	ts := newTimeoutTestServer(t, app.routes(), 200*time.Millisecond)
+	defer ts.Close()
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/create")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	for k, v := range map[string]string{
+		"csrf_token":     extractCSRFToken(t, body),
+		"recipientName":  "Susan Smith",
+		"recipientEmail": "foo@bar.com",
+		"senderName":     "Cheryl Smith",
+		"senderEmail":    "Abar@example.com",
+		"expires":        "7",
+	} {
+		mw.WriteField(k, v)
+	}
+
+	fw, err := mw.CreateFormFile("uploadFile", "numbers.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, strings.Repeat("0123456789", 100))
+	mw.Close()
+
+	header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+	slow := &slowReader{r: &buf, delay: 20 * time.Millisecond}
+
+	code, rsHeader, _ := ts.request(t, http.MethodPost, "/files/create", header, slow)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, rsHeader.Get("Location"), "/files/view/"+mocks.NewToken)
+
+	inserted := app.sharedFile.(*mocks.SharedFileModel).Inserted
+	assert.Equal(t, len(inserted), 1)
+	assert.Equal(t, inserted[0].Size, int64(1000))
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	//Internal
+	"fileshare/internal/models"
+
+	//External
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Passkeys sign people in with their phone, laptop or security key instead of a password. The
+// browser does the WebAuthn ceremonies with the JavaScript in main.js, these handlers give it the
+// options to start with and check what comes back. The challenge for each ceremony is kept in the
+// session until it's finished. Passkeys have to check it's the user (fingerprint, PIN, ...) and are
+// bound to this site, so a passkey sign in counts as two factors and can't be phished.
+
+// newWebAuthn sets up passkeys for the site at origin (e.g. https://files.example.com), passkeys
+// only work on the site they were registered on.
+func newWebAuthn(origin string) (*webauthn.WebAuthn, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: totpIssuer,
+		RPOrigins:     []string{origin},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	})
+}
+
+// webAuthnUser is a user the way the webauthn package wants them.
+type webAuthnUser struct {
+	user     models.User
+	passkeys []models.Passkey
+}
+
+// userHandle is the ID passkeys keep for the user, so a passkey sign in says who it's for without
+// them having to give their email first. It's their user ID, which means nothing outside this site.
+func userHandle(id int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return userHandle(u.user.ID)
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	if u.user.Name != "" {
+		return u.user.Name
+	}
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+	for i, p := range u.passkeys {
+		credentials[i] = p.Credential
+	}
+	return credentials
+}
+
+// webAuthnUser loads the user with id and their passkeys.
+func (app *application) webAuthnUser(id int) (webAuthnUser, error) {
+	user, err := app.users.Get(id)
+	if err != nil {
+		return webAuthnUser{}, err
+	}
+
+	passkeys, err := app.passkeys.GetAll(id)
+	if err != nil {
+		return webAuthnUser{}, err
+	}
+
+	return webAuthnUser{user: user, passkeys: passkeys}, nil
+}
+
+// putCeremony keeps what's needed to finish a ceremony in the session under key, as JSON as the
+// session can only hold simple types.
+func (app *application) putCeremony(r *http.Request, key string, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), key, data)
+
+	return nil
+}
+
+// popCeremony takes the ceremony under key out of the session, it can only be finished once. ok is
+// false if there isn't one.
+func (app *application) popCeremony(r *http.Request, key string) (webauthn.SessionData, bool) {
+	var session webauthn.SessionData
+
+	data := app.sessionManager.PopBytes(r.Context(), key)
+	if data == nil || json.Unmarshal(data, &session) != nil {
+		return webauthn.SessionData{}, false
+	}
+
+	return session, true
+}
+
+// writeJSON sends v to the JavaScript doing the ceremony.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// passkeyResult is what the JavaScript is told once a ceremony is finished, where to go next or
+// what went wrong.
+type passkeyResult struct {
+	Redirect string `json:"redirect,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// passkeyList lists the signed in user's passkeys and lets them add and remove them.
+func (app *application) passkeyList(w http.ResponseWriter, r *http.Request) {
+	id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+
+	passkeys, err := app.passkeys.GetAll(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Passkeys = passkeys
+	app.render(w, r, http.StatusOK, "passkeys.gohtml", data)
+}
+
+// passkeyRegisterBegin starts registering a new passkey for the signed in user. Passkeys they have
+// already are left out so the same one isn't registered twice.
+func (app *application) passkeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user, err := app.webAuthnUser(app.sessionManager.GetInt(r.Context(), "authenticatedUserID"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	creation, session, err := app.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err = app.putCeremony(r, "webauthnRegistration", session); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, creation)
+}
+
+// passkeyRegisterFinish checks the new passkey the browser made and saves it under the name given
+// in the query string.
+func (app *application) passkeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	if utf8.RuneCountInString(name) > 100 {
+		writeJSON(w, http.StatusUnprocessableEntity, passkeyResult{Error: "The name can be at most 100 characters long"})
+		return
+	}
+
+	session, ok := app.popCeremony(r, "webauthnRegistration")
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, passkeyResult{Error: "That took too long, please try again"})
+		return
+	}
+
+	user, err := app.webAuthnUser(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	credential, err := app.webAuthn.FinishRegistration(user, session, r)
+	if err != nil {
+		app.logger.Info("passkey registration failed", "user", id, "error", err.Error())
+		writeJSON(w, http.StatusBadRequest, passkeyResult{Error: "The passkey couldn't be added, please try again"})
+		return
+	}
+
+	if err = app.passkeys.Insert(id, name, *credential); err != nil {
+		if errors.Is(err, models.ErrDuplicatePasskey) {
+			writeJSON(w, http.StatusConflict, passkeyResult{Error: "That passkey has been added already"})
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, models.AuditEvent{Action: models.AuditPasskey, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(id), Detail: "added " + name})
+
+	app.sessionManager.Put(r.Context(), "flash", "Passkey added")
+	writeJSON(w, http.StatusOK, passkeyResult{Redirect: "/user/passkeys"})
+}
+
+func (app *application) passkeyDeletePost(w http.ResponseWriter, r *http.Request) {
+	passkeyId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || passkeyId < 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+
+	if err = app.passkeys.Delete(id, passkeyId); err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.NotFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, models.AuditEvent{Action: models.AuditPasskey, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(id), Detail: "removed"})
+
+	app.sessionManager.Put(r.Context(), "flash", "Passkey removed")
+	http.Redirect(w, r, "/user/passkeys", http.StatusSeeOther)
+}
+
+// passkeyLoginBegin starts a passkey sign in. Nobody says who they are first, the browser offers
+// the passkeys it has for this site and the one picked says whose it is.
+func (app *application) passkeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	assertion, session, err := app.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err = app.putCeremony(r, "webauthnLogin", session); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+// errPasskeyUser is a passkey sign in for a user that doesn't exist or is disabled.
+var errPasskeyUser = errors.New("passkey user not found or disabled")
+
+func (app *application) passkeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	session, ok := app.popCeremony(r, "webauthnLogin")
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, passkeyResult{Error: "That took too long, please try again"})
+		return
+	}
+
+	var found webAuthnUser
+
+	// The passkey's user handle says whose it is, the webauthn package then checks it's one of theirs.
+	handler := func(rawID, handle []byte) (webauthn.User, error) {
+		if len(handle) != 8 {
+			return nil, errPasskeyUser
+		}
+
+		user, err := app.webAuthnUser(int(binary.BigEndian.Uint64(handle)))
+		if err != nil {
+			return nil, err
+		}
+
+		// Accounts single sign-on or the directory manage only sign in through them, so turning
+		// someone off there keeps them out here.
+		if user.user.ID == 0 || user.user.Disabled || user.user.Source != models.SourceLocal {
+			return nil, errPasskeyUser
+		}
+
+		found = user
+		return user, nil
+	}
+
+	_, credential, err := app.webAuthn.FinishPasskeyLogin(handler, session, r)
+	if err != nil {
+		app.logger.Info("passkey sign in failed", "error", err.Error())
+		app.audit(r, models.AuditEvent{Action: models.AuditLoginFailed, ActorEmail: found.user.Email,
+			TargetType: models.AuditTargetUser, Detail: "passkey"})
+
+		writeJSON(w, http.StatusUnauthorized, passkeyResult{Error: "That passkey couldn't be used to sign in"})
+		return
+	}
+
+	// A sign count that's gone backwards means the passkey may have been copied, it isn't trusted.
+	if credential.Authenticator.CloneWarning {
+		app.audit(r, models.AuditEvent{Action: models.AuditLoginFailed, ActorEmail: found.user.Email,
+			TargetType: models.AuditTargetUser, Target: strconv.Itoa(found.user.ID), Detail: "passkey cloned"})
+
+		writeJSON(w, http.StatusUnauthorized, passkeyResult{Error: "That passkey couldn't be used to sign in"})
+		return
+	}
+
+	if err = app.passkeys.Used(found.user.ID, *credential); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err = app.logIn(r, found.user, "passkey"); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, passkeyResult{Redirect: "/"})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+
+	//External
+	"github.com/fxamacker/cbor/v2"
+)
+
+// testOrigin is the site passkeys are for in the tests.
+const testOrigin = "https://localhost"
+
+// testAuthenticator is a passkey on a pretend phone, it makes and signs what a real one would.
+type testAuthenticator struct {
+	key    *ecdsa.PrivateKey
+	id     []byte
+	handle []byte
+	count  uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &testAuthenticator{key: key, id: id}
+}
+
+var b64url = base64.RawURLEncoding
+
+// ceremonyOptions is the part of the options for a ceremony the authenticator needs.
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+func parseCeremonyOptions(t *testing.T, body string) ceremonyOptions {
+	var options ceremonyOptions
+	if err := json.Unmarshal([]byte(body), &options); err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+// authData is the authenticator data for localhost, user present and verified.
+func (a *testAuthenticator) authData(flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte("localhost"))
+
+	data := append(rpIdHash[:], flags|0x01|0x04)
+	return binary.BigEndian.AppendUint32(data, a.count)
+}
+
+func clientData(t *testing.T, kind, challenge string) []byte {
+	data, err := json.Marshal(map[string]string{"type": kind, "challenge": challenge, "origin": testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// register makes a new passkey for the registration options in body, returning what the browser
+// would send back.
+func (a *testAuthenticator) register(t *testing.T, body string) string {
+	options := parseCeremonyOptions(t, body)
+
+	handle, err := b64url.DecodeString(options.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.handle = handle
+
+	// The public key as COSE, EC2 on P-256 for ES256.
+	publicKey, err := cbor.Marshal(map[int]any{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authData := a.authData(0x40)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := cbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := json.Marshal(map[string]any{
+		"id":    b64url.EncodeToString(a.id),
+		"rawId": b64url.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url.EncodeToString(clientData(t, "webauthn.create", options.PublicKey.Challenge)),
+			"attestationObject": b64url.EncodeToString(attestation),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(response)
+}
+
+// assert signs the challenge in the sign in options in body, returning what the browser would send
+// back.
+func (a *testAuthenticator) assert(t *testing.T, body string) string {
+	options := parseCeremonyOptions(t, body)
+
+	a.count++
+	authData := a.authData(0)
+	data := clientData(t, "webauthn.get", options.PublicKey.Challenge)
+
+	clientDataHash := sha256.Sum256(data)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := json.Marshal(map[string]any{
+		"id":    b64url.EncodeToString(a.id),
+		"rawId": b64url.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url.EncodeToString(data),
+			"authenticatorData": b64url.EncodeToString(authData),
+			"signature":         b64url.EncodeToString(signature),
+			"userHandle":        b64url.EncodeToString(a.handle),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(response)
+}
+
+// postJSON posts body the way the passkey JavaScript does, with the CSRF token from the page at
+// formPath in a header.
+func (ts *testServer) postJSON(t *testing.T, formPath, urlPath, body string) (int, string) {
+	_, _, page := ts.get(t, formPath)
+
+	header := http.Header{
+		"Content-Type": {"application/json"},
+		"X-CSRF-Token": {extractCSRFToken(t, page)},
+	}
+
+	code, _, response := ts.request(t, http.MethodPost, urlPath, header, strings.NewReader(body))
+	return code, response
+}
+
+// passkeyLogin signs in with authenticator, returning the status and body of the last step.
+func (ts *testServer) passkeyLogin(t *testing.T, a *testAuthenticator) (int, string) {
+	code, options := ts.postJSON(t, "/user/login", "/user/passkey/login", "")
+	assert.Equal(t, code, http.StatusOK)
+
+	return ts.postJSON(t, "/user/login", "/user/passkey/login/finish", a.assert(t, options))
+}
+
+func TestPasskeys(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "alice@example.com", "pa$$word")
+
+	phone := newTestAuthenticator(t)
+
+	code, options := ts.postJSON(t, "/user/passkeys", "/user/passkeys/register", "")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, options, `"rp":{"name":"FileServ","id":"localhost"}`)
+	assert.StringContains(t, options, `"residentKey":"required"`)
+
+	code, body := ts.postJSON(t, "/user/passkeys", "/user/passkeys/register/finish?name=My+Phone",
+		phone.register(t, options))
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, `"redirect":"/user/passkeys"`)
+
+	code, _, body = ts.get(t, "/user/passkeys")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "My Phone")
+
+	// A ceremony can only be finished once.
+	code, _ = ts.postJSON(t, "/user/passkeys", "/user/passkeys/register/finish", phone.register(t, options))
+	assert.Equal(t, code, http.StatusBadRequest)
+
+	// Two-factor isn't asked for, the passkey is two factors already.
+	if _, err := app.twoFactor.Enable(1, testSecret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	code, body = other.passkeyLogin(t, phone)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, `"redirect":"/"`)
+
+	code, _, _ = other.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusOK)
+
+	audit := app.auditLog.(*mocks.AuditModel)
+	assert.Equal(t, audit.Events[len(audit.Events)-1].Detail, "passkey")
+
+	passkeys, err := app.passkeys.GetAll(1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, passkeys[0].Credential.Authenticator.SignCount, uint32(1))
+
+	// Someone else's passkey, even for the same user, doesn't sign in.
+	stranger := newTestAuthenticator(t)
+	stranger.handle = phone.handle
+
+	fresh := newTestServer(t, app.routes())
+	defer fresh.Close()
+
+	code, body = fresh.passkeyLogin(t, stranger)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	assert.StringContains(t, body, "couldn't be used to sign in")
+
+	code, _, _ = fresh.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	// Once the directory manages the account it has to be signed in to through the directory.
+	if err = app.users.SetSource(1, models.SourceLDAP); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ = fresh.passkeyLogin(t, phone)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	if err = app.users.SetSource(1, models.SourceLocal); err != nil {
+		t.Fatal(err)
+	}
+
+	// An answer is only good for the challenge it was made for.
+	code, options = fresh.postJSON(t, "/user/login", "/user/passkey/login", "")
+	assert.Equal(t, code, http.StatusOK)
+	answer := phone.assert(t, options)
+
+	code, _ = fresh.postJSON(t, "/user/login", "/user/passkey/login", "")
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = fresh.postJSON(t, "/user/login", "/user/passkey/login/finish", answer)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	// A sign count that goes backwards looks like a copied passkey.
+	phone.count = 0
+
+	code, _ = fresh.passkeyLogin(t, phone)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	assert.Equal(t, audit.Events[len(audit.Events)-1].Detail, "passkey cloned")
+
+	// Only the owner can remove a passkey.
+	bob := newTestServer(t, app.routes())
+	defer bob.Close()
+
+	bob.login(t, "Abar@example.com", "pa$$word")
+
+	code, _, _ = bob.postCode(t, "/user/passkeys", "/user/passkeys/delete/1", "")
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _, _ = ts.postCode(t, "/user/passkeys", "/user/passkeys/delete/1", "")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	passkeys, err = app.passkeys.GetAll(1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(passkeys), 0)
+
+	code, _ = fresh.passkeyLogin(t, phone)
+	assert.Equal(t, code, http.StatusUnauthorized)
+}
+
+func TestPasskeyAdminTwoFactor(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	app.securityPolicy.(*mocks.SecurityPolicyModel).Policy.RequireAdminTwoFactor = true
+
+	// The admin sets up two-factor to get in the first time, then adds a passkey.
+	ts.login(t, "admin@example.com", "pa$$word")
+
+	code, _, _ := ts.setUpTwoFactor(t)
+	assert.Equal(t, code, http.StatusOK)
+
+	key := newTestAuthenticator(t)
+
+	code, options := ts.postJSON(t, "/user/passkeys", "/user/passkeys/register", "")
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.postJSON(t, "/user/passkeys", "/user/passkeys/register/finish?name=Key", key.register(t, options))
+	assert.Equal(t, code, http.StatusOK)
+
+	if !bytes.Equal(key.handle, userHandle(4)) {
+		t.Fatalf("got user handle %x; want %x", key.handle, userHandle(4))
+	}
+
+	// Two-factor being reset doesn't lock out an admin that signs in with a passkey.
+	if err := app.twoFactor.Disable(4); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	code, _ = other.passkeyLogin(t, key)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _, _ = other.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusOK)
+}
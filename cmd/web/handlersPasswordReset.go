@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
+	"fileshare/internal/validator"
+)
+
+// Someone that's forgotten their password asks for a link to reset it, the link lets them choose a
+// new one and signs them out everywhere so whoever knew the old one is out too. Asking for a link
+// looks and takes the same whether there's an account for the email or not, so it can't be used to
+// find out who has one.
+
+// passwordResetTTL is how long a reset link works for.
+const passwordResetTTL = time.Hour
+
+type passwordForgotForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+type passwordResetForm struct {
+	Password            string `form:"password"`
+	Confirm             string `form:"confirm"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) passwordForgot(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = passwordForgotForm{}
+	app.render(w, r, http.StatusOK, "password_forgot.gohtml", data)
+}
+
+// passwordForgotPost sends a reset link if there's an account for the email. Guests don't have a
+// password, they can get a sign in link instead, and accounts single sign-on or the directory manage
+// change theirs there. Making the token and sending it happen after the response so it takes as long
+// either way.
+func (app *application) passwordForgotPost(w http.ResponseWriter, r *http.Request) {
+	var form passwordForgotForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "password_forgot.gohtml", data)
+		return
+	}
+
+	user, err := app.users.GetByEmail(form.Email)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err == nil && !user.Guest && !user.Disabled && user.Source == models.SourceLocal {
+		app.background(func() {
+			token, err := app.passwordResets.Insert(user.ID, passwordResetTTL)
+			if err != nil {
+				app.logger.Error("making password reset token", "email", user.Email, "error", err.Error())
+				return
+			}
+
+			if err = app.config.SendPasswordReset(user.Name, user.Email, "/user/password/reset/"+token); err != nil {
+				app.logger.Error("sending password reset", "email", user.Email, "error", err.Error())
+				return
+			}
+
+			app.logger.Info("Password reset link sent", "email", user.Email)
+		})
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "If there's an account for that email, a link to reset its password is on its way")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// passwordReset shows the form to choose a new password, opening the link doesn't use it up.
+func (app *application) passwordReset(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = passwordResetForm{}
+
+	if _, err := app.passwordResets.Get(r.PathValue("token")); err != nil {
+		if !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.renderResetExpired(w, r)
+		return
+	}
+
+	app.render(w, r, http.StatusOK, "password_reset.gohtml", data)
+}
+
+func (app *application) renderResetExpired(w http.ResponseWriter, r *http.Request) {
+	var form passwordResetForm
+	form.AddNonFieldError("This link has expired or has been used already, ask for a new one")
+
+	data := app.newTemplateData(r)
+	data.Form = form
+	app.render(w, r, http.StatusNotFound, "password_reset.gohtml", data)
+}
+
+func (app *application) passwordResetPost(w http.ResponseWriter, r *http.Request) {
+	var form passwordResetForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
+	form.CheckField(validator.MinChars(form.Password, 8), "password", "This field must be at least 8 characters long")
+	form.CheckField(form.Password == form.Confirm, "confirm", "The passwords don't match")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "password_reset.gohtml", data)
+		return
+	}
+
+	id, err := app.passwordResets.Consume(r.PathValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.renderResetExpired(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	if err = app.users.SetPassword(id, form.Password); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err = app.signOutEverywhere(r.Context(), id); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// This browser isn't signed in either, whoever it was before.
+	if err = app.sessionManager.RenewToken(r.Context()); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Remove(r.Context(), "authenticatedUserEmail")
+	app.sessionManager.Remove(r.Context(), "authenticatedMethod")
+	app.clearPendingLogin(r)
+
+	app.audit(r, models.AuditEvent{Action: models.AuditPasswordReset, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(id)})
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been changed, sign in with the new one")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// signOutEverywhere ends every session the user is signed in, or part way through signing in, with.
+func (app *application) signOutEverywhere(ctx context.Context, id int) error {
+	return app.sessionManager.Iterate(ctx, func(ctx context.Context) error {
+		if app.sessionManager.GetInt(ctx, "authenticatedUserID") == id ||
+			app.sessionManager.GetInt(ctx, "twoFactorUserID") == id {
+			return app.sessionManager.Destroy(ctx)
+		}
+		return nil
+	})
+}
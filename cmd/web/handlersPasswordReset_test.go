@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+)
+
+// forgotPassword asks for a reset link for email, returning the status, where it went and the page
+// it went to.
+func (ts *testServer) forgotPassword(t *testing.T, email string) (int, string, string) {
+	_, _, body := ts.get(t, "/user/password/forgot")
+
+	form := url.Values{
+		"email":      {email},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+
+	code, header, _ := ts.postForm(t, "/user/password/forgot", form)
+	_, _, page := ts.get(t, header.Get("Location"))
+
+	return code, header.Get("Location"), page
+}
+
+// resetPassword chooses a new password with the reset link at path.
+func (ts *testServer) resetPassword(t *testing.T, path, password, confirm string) (int, http.Header, string) {
+	_, _, body := ts.get(t, path)
+
+	form := url.Values{
+		"password":   {password},
+		"confirm":    {confirm},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+
+	return ts.postForm(t, path, form)
+}
+
+// sentLinks is the links emailed so far, once everything sending them has finished.
+func sentLinks(app *application) []string {
+	app.tasks.Wait()
+	return app.config.(*mocks.ServerConfigModel).Links
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApplication(t)
+
+	// Alice is signed in on a couple of other browsers.
+	laptop := newTestServer(t, app.routes())
+	defer laptop.Close()
+	laptop.login(t, "alice@example.com", "pa$$word")
+
+	phone := newTestServer(t, app.routes())
+	defer phone.Close()
+	phone.login(t, "alice@example.com", "pa$$word")
+
+	// Bob is too, he stays signed in.
+	bob := newTestServer(t, app.routes())
+	defer bob.Close()
+	bob.login(t, "Abar@example.com", "pa$$word")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, location, page := ts.forgotPassword(t, "alice@example.com")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, location, "/user/login")
+	assert.StringContains(t, page, "a link to reset its password is on its way")
+
+	links := sentLinks(app)
+	assert.Equal(t, len(links), 1)
+	assert.Equal(t, links[0], "/user/password/reset/reset-token-1")
+
+	// Opening the link doesn't use it up.
+	code, _, page = ts.get(t, links[0])
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, page, "New password again")
+
+	code, _, page = ts.resetPassword(t, links[0], "new-pa$$word", "new-pa$$wort")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, page, "The passwords don&#39;t match")
+
+	code, _, _ = ts.resetPassword(t, links[0], "short", "short")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	code, header, _ := ts.resetPassword(t, links[0], "new-pa$$word", "new-pa$$word")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	// Everywhere Alice was signed in she's signed out, nobody else is.
+	code, _, _ = laptop.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, _, _ = phone.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, _, _ = bob.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusOK)
+
+	// Only the new password works.
+	assert.Equal(t, ts.tryLogin(t, "alice@example.com", "pa$$word"), http.StatusUnprocessableEntity)
+	assert.Equal(t, ts.tryLogin(t, "alice@example.com", "new-pa$$word"), http.StatusSeeOther)
+
+	// The link only works once.
+	code, _, page = ts.get(t, links[0])
+	assert.Equal(t, code, http.StatusNotFound)
+	assert.StringContains(t, page, "expired or has been used already")
+
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	code, _, _ = other.resetPassword(t, links[0], "another-pa$$word", "another-pa$$word")
+	assert.Equal(t, code, http.StatusNotFound)
+
+	audit := app.auditLog.(*mocks.AuditModel)
+	assert.StringContains(t, strings.Join(audit.Actions(), " "), "password-reset")
+}
+
+func TestPasswordResetLatestLink(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.forgotPassword(t, "Abar@example.com")
+	ts.forgotPassword(t, "Abar@example.com")
+
+	links := sentLinks(app)
+	assert.Equal(t, len(links), 2)
+
+	// Only the latest link sent works.
+	code, _, _ := ts.get(t, links[0])
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _, _ = ts.get(t, links[1])
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestPasswordForgotSameAnswer(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Staff whose accounts single sign-on or the directory manage.
+	for email, source := range map[string]string{
+		"carol@example.com": models.SourceSSO,
+		"dave@example.com":  models.SourceLDAP,
+	} {
+		if err := app.users.Insert(email, email, "pa$$word", false, true, false, false); err != nil {
+			t.Fatal(err)
+		}
+		user, err := app.users.GetByEmail(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = app.users.SetSource(user.ID, source); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, location, want := ts.forgotPassword(t, "alice@example.com")
+
+	// Someone without an account, a guest who doesn't have a password, or someone that changes their
+	// password somewhere else, gets the same answer but no email. Only the CSRF tokens differ, they're
+	// different every time a page is shown.
+	for _, email := range []string{"nobody@example.com", "foo@bar.com", "carol@example.com", "dave@example.com"} {
+		gotCode, gotLocation, got := ts.forgotPassword(t, email)
+		assert.Equal(t, gotCode, code)
+		assert.Equal(t, gotLocation, location)
+		assert.Equal(t, csrfTokenRX.ReplaceAllString(got, ""), csrfTokenRX.ReplaceAllString(want, ""))
+	}
+
+	assert.Equal(t, len(sentLinks(app)), 1)
+
+	// Nor does a made up link do anything.
+	code, _, _ = ts.get(t, "/user/password/reset/made-up")
+	assert.Equal(t, code, http.StatusNotFound)
+}
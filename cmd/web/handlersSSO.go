@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	//Internal
+	"fileshare/internal/models"
+
+	//External
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Staff sign in with the company's OpenID Connect provider (Entra ID, Okta, Keycloak, ...) instead of
+// keeping a password here. It's the authorization code flow with PKCE: the user is sent to the
+// provider, which sends them back to the callback with a code, and the code is swapped for an ID
+// token that says who they are. Anyone the provider signs in gets an account as a User, and an
+// Admin if they're in the admin group. External guests still sign in here with magic links and
+// passwords.
+//
+// Only accounts single sign-on made, or that an admin has linked to it with the link-sso command, can
+// be signed in to this way. Anyone else with an account for the same email, local admins included,
+// isn't touched, a provider that lets people pick their own email can't be used to take them over.
+
+// ssoConfig is how to reach the provider, from the command line flags and .env file.
+type ssoConfig struct {
+	// Issuer is the provider's URL, its settings are discovered from there.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback, it has to be registered with the provider.
+	RedirectURL string
+	// Name is what the login page calls the provider.
+	Name string
+	// GroupsClaim is the ID token claim with the groups the user is in, and AdminGroup the one
+	// that makes them an admin. Without an AdminGroup admins are only ever made here.
+	GroupsClaim string
+	AdminGroup  string
+	// AllowUnverifiedEmail trusts an email the provider doesn't say is verified, for providers like
+	// Entra ID that don't send email_verified. One it says isn't verified is still refused.
+	AllowUnverifiedEmail bool
+}
+
+type ssoProvider struct {
+	config   ssoConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// newSSOProvider discovers the provider's endpoints and signing keys from its issuer URL.
+func newSSOProvider(ctx context.Context, config ssoConfig) (*ssoProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssoProvider{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  config.RedirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+// ssoClaims are the parts of the ID token used here.
+type ssoClaims struct {
+	Email string `json:"email"`
+	// EmailVerified isn't sent by every provider, see ssoConfig.AllowUnverifiedEmail.
+	EmailVerified *bool  `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// verified is whether the email can be trusted to be the user's.
+func (c ssoClaims) verified(config ssoConfig) bool {
+	if c.EmailVerified == nil {
+		return config.AllowUnverifiedEmail
+	}
+	return *c.EmailVerified
+}
+
+// errSSONotLinked is someone signing in with the email of an account that isn't managed by single
+// sign-on.
+var errSSONotLinked = errors.New("account isn't linked to single sign-on")
+
+// groups is the groups the ID token says the user is in. Providers send a list, or a single group
+// as a string.
+func (p *ssoProvider) groups(token *oidc.IDToken) []string {
+	var claims map[string]any
+	if err := token.Claims(&claims); err != nil {
+		return nil
+	}
+
+	switch v := claims[p.config.GroupsClaim].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var groups []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+
+	return nil
+}
+
+// ssoLogin sends the user to the provider to sign in. The state, nonce and PKCE verifier are kept in
+// the session to check what comes back to the callback is the answer to this request.
+func (app *application) ssoLogin(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state := oauth2.GenerateVerifier()
+	nonce := oauth2.GenerateVerifier()
+	verifier := oauth2.GenerateVerifier()
+
+	app.sessionManager.Put(r.Context(), "ssoState", state)
+	app.sessionManager.Put(r.Context(), "ssoNonce", nonce)
+	app.sessionManager.Put(r.Context(), "ssoVerifier", verifier)
+
+	http.Redirect(w, r, app.sso.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)),
+		http.StatusSeeOther)
+}
+
+// ssoCallback is where the provider sends the user back to, it signs them in as whoever the ID token
+// says they are.
+func (app *application) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Each sign in can only come back once.
+	state := app.sessionManager.PopString(r.Context(), "ssoState")
+	nonce := app.sessionManager.PopString(r.Context(), "ssoNonce")
+	verifier := app.sessionManager.PopString(r.Context(), "ssoVerifier")
+
+	query := r.URL.Query()
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		app.ssoFailed(w, r, "", errors.New("state doesn't match"))
+		return
+	}
+
+	if e := query.Get("error"); e != "" {
+		app.ssoFailed(w, r, "", fmt.Errorf("provider said %s: %s", e, query.Get("error_description")))
+		return
+	}
+
+	token, err := app.sso.oauth2.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		app.ssoFailed(w, r, "", err)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		app.ssoFailed(w, r, "", errors.New("no ID token"))
+		return
+	}
+
+	// The signature, issuer, audience and expiry are all checked here.
+	idToken, err := app.sso.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		app.ssoFailed(w, r, "", err)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(idToken.Nonce)) != 1 {
+		app.ssoFailed(w, r, "", errors.New("nonce doesn't match"))
+		return
+	}
+
+	var claims ssoClaims
+	if err = idToken.Claims(&claims); err != nil {
+		app.ssoFailed(w, r, "", err)
+		return
+	}
+
+	if claims.Email == "" || !claims.verified(app.sso.config) {
+		app.ssoFailed(w, r, claims.Email, errors.New("no verified email"))
+		return
+	}
+
+	user, err := app.ssoUser(r, claims, app.sso.groups(idToken))
+	if errors.Is(err, errSSONotLinked) {
+		app.ssoFailed(w, r, claims.Email, err)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if user.Disabled {
+		app.ssoFailed(w, r, claims.Email, errors.New("user is disabled"))
+		return
+	}
+
+	app.loginWith(w, r, user, "sso", "/")
+}
+
+// ssoFailed sends the user back to the login page. Why is only logged, unless it's an account that
+// isn't linked, and the sign in audited as failed against email if it got as far as knowing who it
+// was.
+func (app *application) ssoFailed(w http.ResponseWriter, r *http.Request, email string, err error) {
+	app.logger.Info("single sign-on failed", "email", email, "error", err.Error())
+	app.audit(r, models.AuditEvent{Action: models.AuditLoginFailed, ActorEmail: email,
+		TargetType: models.AuditTargetUser, Detail: "sso"})
+
+	if errors.Is(err, errSSONotLinked) {
+		app.sessionManager.Put(r.Context(), "flash",
+			"There's already an account for your email that isn't set up for single sign-on, ask an admin to link it")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "Single sign-on didn't work, please try again")
+	}
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ssoUser is the account for someone the provider has signed in, made for them if they don't have
+// one. They're staff, so they're made a User. If there's an admin group they're an admin only while
+// they're in it. An account for their email that single sign-on doesn't manage, even a guest one
+// from being sent files, gives errSSONotLinked.
+func (app *application) ssoUser(r *http.Request, claims ssoClaims, groups []string) (models.User, error) {
+	admin := app.sso.config.AdminGroup != "" && slices.Contains(groups, app.sso.config.AdminGroup)
+
+	user, err := app.users.GetByEmail(claims.Email)
+	if errors.Is(err, models.ErrNoRecord) {
+		name := claims.Name
+		if name == "" {
+			name = claims.Email
+		}
+
+		// The password is random and never told to anyone, they sign in through the provider.
+		// Insert(name, email, password string, admin, user, guest, disabled bool) error
+		err = app.users.Insert(name, claims.Email, app.RandPasswordGen(32), admin, true, false, false)
+		if err != nil {
+			return models.User{}, err
+		}
+
+		user, err = app.users.GetByEmail(claims.Email)
+		if err != nil {
+			return models.User{}, err
+		}
+
+		if err = app.users.SetSource(user.ID, models.SourceSSO); err != nil {
+			return models.User{}, err
+		}
+		user.Source = models.SourceSSO
+
+		app.audit(r, models.AuditEvent{Action: models.AuditUserEdit, ActorEmail: user.Email,
+			TargetType: models.AuditTargetUser, Target: strconv.Itoa(user.ID), Detail: "created by single sign-on"})
+
+		return user, nil
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if user.Source != models.SourceSSO {
+		return models.User{}, errSSONotLinked
+	}
+
+	if app.sso.config.AdminGroup == "" {
+		admin = user.Admin
+	}
+
+	if user.Admin != admin || !user.User || user.Guest {
+		if err = app.users.SetRoles(user.ID, admin, true, false); err != nil {
+			return models.User{}, err
+		}
+
+		app.audit(r, models.AuditEvent{Action: models.AuditUserEdit, ActorEmail: user.Email,
+			TargetType: models.AuditTargetUser, Target: strconv.Itoa(user.ID),
+			Detail: fmt.Sprintf("single sign-on set admin=%t user=true guest=false", admin)})
+
+		user.Admin, user.User, user.Guest = admin, true, false
+	}
+
+	return user, nil
+}
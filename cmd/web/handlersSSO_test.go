@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+
+	//External
+	"github.com/go-jose/go-jose/v4"
+)
+
+// testIdP is a pretend OpenID Connect provider. Whoever signs in is whoever the test says, it
+// hands out codes for the ID token claims it's given.
+type testIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]testIdPCode
+}
+
+// testIdPCode is a sign in waiting for the code to be swapped for an ID token.
+type testIdPCode struct {
+	challenge string
+	claims    map[string]any
+}
+
+const (
+	testClientID     = "fileshare"
+	testClientSecret = "s3cret"
+)
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{key: key, codes: map[string]testIdPCode{}}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != testClientID || secret != testClientSecret {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		idp.mu.Lock()
+		code, ok := idp.codes[r.PostFormValue("code")]
+		delete(idp.codes, r.PostFormValue("code"))
+		idp.mu.Unlock()
+
+		// PKCE, only whoever started the sign in knows the verifier.
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || b64url.EncodeToString(sum[:]) != code.challenge {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.sign(t, code.claims),
+		})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+
+	return idp
+}
+
+// sign makes an ID token with claims.
+func (idp *testIdP) sign(t *testing.T, claims map[string]any) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: idp.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// authorize is the user signing in at the provider, it returns where the provider sends them back
+// to. The standard claims are filled in, and the email is verified, claims adds to or overrides
+// them.
+func (idp *testIdP) authorize(t *testing.T, location string, claims map[string]any) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+
+	assert.Equal(t, u.Host, strings.TrimPrefix(idp.URL, "http://"))
+	assert.Equal(t, query.Get("client_id"), testClientID)
+	assert.Equal(t, query.Get("code_challenge_method"), "S256")
+	assert.StringContains(t, query.Get("scope"), "openid")
+
+	all := map[string]any{
+		"iss":   idp.URL,
+		"aud":   testClientID,
+		"sub":   "123",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+
+		"email_verified": true,
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	code := rand.Text()
+
+	idp.mu.Lock()
+	idp.codes[code] = testIdPCode{challenge: query.Get("code_challenge"), claims: all}
+	idp.mu.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return redirect.Path + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+}
+
+// ssoLogin signs in through idp as whoever claims say, returning where the app sends them after.
+func (ts *testServer) ssoLogin(t *testing.T, idp *testIdP, claims map[string]any) (int, http.Header) {
+	code, header, _ := ts.get(t, "/user/sso")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, header, _ = ts.get(t, idp.authorize(t, header.Get("Location"), claims))
+	return code, header
+}
+
+func newSSOTestApplication(t *testing.T, idp *testIdP) *application {
+	app := newTestApplication(t)
+
+	sso, err := newSSOProvider(context.Background(), ssoConfig{
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testOrigin + "/user/sso/callback",
+		Name:         "Example Corp",
+		GroupsClaim:  "groups",
+		AdminGroup:   "fileshare-admins",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.sso = sso
+
+	return app
+}
+
+func TestSSOLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+
+	app := newSSOTestApplication(t, idp)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	assert.StringContains(t, body, `<a href="/user/sso">Sign In with Example Corp</a>`)
+
+	// Staff signing in the first time get an account as a User.
+	code, header := ts.ssoLogin(t, idp, map[string]any{
+		"email": "carol@example.com", "email_verified": true, "name": "Carol", "groups": []string{"staff"},
+	})
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/")
+
+	code, _, _ = ts.get(t, "/files/create")
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _, _ = ts.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	carol, err := app.users.GetByEmail("carol@example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, carol.Name, "Carol")
+	assert.Equal(t, carol.User, true)
+	assert.Equal(t, carol.Admin, false)
+
+	audit := app.auditLog.(*mocks.AuditModel)
+	assert.Equal(t, strings.Join(audit.Actions(), " "), "user-edit login")
+	assert.Equal(t, audit.Events[1].Detail, "sso")
+
+	// The admin group makes them an admin, and leaving it takes it away again.
+	admin := newTestServer(t, app.routes())
+	defer admin.Close()
+
+	code, _ = admin.ssoLogin(t, idp, map[string]any{
+		"email": "carol@example.com", "groups": []string{"staff", "fileshare-admins"},
+	})
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, _, _ = admin.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = admin.ssoLogin(t, idp, map[string]any{"email": "carol@example.com", "groups": "staff"})
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, _, _ = admin.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	// Carol can't sign in with a password here, whatever it is.
+	if err = app.users.SetPassword(carol.ID, "pa$$word"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, admin.tryLogin(t, "carol@example.com", "pa$$word"), http.StatusUnprocessableEntity)
+
+	// Someone that already has an account, even a guest one from being sent files, isn't signed in
+	// to it until an admin links it.
+	if err = app.users.Insert("Dave", "dave@example.com", "pa$$word", false, false, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	dave, err := app.users.GetByEmail("dave@example.com")
+	assert.Equal(t, err, nil)
+
+	if err = app.users.SetPassword(dave.ID, "pa$$word"); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := newTestServer(t, app.routes())
+	defer guest.Close()
+
+	_, header = guest.ssoLogin(t, idp, map[string]any{"email": "dave@example.com"})
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	_, _, body = guest.get(t, "/user/login")
+	assert.StringContains(t, body, "ask an admin to link it")
+
+	dave, err = app.users.GetByEmail("dave@example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, dave.Guest, true)
+
+	if err = app.runCommand([]string{"link-sso", "-email=dave@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, header = guest.ssoLogin(t, idp, map[string]any{"email": "dave@example.com"})
+	assert.Equal(t, header.Get("Location"), "/")
+
+	dave, err = app.users.GetByEmail("dave@example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, dave.User, true)
+	assert.Equal(t, dave.Guest, false)
+
+	// Once it's linked its password stops working.
+	assert.Equal(t, guest.tryLogin(t, "dave@example.com", "pa$$word"), http.StatusUnprocessableEntity)
+
+	// Two-factor is still asked for by those that have turned it on.
+	if _, err = app.twoFactor.Enable(carol.ID, testSecret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestServer(t, app.routes())
+	defer second.Close()
+
+	_, header = second.ssoLogin(t, idp, map[string]any{"email": "carol@example.com"})
+	assert.Equal(t, header.Get("Location"), "/user/login/2fa")
+
+	// External guests still sign in here.
+	external := newTestServer(t, app.routes())
+	defer external.Close()
+
+	external.login(t, "foo@bar.com", "pa$$word")
+
+	code, _, _ = external.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestSSOLoginRefused(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+
+	app := newSSOTestApplication(t, idp)
+
+	if err := app.users.Insert("Eve", "eve@example.com", "pa$$word", false, true, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	eve, err := app.users.GetByEmail("eve@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = app.users.SetSource(eve.ID, models.SourceSSO); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		// callback changes where the provider sends the user back to
+		callback func(string) string
+	}{
+		{
+			name:   "Unverified email",
+			claims: map[string]any{"email": "mallory@example.com", "email_verified": false},
+		},
+		{
+			name:   "Email not said to be verified",
+			claims: map[string]any{"email": "mallory@example.com", "email_verified": nil},
+		},
+		{
+			name:   "Local admin",
+			claims: map[string]any{"email": "admin@example.com", "groups": []string{"staff"}},
+		},
+		{
+			name:   "No email",
+			claims: map[string]any{},
+		},
+		{
+			name:   "Disabled user",
+			claims: map[string]any{"email": "eve@example.com"},
+		},
+		{
+			name:   "Wrong audience",
+			claims: map[string]any{"email": "mallory@example.com", "aud": "another-app"},
+		},
+		{
+			name:   "Expired",
+			claims: map[string]any{"email": "mallory@example.com", "exp": time.Now().Add(-time.Hour).Unix()},
+		},
+		{
+			name:   "Wrong nonce",
+			claims: map[string]any{"email": "mallory@example.com", "nonce": "replayed"},
+		},
+		{
+			name:   "Wrong state",
+			claims: map[string]any{"email": "mallory@example.com"},
+			callback: func(s string) string {
+				return strings.Replace(s, "state=", "state=x", 1)
+			},
+		},
+		{
+			name:   "Provider error",
+			claims: map[string]any{"email": "mallory@example.com"},
+			callback: func(s string) string {
+				return s + "&error=access_denied"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			code, header, _ := ts.get(t, "/user/sso")
+			assert.Equal(t, code, http.StatusSeeOther)
+
+			callback := idp.authorize(t, header.Get("Location"), tt.claims)
+			if tt.callback != nil {
+				callback = tt.callback(callback)
+			}
+
+			code, header, _ = ts.get(t, callback)
+			assert.Equal(t, code, http.StatusSeeOther)
+			assert.Equal(t, header.Get("Location"), "/user/login")
+
+			code, _, _ = ts.get(t, "/user/update/")
+			assert.Equal(t, code, http.StatusSeeOther)
+
+			audit := app.auditLog.(*mocks.AuditModel)
+			assert.Equal(t, audit.Events[len(audit.Events)-1].Action, "login-failed")
+		})
+	}
+
+	_, err = app.users.GetByEmail("mallory@example.com")
+	assert.Equal(t, err != nil, true)
+
+	// The local admin is still one.
+	localAdmin, err := app.users.GetByEmail("admin@example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, localAdmin.Admin, true)
+	assert.Equal(t, localAdmin.Source, models.SourceLocal)
+
+	// Only the browser that started the sign in can finish it.
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, header, _ := ts.get(t, "/user/sso")
+	callback := idp.authorize(t, header.Get("Location"), map[string]any{"email": "carol@example.com"})
+
+	thief := newTestServer(t, app.routes())
+	defer thief.Close()
+
+	code, header, _ := thief.get(t, callback)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	// Nor can it be used twice.
+	code, header, _ = ts.get(t, callback)
+	assert.Equal(t, header.Get("Location"), "/")
+
+	code, header, _ = ts.get(t, callback)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+}
+
+func TestSSOAllowUnverifiedEmail(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+
+	app := newSSOTestApplication(t, idp)
+	app.sso.config.AllowUnverifiedEmail = true
+
+	// A provider that doesn't say whether emails are verified is trusted.
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, header := ts.ssoLogin(t, idp, map[string]any{"email": "carol@example.com", "email_verified": nil})
+	assert.Equal(t, header.Get("Location"), "/")
+
+	// One that says an email isn't still isn't.
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	_, header = other.ssoLogin(t, idp, map[string]any{"email": "mallory@example.com", "email_verified": false})
+	assert.Equal(t, header.Get("Location"), "/user/login")
+}
+
+func TestSSODisabled(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	if strings.Contains(body, "/user/sso") {
+		t.Error("login page offers single sign-on when it isn't set up")
+	}
+
+	code, _, _ := ts.get(t, "/user/sso")
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _, _ = ts.get(t, "/user/sso/callback?code=x&state=y")
+	assert.Equal(t, code, http.StatusNotFound)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
+)
+
+// Files uploaded together are grouped into a share. The recipients can look at each file on its own
+// or download the lot as a ZIP, which is built as it is sent so nothing is written to disk.
+
+// maxShareFiles is how many files can be uploaded together in one share.
+const maxShareFiles = 20
+
+// zipTimeout replaces the server's WriteTimeout for a ZIP download, a share of big files takes a
+// while to send.
+const zipTimeout = 30 * time.Minute
+
+func (app *application) shareView(w http.ResponseWriter, r *http.Request) {
+	files := app.shareFromContext(r)
+
+	data := app.newTemplateData(r)
+	data.SharedFiles = files
+	data.ShareToken = files[0].ShareToken
+
+	app.audit(r, models.AuditEvent{Action: models.AuditView, TargetType: models.AuditTargetShare,
+		Target: data.ShareToken, Detail: fmt.Sprintf("%d files", len(files))})
+
+	app.render(w, r, http.StatusOK, "view.gohtml", data)
+}
+
+func (app *application) shareDownload(w http.ResponseWriter, r *http.Request) {
+	files := app.shareFromContext(r)
+	shareId := files[0].ShareId
+
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(zipTimeout)); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		// Files that ran out of downloads since the share was loaded are left out of the ZIP
+		email := app.sessionManager.GetString(r.Context(), "authenticatedUserEmail")
+		counted := files[:0:0]
+		var firsts []models.SharedFile
+
+		for _, f := range files {
+			first, err := app.sharedFile.RecordDownload(f.Id, email)
+			if errors.Is(err, models.ErrDownloadLimit) {
+				continue
+			} else if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+
+			counted = append(counted, f)
+			app.audit(r, models.AuditEvent{Action: models.AuditDownload, TargetType: models.AuditTargetFile,
+				Target: f.Token, Detail: f.DocName})
+
+			if first {
+				firsts = append(firsts, f)
+			}
+		}
+
+		if len(counted) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		files = counted
+
+		link := "/shares/view/" + files[0].ShareToken
+		app.background(func() {
+			app.notifySender(firsts, email, link)
+		})
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/zip")
+	h.Set("Content-Disposition", contentDisposition(fmt.Sprintf("share-%s.zip", files[0].CreatedAt.Format("2006-01-02"))))
+	h.Set("Cache-Control", "private")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	zw := zip.NewWriter(w)
+
+	for i, name := range zipNames(files) {
+		if err := app.writeZipFile(zw, name, files[i]); err != nil {
+			// The headers have gone already, so all that can be done is to cut the connection and
+			// leave the client with a ZIP it can tell is broken.
+			app.logger.Error("Error sending share", "share", shareId, "file", files[i].Id, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		app.logger.Error("Error sending share", "share", shareId, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeZipFile adds the content of sharedF to zw as name.
+func (app *application) writeZipFile(zw *zip.Writer, name string, sharedF models.SharedFile) error {
+	f, _, err := app.openSharedFile(sharedF)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: sharedF.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, newVerifyingReader(f, sharedF.Size, sharedF.Checksum))
+	return err
+}
+
+// zipNames gives each file a name in the ZIP. Anything that looks like a path is flattened so a file
+// can't be unpacked outside the folder it's unpacked into, and files with the same name get a number
+// added, like "report (2).pdf", so none of them are lost.
+func zipNames(files []models.SharedFile) []string {
+	names := make([]string, len(files))
+	seen := map[string]bool{}
+
+	for i, f := range files {
+		name := strings.NewReplacer("/", "_", "\\", "_").Replace(f.DocName)
+		if name == "" || strings.Trim(name, ".") == "" {
+			name = "file"
+		}
+
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+
+		seen[strings.ToLower(name)] = true
+		names[i] = name
+	}
+
+	return names
+}
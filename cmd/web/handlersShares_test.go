@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+)
+
+func TestShareDownload(t *testing.T) {
+	app := newTestApplication(t)
+
+	// Both files in the mock share were stored before encryption at rest.
+	for key, content := range map[string]string{
+		"0123456789abcdef0123456789abcdef": "file contents",
+		"fedcba9876543210fedcba9876543210": "appendix contents",
+	} {
+		if err := app.storage.Put(key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, _, _ := ts.get(t, "/shares/download/"+mocks.ShareToken)
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	ts.login(t, "alice@example.com", "pa$$word")
+
+	code, _, _ = ts.get(t, "/shares/view/"+mocks.ShareToken)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	ts.login(t, "foo@bar.com", "pa$$word")
+
+	code, _, body := ts.get(t, "/shares/view/"+mocks.ShareToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Big Important Document")
+	assert.StringContains(t, body, "Appendix.txt")
+	assert.StringContains(t, body, "/shares/download/"+mocks.ShareToken)
+	assert.StringContains(t, body, "/files/download/"+mocks.ShareFileToken)
+
+	code, _, _ = ts.get(t, "/shares/view/1")
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// The view of a single file lists the rest of its share.
+	code, _, body = ts.get(t, "/files/view/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Appendix.txt")
+
+	code, header, body := ts.request(t, http.MethodGet, "/shares/download/"+mocks.ShareToken, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, header.Get("Content-Type"), "application/zip")
+	assert.StringContains(t, header.Get("Content-Disposition"), `attachment; filename="share-`)
+
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[f.Name] = string(content)
+	}
+
+	assert.Equal(t, len(got), 2)
+	assert.Equal(t, got["Big Important Document"], "file contents")
+	assert.Equal(t, got["Appendix.txt"], "appendix contents")
+
+	// Downloading the ZIP counts as downloading each file.
+	assert.Equal(t, len(app.sharedFile.(*mocks.SharedFileModel).Downloaded), 2)
+}
+
+func TestFileCreateShare(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/create")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	for k, v := range map[string]string{
+		"csrf_token":     extractCSRFToken(t, body),
+		"recipientName":  "Susan Smith",
+		"recipientEmail": "foo@bar.com",
+		"senderName":     "Cheryl Smith",
+		"senderEmail":    "Abar@example.com",
+		"expires":        "7",
+	} {
+		mw.WriteField(k, v)
+	}
+
+	for name, content := range map[string]string{"one.txt": "first file", "two.txt": "second file"} {
+		fw, err := mw.CreateFormFile("uploadFile", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, content)
+	}
+	mw.Close()
+
+	header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+
+	code, rsHeader, _ := ts.request(t, http.MethodPost, "/files/create", header, &buf)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, rsHeader.Get("Location"), "/shares/view/"+mocks.NewToken)
+
+	inserted := app.sharedFile.(*mocks.SharedFileModel).Inserted
+	assert.Equal(t, len(inserted), 2)
+
+	for _, f := range inserted {
+		assert.Equal(t, f.SenderEmail, "Abar@example.com")
+		assert.Equal(t, f.RecipientNames(), "Susan Smith")
+	}
+
+	objects, err := app.storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(objects), 2)
+
+	// The recipient is emailed one magic link that takes them to the share.
+	links := app.config.(*mocks.ServerConfigModel).Links
+	assert.Equal(t, len(links), 1)
+	assert.StringContains(t, links[0], "/user/magic/")
+
+	_, path, err := app.loginTokens.Consume(strings.TrimPrefix(links[0], "/user/magic/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, path, "/shares/view/"+mocks.NewToken)
+}
+
+func TestZipNames(t *testing.T) {
+	files := []models.SharedFile{
+		{DocName: "report.pdf"},
+		{DocName: "Report.pdf"},
+		{DocName: "report.pdf"},
+		{DocName: "../../etc/passwd"},
+		{DocName: ".."},
+		{DocName: "notes"},
+		{DocName: "notes"},
+	}
+
+	assert.Equal(t, strings.Join(zipNames(files), "|"),
+		"report.pdf|Report (2).pdf|report (3).pdf|.._.._etc_passwd|file|notes|notes (2)")
+}
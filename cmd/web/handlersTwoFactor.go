@@ -0,0 +1,569 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
+	"fileshare/internal/totp"
+	"fileshare/internal/validator"
+
+	//External
+	"github.com/skip2/go-qrcode"
+)
+
+// Two-factor sign in asks for a code from an authenticator app (or one of the recovery codes given
+// when it was set up) after the password or magic link. Until the code is given the session only
+// holds who is part way through signing in, under twoFactorUserID, never authenticatedUserID, so
+// none of the protected pages can be got at with just a password.
+
+// totpIssuer is what authenticator apps list the account under.
+const totpIssuer = "FileServ"
+
+// pendingLoginTTL is how long someone has to give their code after their password.
+const pendingLoginTTL = 10 * time.Minute
+
+// maxTwoFactorAttempts is how many wrong codes can be given before having to start again with the
+// password, six digit codes can't be guessed in that many goes.
+const maxTwoFactorAttempts = 5
+
+type twoFactorForm struct {
+	Code                string `form:"code"`
+	validator.Validator `form:"-"`
+}
+
+// loginWith signs user in once they've passed the first factor (method is which, for the audit
+// log) and sends them on to path. If they have two-factor turned on, or are an admin that has to
+// and hasn't set it up yet, they're asked for a code or to set it up first.
+func (app *application) loginWith(w http.ResponseWriter, r *http.Request, user models.User, method, path string) {
+	enrolled, required, err := app.twoFactorStatus(user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !enrolled && !required {
+		if err = app.logIn(r, user, method); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		http.Redirect(w, r, safePath(path), http.StatusSeeOther)
+		return
+	}
+
+	// The session ID changes here as well as when the code is given, a session from before the
+	// password can't be used to finish signing in.
+	if err = app.sessionManager.RenewToken(r.Context()); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.sessionManager.Remove(r.Context(), "authenticatedUserEmail")
+	app.sessionManager.Put(r.Context(), "twoFactorUserID", user.ID)
+	app.sessionManager.Put(r.Context(), "twoFactorMethod", method)
+	app.sessionManager.Put(r.Context(), "twoFactorPath", path)
+	app.sessionManager.Put(r.Context(), "twoFactorExpires", time.Now().Add(pendingLoginTTL).Unix())
+	app.sessionManager.Put(r.Context(), "twoFactorAttempts", 0)
+
+	if !enrolled {
+		app.sessionManager.Put(r.Context(), "flash", "Admins have to set up two-factor sign in before they can carry on")
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+}
+
+// twoFactorStatus is whether user has two-factor turned on, and whether they have to.
+func (app *application) twoFactorStatus(user models.User) (enrolled, required bool, err error) {
+	_, err = app.twoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		return false, false, err
+	}
+	enrolled = err == nil
+
+	if user.Admin {
+		policy, err := app.securityPolicy.Get()
+		if err != nil {
+			return false, false, err
+		}
+		required = policy.RequireAdminTwoFactor
+	}
+
+	return enrolled, required, nil
+}
+
+// logIn puts user in the session, they're signed in from here on.
+func (app *application) logIn(r *http.Request, user models.User, method string) error {
+	// Use the RenewToken() method on the current session to change the session
+	// ID. It's good practice to generate a new session ID when the
+	// authentication state or privilege levels changes for the user (e.g. login
+	// and logout operations). -- OWASP Session Fixation Mitigation
+	if err := app.sessionManager.RenewToken(r.Context()); err != nil {
+		return err
+	}
+
+	app.clearPendingLogin(r)
+
+	// Add the ID & Email of the current user to the session, so that they are now
+	// 'logged in'.
+	app.sessionManager.Put(r.Context(), "authenticatedUserID", user.ID)
+	app.sessionManager.Put(r.Context(), "authenticatedUserEmail", user.Email)
+	app.sessionManager.Put(r.Context(), "authenticatedMethod", method)
+
+	app.audit(r, models.AuditEvent{Action: models.AuditLogin, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(user.ID), Detail: method})
+
+	return nil
+}
+
+// clearPendingLogin forgets anyone part way through signing in.
+func (app *application) clearPendingLogin(r *http.Request) {
+	for _, key := range []string{"twoFactorUserID", "twoFactorMethod", "twoFactorPath", "twoFactorExpires",
+		"twoFactorAttempts", "totpSecret"} {
+		app.sessionManager.Remove(r.Context(), key)
+	}
+}
+
+// pendingLogin is the ID of who's part way through signing in, 0 if nobody is or they took too long.
+func (app *application) pendingLogin(r *http.Request) int {
+	id := app.sessionManager.GetInt(r.Context(), "twoFactorUserID")
+	if id == 0 {
+		return 0
+	}
+
+	if time.Now().Unix() > app.sessionManager.GetInt64(r.Context(), "twoFactorExpires") {
+		app.clearPendingLogin(r)
+		return 0
+	}
+
+	return id
+}
+
+// safePath is path if it's somewhere on this site, otherwise the home page.
+func safePath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return "/"
+	}
+
+	return path
+}
+
+// checkSecondFactor checks code is a current code from the user's authenticator app, or one of
+// their recovery codes, and uses it up. A code that's been used already isn't taken again.
+func (app *application) checkSecondFactor(factor models.TwoFactor, code string) (recovery, ok bool, err error) {
+	if step, valid := totp.Validate(factor.Secret, code, time.Now()); valid {
+		err = app.twoFactor.UseStep(factor.UserId, step)
+		if errors.Is(err, models.ErrCodeUsed) {
+			return false, false, nil
+		}
+		return false, err == nil, err
+	}
+
+	if models.NormalizeRecoveryCode(code) == "" {
+		return false, false, nil
+	}
+
+	err = app.twoFactor.UseRecoveryCode(factor.UserId, code)
+	if errors.Is(err, models.ErrNoRecord) {
+		return true, false, nil
+	}
+
+	return true, err == nil, err
+}
+
+func (app *application) twoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if app.pendingLogin(r) == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = twoFactorForm{}
+	app.render(w, r, http.StatusOK, "login_2fa.gohtml", data)
+}
+
+func (app *application) twoFactorLoginPost(w http.ResponseWriter, r *http.Request) {
+	id := app.pendingLogin(r)
+	if id == 0 {
+		app.sessionManager.Put(r.Context(), "flash", "That took too long, please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	var form twoFactorForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	factor, err := app.twoFactor.Get(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	user, err := app.users.Get(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	recovery, ok, err := app.checkSecondFactor(factor, form.Code)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !ok || user.Disabled {
+		app.audit(r, models.AuditEvent{Action: models.AuditLoginFailed, ActorEmail: user.Email,
+			TargetType: models.AuditTargetUser, Target: strconv.Itoa(id), Detail: "two-factor"})
+
+		attempts := app.sessionManager.GetInt(r.Context(), "twoFactorAttempts") + 1
+		if attempts >= maxTwoFactorAttempts {
+			app.clearPendingLogin(r)
+			app.sessionManager.Put(r.Context(), "flash", "Too many wrong codes, please log in again")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "twoFactorAttempts", attempts)
+
+		form.AddFieldError("code", "That code isn't right or has already been used")
+
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "login_2fa.gohtml", data)
+		return
+	}
+
+	method := app.sessionManager.GetString(r.Context(), "twoFactorMethod")
+	path := app.sessionManager.GetString(r.Context(), "twoFactorPath")
+
+	detail := method + ", two-factor"
+	if recovery {
+		detail = method + ", recovery code"
+	}
+
+	if err = app.logIn(r, user, detail); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if recovery {
+		app.sessionManager.Put(r.Context(), "flash",
+			"You signed in with a recovery code, you have "+strconv.Itoa(factor.RecoveryCodes-1)+" left")
+	}
+
+	http.Redirect(w, r, safePath(path), http.StatusSeeOther)
+}
+
+// twoFactorSetupUser is who's setting up two-factor, whoever is signed in or an admin part way
+// through signing in that has to set it up before they can carry on. Someone part way through that
+// already has it set up has to give a code instead, ok is false for them and for nobody.
+func (app *application) twoFactorSetupUser(r *http.Request) (user models.User, pending, ok bool, err error) {
+	id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+	if !app.isAuthenticated(r) {
+		id, pending = app.pendingLogin(r), true
+	}
+
+	if id == 0 {
+		return models.User{}, false, false, nil
+	}
+
+	user, err = app.users.Get(id)
+	if err != nil {
+		return models.User{}, false, false, err
+	}
+
+	if pending {
+		enrolled, required, err := app.twoFactorStatus(user)
+		if err != nil || enrolled || !required {
+			return models.User{}, false, false, err
+		}
+	}
+
+	return user, pending, true, nil
+}
+
+// twoFactorSecret is the secret being set up, a new one is made the first time the setup page is
+// shown and kept in the session until the user has shown their app has it.
+func (app *application) twoFactorSecret(r *http.Request) (string, error) {
+	secret := app.sessionManager.GetString(r.Context(), "totpSecret")
+	if secret != "" {
+		return secret, nil
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+
+	app.sessionManager.Put(r.Context(), "totpSecret", secret)
+
+	return secret, nil
+}
+
+func (app *application) twoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	user, _, ok, err := app.twoFactorSetupUser(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !ok {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := app.twoFactorSecret(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.TOTPSecret = secret
+	data.Form = twoFactorForm{}
+	app.render(w, r, http.StatusOK, "twofactor_setup.gohtml", data)
+}
+
+// twoFactorSetupPost turns on two-factor once the user has given a code from their app, and shows
+// them their recovery codes. An admin that had to set it up on their way in is signed in too.
+func (app *application) twoFactorSetupPost(w http.ResponseWriter, r *http.Request) {
+	user, pending, ok, err := app.twoFactorSetupUser(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !ok {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	var form twoFactorForm
+
+	if err = app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	secret := app.sessionManager.GetString(r.Context(), "totpSecret")
+	if secret == "" {
+		http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	step, valid := totp.Validate(secret, form.Code, time.Now())
+	form.CheckField(valid, "code", "That code isn't right, check the time on your phone is correct")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.User = user
+		data.TOTPSecret = secret
+		data.Form = form
+		app.render(w, r, http.StatusUnprocessableEntity, "twofactor_setup.gohtml", data)
+		return
+	}
+
+	codes, err := app.twoFactor.Enable(user.ID, secret, step)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Remove(r.Context(), "totpSecret")
+
+	app.audit(r, models.AuditEvent{Action: models.AuditTwoFactor, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(user.ID), Detail: "enabled"})
+
+	path := "/user/2fa"
+	if pending {
+		path = safePath(app.sessionManager.GetString(r.Context(), "twoFactorPath"))
+		method := app.sessionManager.GetString(r.Context(), "twoFactorMethod")
+
+		if err = app.logIn(r, user, method+", two-factor"); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.renderRecoveryCodes(w, r, codes, path)
+}
+
+// renderRecoveryCodes shows the user their new recovery codes, it's the only time they're shown.
+// next is where to carry on to once they've been written down.
+func (app *application) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string, next string) {
+	w.Header().Add("Cache-Control", "no-store")
+
+	data := app.newTemplateData(r)
+	data.RecoveryCodes = codes
+	data.Next = next
+	app.render(w, r, http.StatusOK, "twofactor_codes.gohtml", data)
+}
+
+// twoFactorQR is the QR code of the secret being set up, for the setup page to show. It's an image
+// of its own rather than inline in the page as the content security policy doesn't allow data: URLs.
+func (app *application) twoFactorQR(w http.ResponseWriter, r *http.Request) {
+	user, _, ok, err := app.twoFactorSetupUser(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	secret := app.sessionManager.GetString(r.Context(), "totpSecret")
+	if !ok || secret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	png, err := qrcode.Encode(totp.URI(totpIssuer, user.Email, secret), qrcode.Medium, 256)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Add("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// twoFactorSettings shows the signed in user whether they have two-factor turned on and lets them
+// turn it on or off, or get new recovery codes.
+func (app *application) twoFactorSettings(w http.ResponseWriter, r *http.Request) {
+	app.renderTwoFactorSettings(w, r, http.StatusOK, twoFactorForm{})
+}
+
+func (app *application) renderTwoFactorSettings(w http.ResponseWriter, r *http.Request, status int, form twoFactorForm) {
+	id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+
+	factor, err := app.twoFactor.Get(id)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.TwoFactor = factor
+	data.Form = form
+	app.render(w, r, status, "twofactor.gohtml", data)
+}
+
+// currentSecondFactor checks the code in form is a current one for the signed in user, turning
+// two-factor off or getting new recovery codes needs one so a session left open isn't enough.
+// ok is false if the settings page has been shown again with an error.
+func (app *application) currentSecondFactor(w http.ResponseWriter, r *http.Request) (factor models.TwoFactor, ok bool) {
+	var form twoFactorForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return models.TwoFactor{}, false
+	}
+
+	id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+
+	factor, err := app.twoFactor.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return models.TwoFactor{}, false
+	}
+
+	_, valid, err := app.checkSecondFactor(factor, form.Code)
+	if err != nil {
+		app.serverError(w, r, err)
+		return models.TwoFactor{}, false
+	}
+
+	if !valid {
+		form.AddFieldError("code", "That code isn't right or has already been used")
+		app.renderTwoFactorSettings(w, r, http.StatusUnprocessableEntity, form)
+		return models.TwoFactor{}, false
+	}
+
+	return factor, true
+}
+
+func (app *application) twoFactorDisablePost(w http.ResponseWriter, r *http.Request) {
+	if app.isAdmin(r) {
+		policy, err := app.securityPolicy.Get()
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		if policy.RequireAdminTwoFactor {
+			app.sessionManager.Put(r.Context(), "flash", "Admins have to keep two-factor sign in turned on")
+			http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+			return
+		}
+	}
+
+	factor, ok := app.currentSecondFactor(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.twoFactor.Disable(factor.UserId); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditEvent{Action: models.AuditTwoFactor, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(factor.UserId), Detail: "disabled"})
+
+	app.sessionManager.Put(r.Context(), "flash", "Two-factor sign in turned off")
+	http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+}
+
+func (app *application) twoFactorRecoveryPost(w http.ResponseWriter, r *http.Request) {
+	factor, ok := app.currentSecondFactor(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := app.twoFactor.NewRecoveryCodes(factor.UserId)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditEvent{Action: models.AuditTwoFactor, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(factor.UserId), Detail: "new recovery codes"})
+
+	app.renderRecoveryCodes(w, r, codes, "/user/2fa")
+}
+
+// twoFactorResetPost turns off two-factor for a user that's lost their phone and recovery codes,
+// they can sign in with just their password again (and set it up again, admins have to).
+func (app *application) twoFactorResetPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err = app.twoFactor.Disable(id); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditEvent{Action: models.AuditTwoFactor, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(id), Detail: "reset"})
+
+	app.sessionManager.Put(r.Context(), "flash", "Two-factor sign in reset")
+	http.Redirect(w, r, "/user/edit/"+strconv.Itoa(id), http.StatusSeeOther)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+	"fileshare/internal/totp"
+)
+
+// testSecret is the second factor alice has turned on in the tests.
+const testSecret = "JBSWY3DPEHPK3PXP"
+
+// currentCode is the code an authenticator app would show for secret right now.
+func currentCode(t *testing.T, secret string) string {
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// postCode gives code on the page at formPath, posting it to postPath.
+func (ts *testServer) postCode(t *testing.T, formPath, postPath, code string) (int, http.Header, string) {
+	_, _, body := ts.get(t, formPath)
+
+	form := url.Values{
+		"code":       {code},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+
+	return ts.postForm(t, postPath, form)
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app := newTestApplication(t)
+
+	if _, err := app.twoFactor.Enable(1, testSecret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{
+		"email":      {"alice@example.com"},
+		"password":   {"pa$$word"},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+	code, header, _ := ts.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login/2fa")
+
+	// The password alone doesn't sign in.
+	code, _, _ = ts.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, _, body = ts.postCode(t, "/user/login/2fa", "/user/login/2fa", "000000")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "That code isn&#39;t right")
+
+	totpCode := currentCode(t, testSecret)
+
+	code, header, _ = ts.postCode(t, "/user/login/2fa", "/user/login/2fa", totpCode)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/")
+
+	code, _, body = ts.get(t, "/user/2fa")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "you have 10 recovery")
+
+	audit := app.auditLog.(*mocks.AuditModel)
+	assert.Equal(t, strings.Join(audit.Actions(), " "), "login-failed login")
+	assert.Equal(t, audit.Events[1].Detail, "password, two-factor")
+
+	// Signing in somewhere else, the same code can't be used again but a recovery code can.
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	other.login(t, "alice@example.com", "pa$$word")
+
+	code, _, _ = other.postCode(t, "/user/login/2fa", "/user/login/2fa", totpCode)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	code, _, _ = other.postCode(t, "/user/login/2fa", "/user/login/2fa", "RECOV ERY03")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, _, body = other.get(t, "/user/2fa")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "You signed in with a recovery code, you have 9 left")
+
+	factor, err := app.twoFactor.Get(1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, factor.RecoveryCodes, 9)
+}
+
+func TestTwoFactorAttempts(t *testing.T) {
+	app := newTestApplication(t)
+
+	if _, err := app.twoFactor.Enable(1, testSecret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "alice@example.com", "pa$$word")
+
+	for range maxTwoFactorAttempts - 1 {
+		code, _, _ := ts.postCode(t, "/user/login/2fa", "/user/login/2fa", "000000")
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	}
+
+	code, header, _ := ts.postCode(t, "/user/login/2fa", "/user/login/2fa", "000000")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	// Even the right code is no good now, it's back to the password.
+	code, header, _ = ts.get(t, "/user/login/2fa")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	code, _, _ = ts.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusSeeOther)
+}
+
+var totpSecretRX = regexp.MustCompile(`Key: <code>([A-Z2-7]+)</code>`)
+
+// setUpTwoFactor goes through the setup page, returning the page with the recovery codes.
+func (ts *testServer) setUpTwoFactor(t *testing.T) (int, http.Header, string) {
+	code, _, body := ts.get(t, "/user/2fa/setup")
+	assert.Equal(t, code, http.StatusOK)
+
+	matches := totpSecretRX.FindStringSubmatch(body)
+	if len(matches) < 2 {
+		t.Fatal("no secret found in body")
+	}
+
+	code, header, _ := ts.get(t, "/user/2fa/qr")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, header.Get("Content-Type"), "image/png")
+
+	return ts.postCode(t, "/user/2fa/setup", "/user/2fa/setup", currentCode(t, matches[1]))
+}
+
+func TestTwoFactorSetup(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Nobody signed in has nothing to set up.
+	code, _, _ := ts.get(t, "/user/2fa/qr")
+	assert.Equal(t, code, http.StatusNotFound)
+
+	ts.login(t, "alice@example.com", "pa$$word")
+
+	code, _, body := ts.get(t, "/user/2fa")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Two-factor sign in is off")
+
+	code, _, body = ts.postCode(t, "/user/2fa/setup", "/user/2fa/setup", "000000")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "That code isn&#39;t right")
+
+	code, _, body = ts.setUpTwoFactor(t)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "recov-ery01")
+	assert.StringContains(t, body, "recov-ery10")
+
+	factor, err := app.twoFactor.Get(1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, factor.RecoveryCodes, 10)
+
+	// New recovery codes and turning it off need a code, the one used to set it up is spent.
+	code, _, _ = ts.postCode(t, "/user/2fa", "/user/2fa/recovery", currentCode(t, factor.Secret))
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	code, _, body = ts.postCode(t, "/user/2fa", "/user/2fa/recovery", "recov-ery01")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "recov-ery11")
+
+	code, _, _ = ts.postCode(t, "/user/2fa", "/user/2fa/disable", "recov-ery02")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	code, _, _ = ts.postCode(t, "/user/2fa", "/user/2fa/disable", "recov-ery12")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	_, err = app.twoFactor.Get(1)
+	assert.Equal(t, err, models.ErrNoRecord)
+
+	audit := app.auditLog.(*mocks.AuditModel)
+	assert.Equal(t, strings.Join(audit.Actions(), " "), "login two-factor two-factor two-factor")
+}
+
+func TestAdminTwoFactorRequired(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// An admin already signed in when it's required has to set it up before going on.
+	ts.login(t, "admin@example.com", "pa$$word")
+
+	code, _, body := ts.get(t, "/admin/security")
+	assert.Equal(t, code, http.StatusOK)
+
+	form := url.Values{
+		"requireAdminTwoFactor": {"true"},
+		"csrf_token":            {extractCSRFToken(t, body)},
+	}
+	code, _, _ = ts.postForm(t, "/admin/security", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, app.securityPolicy.(*mocks.SecurityPolicyModel).Policy.RequireAdminTwoFactor, true)
+
+	code, header, _ := ts.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/2fa/setup")
+
+	// Signing in again, an admin without it set up is only part way in until they do.
+	fresh := newTestServer(t, app.routes())
+	defer fresh.Close()
+
+	_, _, body = fresh.get(t, "/user/login")
+	form = url.Values{
+		"email":      {"admin@example.com"},
+		"password":   {"pa$$word"},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+	code, header, _ = fresh.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/2fa/setup")
+
+	code, header, _ = fresh.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	code, _, body = fresh.setUpTwoFactor(t)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, `href="/"`)
+
+	code, _, _ = fresh.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusOK)
+
+	// It can't be turned off while it's required.
+	code, _, _ = fresh.postCode(t, "/user/2fa", "/user/2fa/disable", "recov-ery01")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	_, err := app.twoFactor.Get(4)
+	assert.Equal(t, err, nil)
+
+	// Others aren't asked for it.
+	user := newTestServer(t, app.routes())
+	defer user.Close()
+
+	user.login(t, "alice@example.com", "pa$$word")
+
+	code, _, _ = user.get(t, "/user/update/")
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestTwoFactorReset(t *testing.T) {
+	app := newTestApplication(t)
+
+	if _, err := app.twoFactor.Enable(1, testSecret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "admin@example.com", "pa$$word")
+
+	code, header, _ := ts.postCode(t, "/user/edit/1", "/user/2fa/reset/1", "")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/edit/1")
+
+	_, err := app.twoFactor.Get(1)
+	assert.Equal(t, err, models.ErrNoRecord)
+
+	// Alice can sign in with just her password again.
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	_, _, body := other.get(t, "/user/login")
+	form := url.Values{
+		"email":      {"alice@example.com"},
+		"password":   {"pa$$word"},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+	_, header, _ = other.postForm(t, "/user/login", form)
+	assert.Equal(t, header.Get("Location"), "/")
+}
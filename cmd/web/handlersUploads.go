@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	//Internal
+	"fileshare/internal/models"
+	"fileshare/internal/storage"
+	"fileshare/internal/validator"
+)
+
+// Resumable uploads follow the core of the tus protocol (https://tus.io/protocols/resumable-upload):
+// a POST creates the upload, each PATCH appends a chunk at the offset the client says it is at, and a
+// HEAD tells a client that lost its connection where to carry on from. Chunks are stored encrypted
+// in the storage backend like any other file and the files row is only made once the last one is in.
+// The recipientName and recipientEmail metadata hold comma separated lists when there are several.
+// An upload that isn't finished within uploadTTL expires (the tus expiration extension), the janitor
+// removes it and its parts.
+
+const tusVersion = "1.0.0"
+
+// maxChunkSize caps the body of a single PATCH, big files are sent as many of these.
+const maxChunkSize = 64 << 20
+
+// chunkTimeout replaces the server's ReadTimeout and WriteTimeout for a PATCH, a chunk on a slow
+// connection takes longer than those allow.
+const chunkTimeout = 10 * time.Minute
+
+// assembleRate is the slowest the parts of a finished upload are expected to be read back, encrypted
+// and stored again (and scanned) in bytes a second, the last PATCH has long enough to do the whole
+// upload at this rate.
+const assembleRate = 4 << 20
+
+// uploadTTL is how long a resumable upload can be carried on for after it was started.
+const uploadTTL = 24 * time.Hour
+
+func (app *application) uploadCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if length > MaxResumableUploadSize {
+		app.clientError(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	expires, _ := strconv.Atoi(meta["expires"])
+	maxDownloads, _ := strconv.Atoi(meta["maxDownloads"])
+
+	form := fileCreateForm{
+		DocName: meta["filename"],
+		recipientFields: recipientFields{
+			RecipientNames:  []string{meta["recipientName"]},
+			RecipientEmails: []string{meta["recipientEmail"]},
+		},
+		SenderUserName: meta["senderName"],
+		SenderEmail:    meta["senderEmail"],
+		Expires:        expires,
+		MaxDownloads:   maxDownloads,
+	}
+
+	policy, err := app.uploadPolicy.Get()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	form.validate()
+	form.CheckField(validator.NotBlank(form.DocName), "uploadFile", "Please choose a file to upload")
+
+	// The content isn't here yet, its type is checked when the first chunk is
+	app.checkUpload(r, &form.Validator, policy, form.DocName, length, nil)
+
+	if !form.Valid() {
+		uploadFormErrors(w, form.Validator)
+		return
+	}
+
+	id, err := storage.NewKey()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	upload := models.Upload{
+		Id:             id,
+		UserId:         app.sessionManager.GetInt(r.Context(), "authenticatedUserID"),
+		Length:         length,
+		DocName:        form.DocName,
+		SenderName:     form.SenderUserName,
+		SenderEmail:    form.SenderEmail,
+		RecipientName:  meta["recipientName"],
+		RecipientEmail: meta["recipientEmail"],
+		MaxDownloads:   form.MaxDownloads,
+		Expires:        form.Expires,
+	}
+
+	if err := app.uploads.Insert(upload); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.Info("Upload started", "upload", id, "length", length)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Location", "/files/uploads/"+id)
+	w.Header().Set("Upload-Expires", time.Now().Add(uploadTTL).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (app *application) uploadStatus(w http.ResponseWriter, r *http.Request) {
+	upload, ok := app.uploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", uploadExpires(upload).Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (app *application) uploadPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := app.uploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		app.clientError(w, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// The client has to carry on from where we are, not where it thinks it is.
+	if offset != upload.Offset {
+		app.clientError(w, http.StatusConflict)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(chunkTimeout)); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if err := rc.SetWriteDeadline(time.Now().Add(chunkTimeout)); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var src io.Reader = http.MaxBytesReader(w, r.Body, min(maxChunkSize, upload.Length-offset))
+
+	// The first chunk has the start of the file, where its type can be sniffed from. An upload of
+	// something that isn't allowed goes no further.
+	if offset == 0 {
+		policy, err := app.uploadPolicy.Get()
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		br := bufio.NewReaderSize(src, sniffLen)
+		head, _ := br.Peek(sniffLen)
+
+		var v validator.Validator
+		app.checkUpload(r, &v, policy, upload.DocName, upload.Length, head)
+
+		if !v.Valid() {
+			if err := app.removeUpload(upload); err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+
+			uploadFormErrors(w, v)
+			return
+		}
+
+		src = br
+	}
+
+	body := &countingReader{r: src}
+
+	stored, err := app.storeFile(body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			app.clientError(w, http.StatusRequestEntityTooLarge)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	part := models.UploadPart{Offset: offset, Size: body.n, StorageKey: stored.StorageKey, WrappedKey: stored.WrappedKey}
+
+	// An empty chunk (only useful for an empty file) isn't worth keeping as a part.
+	if part.Size == 0 {
+		if err := app.storage.Delete(stored.StorageKey); err != nil {
+			app.logger.Info("Error removing upload part", "error", err)
+		}
+	} else if err := app.uploads.AddPart(upload.Id, part); err != nil {
+		if err := app.storage.Delete(stored.StorageKey); err != nil {
+			app.logger.Info("Error removing upload part", "error", err)
+		}
+
+		if errors.Is(err, models.ErrUploadOffset) {
+			app.clientError(w, http.StatusConflict)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	upload.Offset += body.n
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", uploadExpires(upload).Format(http.TimeFormat))
+
+	if upload.Offset == upload.Length {
+		// Putting a big upload back together takes a while, the answer can't be sent until it's done
+		assemble := chunkTimeout + time.Duration(upload.Length/assembleRate)*time.Second
+		if err := rc.SetWriteDeadline(time.Now().Add(assemble)); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		path, sharedF, err := app.completeUpload(r, upload)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.sessionManager.Put(r.Context(), "flash", uploadedFlash([]models.SharedFile{sharedF}))
+		w.Header().Set("Content-Location", path)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) uploadDelete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := app.uploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.removeUpload(upload); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadFormErrors sends the field errors in v back to the JavaScript that drives the upload from
+// the create page, as JSON for it to show next to the form.
+func uploadFormErrors(w http.ResponseWriter, v validator.Validator) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(v)
+}
+
+// completeUpload puts the parts of a finished upload back together as one stored file, shares it and
+// cleans the parts up. It returns the path of the new file's page and the file as it was shared.
+func (app *application) completeUpload(r *http.Request, upload models.Upload) (string, models.SharedFile, error) {
+	parts, err := app.uploads.Parts(upload.Id)
+	if err != nil {
+		return "", models.SharedFile{}, err
+	}
+
+	src := &partsReader{app: app, parts: parts}
+	defer src.Close()
+
+	stored, err := app.storeScannedFile(src)
+	if err != nil {
+		return "", models.SharedFile{}, err
+	}
+
+	form := fileCreateForm{
+		recipientFields: recipientFields{
+			RecipientNames:  []string{upload.RecipientName},
+			RecipientEmails: []string{upload.RecipientEmail},
+		},
+		SenderUserName: upload.SenderName,
+		SenderEmail:    upload.SenderEmail,
+		Expires:        upload.Expires,
+		MaxDownloads:   upload.MaxDownloads,
+	}
+
+	files := []models.SharedFile{stored.sharedFile(upload.DocName)}
+
+	path, err := app.shareFiles(r, form, files)
+	if err != nil {
+		return "", models.SharedFile{}, err
+	}
+
+	if err := app.removeUpload(upload); err != nil {
+		app.logger.Info("Error removing finished upload", "upload", upload.Id, "error", err)
+	}
+
+	return path, files[0], nil
+}
+
+// removeUpload deletes an upload and the parts it has stored so far.
+func (app *application) removeUpload(upload models.Upload) error {
+	parts, err := app.uploads.Parts(upload.Id)
+	if err != nil {
+		return err
+	}
+
+	if err := app.uploads.Remove(upload.Id); err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if err := app.storage.Delete(part.StorageKey); err != nil {
+			app.logger.Info("Error removing upload part", "key", part.StorageKey, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// uploadFromRequest loads the upload named by the {id} path value, an upload can only be carried on
+// by the user that started it. If it returns false a response has already been sent.
+func (app *application) uploadFromRequest(w http.ResponseWriter, r *http.Request) (models.Upload, bool) {
+	upload, err := app.uploads.Get(r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.NotFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return models.Upload{}, false
+	}
+
+	if upload.UserId != app.sessionManager.GetInt(r.Context(), "authenticatedUserID") {
+		http.NotFound(w, r)
+		return models.Upload{}, false
+	}
+
+	// The janitor hasn't got to it yet, but it can't be carried on with
+	if !time.Now().Before(uploadExpires(upload)) {
+		app.clientError(w, http.StatusGone)
+		return models.Upload{}, false
+	}
+
+	return upload, true
+}
+
+// uploadExpires is when an upload can no longer be carried on with.
+func uploadExpires(upload models.Upload) time.Time {
+	return upload.CreatedAt.Add(uploadTTL).UTC()
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header, a comma separated list of keys each
+// followed by a space and its base64 encoded value. Values with control characters are refused, the
+// names in them end up in email headers where a line break would start a new header.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.ContainsFunc(string(decoded), unicode.IsControl) {
+			return nil, fmt.Errorf("control character in %s", key)
+		}
+
+		meta[key] = string(decoded)
+	}
+
+	return meta, nil
+}
+
+// countingReader keeps track of how much has been read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// partsReader reads the parts of an upload back to back, only opening one part at a time.
+type partsReader struct {
+	app     *application
+	parts   []models.UploadPart
+	current io.ReadCloser
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			f, _, err := p.app.openStored(p.parts[0].StorageKey, p.parts[0].WrappedKey)
+			if err != nil {
+				return 0, err
+			}
+
+			p.current = f
+			p.parts = p.parts[1:]
+		}
+
+		n, err := p.current.Read(b)
+		if errors.Is(err, io.EOF) {
+			p.current.Close()
+			p.current = nil
+
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.current == nil {
+		return nil
+	}
+
+	return p.current.Close()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+)
+
+func uploadMetadata(values map[string]string) string {
+	var pairs []string
+	for k, v := range values {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func TestResumableUpload(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/create")
+	csrfToken := extractCSRFToken(t, body)
+
+	content := strings.Repeat("0123456789", 100)
+
+	metadata := map[string]string{
+		"filename":       "numbers.txt",
+		"recipientName":  "Susan Smith, Alice Jones",
+		"recipientEmail": "foo@bar.com, alice@example.com",
+		"senderName":     "Cheryl Smith",
+		"senderEmail":    "Abar@example.com",
+		"expires":        "7",
+	}
+
+	t.Run("Invalid Metadata", func(t *testing.T) {
+		header := http.Header{
+			"X-Csrf-Token":    {csrfToken},
+			"Upload-Length":   {"1000"},
+			"Upload-Metadata": {uploadMetadata(map[string]string{"filename": "numbers.txt"})},
+		}
+
+		code, _, body := ts.request(t, http.MethodPost, "/files/uploads", header, nil)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.StringContains(t, body, "recipientEmail")
+	})
+
+	header := http.Header{
+		"X-Csrf-Token":    {csrfToken},
+		"Upload-Length":   {"1000"},
+		"Upload-Metadata": {uploadMetadata(metadata)},
+	}
+
+	code, rsHeader, _ := ts.request(t, http.MethodPost, "/files/uploads", header, nil)
+	assert.Equal(t, code, http.StatusCreated)
+
+	location := rsHeader.Get("Location")
+	assert.StringContains(t, location, "/files/uploads/")
+
+	// The upload has to be finished within a day.
+	expires, err := http.ParseTime(rsHeader.Get("Upload-Expires"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expires.After(time.Now().Add(uploadTTL-time.Minute)), true)
+
+	patch := func(offset, chunk string) (int, http.Header) {
+		header := http.Header{
+			"X-Csrf-Token":  {csrfToken},
+			"Content-Type":  {"application/offset+octet-stream"},
+			"Upload-Offset": {offset},
+		}
+
+		code, rsHeader, _ := ts.request(t, http.MethodPatch, location, header, strings.NewReader(chunk))
+		return code, rsHeader
+	}
+
+	code, rsHeader = patch("0", content[:400])
+	assert.Equal(t, code, http.StatusNoContent)
+	assert.Equal(t, rsHeader.Get("Upload-Offset"), "400")
+
+	// Sending the same chunk again (e.g. the client missed our answer) is refused.
+	code, _ = patch("0", content[:400])
+	assert.Equal(t, code, http.StatusConflict)
+
+	// A client that lost its connection asks where to carry on from.
+	code, rsHeader, _ = ts.request(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, rsHeader.Get("Upload-Offset"), "400")
+	assert.Equal(t, rsHeader.Get("Upload-Length"), "1000")
+
+	// More than is left of the upload is too much.
+	code, _ = patch("400", content[400:]+"extra")
+	assert.Equal(t, code, http.StatusRequestEntityTooLarge)
+
+	code, rsHeader = patch("400", content[400:])
+	assert.Equal(t, code, http.StatusNoContent)
+	assert.Equal(t, rsHeader.Get("Upload-Offset"), "1000")
+	assert.Equal(t, rsHeader.Get("Content-Location"), "/files/view/"+mocks.NewToken)
+
+	// Only the assembled file is left in storage and it holds the whole upload.
+	objects, err := app.storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(objects), 1)
+
+	// Both recipients from the metadata end up on the file.
+	inserted := app.sharedFile.(*mocks.SharedFileModel).Inserted
+	assert.Equal(t, len(inserted), 1)
+	assert.Equal(t, inserted[0].ContentType, "text/plain; charset=utf-8")
+	assert.Equal(t, inserted[0].RecipientNames(), "Susan Smith, Alice Jones")
+
+	code, _, _ = ts.request(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	meta, err := parseUploadMetadata("filename bXkgZmlsZS5wZGY=,empty ,expires Nw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, meta["filename"], "my file.pdf")
+	assert.Equal(t, meta["empty"], "")
+	assert.Equal(t, meta["expires"], "7")
+
+	_, err = parseUploadMetadata("filename not-base64!")
+	assert.Equal(t, err != nil, true)
+
+	// "a.pdf\r\nBcc: x@example.com"
+	_, err = parseUploadMetadata("filename YS5wZGYNCkJjYzogeEBleGFtcGxlLmNvbQ==")
+	assert.Equal(t, err != nil, true)
+}
+
+func TestResumableUploadPolicy(t *testing.T) {
+	app := newTestApplication(t)
+	app.uploadPolicy.Update(models.UploadPolicy{
+		BlockedExtensions: models.DefaultUploadPolicy.BlockedExtensions,
+		BlockedTypes:      models.DefaultUploadPolicy.BlockedTypes,
+		UserMaxSize:       1 << 20,
+	})
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/create")
+	csrfToken := extractCSRFToken(t, body)
+
+	create := func(filename, length string) (int, http.Header, string) {
+		header := http.Header{
+			"X-Csrf-Token":  {csrfToken},
+			"Upload-Length": {length},
+			"Upload-Metadata": {uploadMetadata(map[string]string{
+				"filename":       filename,
+				"recipientName":  "Susan Smith",
+				"recipientEmail": "foo@bar.com",
+				"senderName":     "Cheryl Smith",
+				"senderEmail":    "Abar@example.com",
+				"expires":        "7",
+			})},
+		}
+
+		return ts.request(t, http.MethodPost, "/files/uploads", header, nil)
+	}
+
+	// The name and size are checked before anything is sent.
+	code, _, body := create("setup.exe", "1000")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "setup.exe can't be uploaded, that kind of file isn't allowed")
+
+	code, _, body = create("numbers.txt", "2000000")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "numbers.txt is too big, files can be at most 1.0 MiB")
+
+	// The type is checked when the first chunk comes in, and the upload is thrown away.
+	content := windowsProgram() + strings.Repeat("0", 1000-len(windowsProgram()))
+
+	code, rsHeader, _ := create("numbers.txt", "1000")
+	assert.Equal(t, code, http.StatusCreated)
+	location := rsHeader.Get("Location")
+
+	header := http.Header{
+		"X-Csrf-Token":  {csrfToken},
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {"0"},
+	}
+
+	code, _, body = ts.request(t, http.MethodPatch, location, header, strings.NewReader(content[:400]))
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "application/x-msdownload files aren't allowed")
+
+	code, _, _ = ts.request(t, http.MethodHead, location, nil, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	objects, err := app.storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(objects), 0)
+}
+
+func TestResumableUploadExpired(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "Abar@example.com", "pa$$word")
+
+	_, _, body := ts.get(t, "/files/create")
+	csrfToken := extractCSRFToken(t, body)
+
+	// Abar started this upload two days ago and never finished it.
+	upload := models.Upload{Id: "abandoned", UserId: 2, Length: 1000, DocName: "numbers.txt",
+		CreatedAt: time.Now().Add(-48 * time.Hour)}
+	if err := app.uploads.Insert(upload); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, _ := ts.request(t, http.MethodHead, "/files/uploads/abandoned", nil, nil)
+	assert.Equal(t, code, http.StatusGone)
+
+	header := http.Header{
+		"X-Csrf-Token":  {csrfToken},
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {"0"},
+	}
+
+	code, _, _ = ts.request(t, http.MethodPatch, "/files/uploads/abandoned", header, strings.NewReader("0123456789"))
+	assert.Equal(t, code, http.StatusGone)
+}
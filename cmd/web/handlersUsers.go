@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	//Internal
 	"fileshare/internal/models"
@@ -116,8 +117,22 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 	id, err := app.users.Authenticate(form.Email, form.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredentials) {
+			app.audit(r, models.AuditEvent{Action: models.AuditLoginFailed, ActorEmail: form.Email,
+				TargetType: models.AuditTargetUser, Detail: "password"})
+
 			form.AddNonFieldError("Email or password is incorrect")
 
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, r, http.StatusUnprocessableEntity, "login.gohtml", data)
+		} else if errors.Is(err, models.ErrNotLinked) {
+			// Only said once the directory has taken their password, so it doesn't give away who
+			// has an account.
+			app.audit(r, models.AuditEvent{Action: models.AuditLoginFailed, ActorEmail: form.Email,
+				TargetType: models.AuditTargetUser, Detail: "directory, not linked"})
+
+			form.AddNonFieldError("There's already an account for your email that isn't set up to sign in with the directory, ask an admin to link it")
+
 			data := app.newTemplateData(r)
 			data.Form = form
 			app.render(w, r, http.StatusUnprocessableEntity, "login.gohtml", data)
@@ -127,22 +142,122 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Use the RenewToken() method on the current session to change the session
-	// ID. It's good practice to generate a new session ID when the
-	// authentication state or privilege levels changes for the user (e.g. login
-	// and logout operations). -- OWASP Session Fixation Mitigation
-	if err = app.sessionManager.RenewToken(r.Context()); err != nil {
+	user, err := app.users.Get(id)
+	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	// Add the ID & Email of the current user to the session, so that they are now
-	// 'logged in'.
-	app.sessionManager.Put(r.Context(), "authenticatedUserID", id)
-	app.sessionManager.Put(r.Context(), "authenticatedUserEmail", form.Email)
+	app.loginWith(w, r, user, "password", "/")
+}
+
+// Magic links sign someone in without a password and take them where the link was for, that's how
+// recipients get to the files sent to them. Following a link only shows a page with a button that
+// does the signing in, so mail scanners that open links don't use them up.
+
+// magicLinkTTL is how long the link sent with a file works for.
+const magicLinkTTL = 7 * 24 * time.Hour
+
+// loginLinkTTL is how long a link asked for from the login page works for.
+const loginLinkTTL = time.Hour
+
+// recipientLink is the link to path emailed to user about files sent to them. Only guests get a magic
+// link, anyone else signs in the usual way, otherwise whoever got hold of the email could get into an
+// admin's or a staff member's account with it.
+func (app *application) recipientLink(user models.User, path string) (string, error) {
+	if !user.Guest {
+		return path, nil
+	}
+
+	token, err := app.loginTokens.Insert(user.ID, path, magicLinkTTL)
+	if err != nil {
+		return "", err
+	}
 
-	// Redirect the user to the create snippet page.
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return "/user/magic/" + token, nil
+}
+
+type magicLinkForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) magicLink(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = magicLinkForm{}
+	app.render(w, r, http.StatusOK, "magic.gohtml", data)
+}
+
+func (app *application) magicLinkPost(w http.ResponseWriter, r *http.Request) {
+	userId, path, err := app.loginTokens.Consume(r.PathValue("token"))
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var user models.User
+	if err == nil {
+		user, err = app.users.Get(userId)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	// A link left over from before an account was managed somewhere else doesn't get into it.
+	if err != nil || user.Disabled || user.Source != models.SourceLocal {
+		app.audit(r, models.AuditEvent{Action: models.AuditLoginFailed, ActorEmail: user.Email,
+			TargetType: models.AuditTargetUser, Detail: "magic link"})
+
+		form := magicLinkForm{}
+		form.AddNonFieldError("This link has expired or has already been used, you can ask for a new one from the login page")
+
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, r, http.StatusNotFound, "magic.gohtml", data)
+		return
+	}
+
+	app.loginWith(w, r, user, "magic link", path)
+}
+
+// loginLinkPost emails a new magic link to a guest, they don't have a password to log in with once
+// the link that came with their file has been used. The answer is the same whether or not a link
+// was sent, so it can't be used to find out who has an account. Making the token and sending it
+// happen after the response so it takes as long either way.
+func (app *application) loginLinkPost(w http.ResponseWriter, r *http.Request) {
+	var form magicLinkForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.users.GetByEmail(form.Email)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err == nil && user.Guest && !user.Disabled && user.Source == models.SourceLocal {
+		app.background(func() {
+			token, err := app.loginTokens.Insert(user.ID, "/", loginLinkTTL)
+			if err != nil {
+				app.logger.Error("making login link token", "email", user.Email, "error", err.Error())
+				return
+			}
+
+			if err = app.config.SendLoginLink(user.Name, user.Email, "/user/magic/"+token); err != nil {
+				app.logger.Error("sending login link", "email", user.Email, "error", err.Error())
+				return
+			}
+
+			app.logger.Info("Login link sent", "email", user.Email)
+		})
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "If you have been sent files at that address, a sign in link is on its way")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
 func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
@@ -156,6 +271,7 @@ func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
 	// Remove the authenticatedUserID from the session data so that the user is
 	// 'logged out'.
 	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+	app.clearPendingLogin(r)
 
 	// Add a flash message to the session to confirm to the user that they've been
 	// logged out.
@@ -237,6 +353,10 @@ func (app *application) editUserPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := app.users.UpdateUser(id, form.Name, form.Email, form.Password, form.Admin, form.User, form.Guest)
+	if err == nil {
+		app.audit(r, models.AuditEvent{Action: models.AuditUserEdit, TargetType: models.AuditTargetUser,
+			Target: strconv.Itoa(id), Detail: form.Email})
+	}
 
 	data := app.newTemplateData(r)
 	data.User = user
@@ -255,12 +375,17 @@ func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil || id < 1 {
 		http.NotFound(w, r)
+		return
 	}
 
 	if err := app.users.DeleteUser(id); err != nil {
 		app.serverError(w, r, err)
+		return
 	}
 
+	app.audit(r, models.AuditEvent{Action: models.AuditUserDelete, TargetType: models.AuditTargetUser,
+		Target: strconv.Itoa(id)})
+
 	app.sessionManager.Put(r.Context(), "flash", "User Deleted")
 	http.Redirect(w, r, "/users/", http.StatusSeeOther)
 }
@@ -301,6 +426,10 @@ func (app *application) updateUserPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := app.users.UpdateUser(id, form.Name, form.Email, form.Password, false, true, false)
+	if err == nil {
+		app.audit(r, models.AuditEvent{Action: models.AuditUserEdit, TargetType: models.AuditTargetUser,
+			Target: strconv.Itoa(id), Detail: form.Email})
+	}
 
 	data := app.newTemplateData(r)
 	data.User = user
@@ -308,3 +437,27 @@ func (app *application) updateUserPost(w http.ResponseWriter, r *http.Request) {
 	app.sessionManager.Put(r.Context(), "flash", "Information Updated")
 	app.render(w, r, http.StatusOK, "user_password.gohtml", data)
 }
+
+type notificationsForm struct {
+	NotifyDownloads bool `form:"notifyDownloads"`
+}
+
+// notificationsPost saves whether the signed in user is emailed when their files are downloaded.
+func (app *application) notificationsPost(w http.ResponseWriter, r *http.Request) {
+	var form notificationsForm
+
+	if err := app.decodePostForm(r, &form); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+
+	if err := app.users.SetNotifyDownloads(id, form.NotifyDownloads); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Email settings saved")
+	http.Redirect(w, r, "/user/update/", http.StatusSeeOther)
+}
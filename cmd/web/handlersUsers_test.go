@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+)
+
+func TestMagicLink(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// The recipient of the mock file is user 3.
+	token, err := app.loginTokens.Insert(3, "/files/view/"+mocks.FileToken, magicLinkTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the link doesn't sign in by itself.
+	code, _, body := ts.get(t, "/user/magic/"+token)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Sign In")
+
+	code, _, _ = ts.get(t, "/files/view/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	form := url.Values{"csrf_token": {extractCSRFToken(t, body)}}
+
+	code, header, _ := ts.postForm(t, "/user/magic/"+token, form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/files/view/"+mocks.FileToken)
+
+	code, _, body = ts.get(t, "/files/view/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Big Important Document")
+
+	// A link only works once.
+	_, _, body = ts.get(t, "/user/magic/"+token)
+	form = url.Values{"csrf_token": {extractCSRFToken(t, body)}}
+
+	code, _, body = ts.postForm(t, "/user/magic/"+token, form)
+	assert.Equal(t, code, http.StatusNotFound)
+	assert.StringContains(t, body, "expired or has already been used")
+
+	// Nor does one for an account that's since been linked to single sign-on.
+	if err = app.users.SetSource(3, models.SourceSSO); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err = app.loginTokens.Insert(3, "/files/view/"+mocks.FileToken, magicLinkTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	_, _, body = other.get(t, "/user/magic/"+token)
+	form = url.Values{"csrf_token": {extractCSRFToken(t, body)}}
+
+	code, _, _ = other.postForm(t, "/user/magic/"+token, form)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _, _ = other.get(t, "/files/view/"+mocks.FileToken)
+	assert.Equal(t, code, http.StatusSeeOther)
+}
+
+// brokenMail is the mock mail settings with a mail server that can't be reached.
+type brokenMail struct {
+	*mocks.ServerConfigModel
+}
+
+func (m brokenMail) SendLoginLink(name, email, linkPath string) error {
+	return errors.New("connection refused")
+}
+
+func TestLoginLinkPost(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		brokenMail bool
+		wantLinks  int
+	}{
+		{name: "Guest", email: "foo@bar.com", wantLinks: 1},
+		{name: "User", email: "Abar@example.com", wantLinks: 0},
+		{name: "Unknown", email: "nobody@example.com", wantLinks: 0},
+		{name: "Mail Down", email: "foo@bar.com", brokenMail: true, wantLinks: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			config := &mocks.ServerConfigModel{}
+			app.config = config
+			if tt.brokenMail {
+				app.config = brokenMail{config}
+			}
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			_, _, body := ts.get(t, "/user/login")
+
+			form := url.Values{
+				"csrf_token": {extractCSRFToken(t, body)},
+				"email":      {tt.email},
+			}
+
+			// Everyone gets the same answer.
+			code, header, _ := ts.postForm(t, "/user/login/link", form)
+			assert.Equal(t, code, http.StatusSeeOther)
+			assert.Equal(t, header.Get("Location"), "/user/login")
+
+			app.tasks.Wait()
+			assert.Equal(t, len(config.Links), tt.wantLinks)
+		})
+	}
+}
+
+// testDirectory is a company directory for the login tests, it knows the people in it and their
+// passwords. down makes it act like it can't be reached.
+type testDirectory struct {
+	people map[string]models.Identity
+	down   bool
+}
+
+func (d *testDirectory) Authenticate(email, password string) (models.Identity, error) {
+	if d.down {
+		return models.Identity{}, errors.New("directory unreachable")
+	}
+
+	identity, ok := d.people[email]
+	if !ok {
+		return models.Identity{}, models.ErrNoRecord
+	}
+	if password != "dir-pa$$" {
+		return models.Identity{}, models.ErrInvalidCredentials
+	}
+
+	return identity, nil
+}
+
+// tryLogin posts the login form, returning the status.
+func (ts *testServer) tryLogin(t *testing.T, email, password string) int {
+	_, _, body := ts.get(t, "/user/login")
+
+	form := url.Values{
+		"email":      {email},
+		"password":   {password},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+
+	code, _, _ := ts.postForm(t, "/user/login", form)
+	return code
+}
+
+func TestDirectoryLogin(t *testing.T) {
+	app := newTestApplication(t)
+
+	directory := &testDirectory{people: map[string]models.Identity{
+		"carol@example.com": {Name: "Carol", Email: "carol@example.com", User: true},
+		"alice@example.com": {Name: "Alice", Email: "alice@example.com", Admin: true, User: true},
+	}}
+	users := &mocks.UserModel{Authenticators: []models.Authenticator{directory}}
+	app.users = users
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Someone new from the directory gets a users row the first time they sign in.
+	assert.Equal(t, ts.tryLogin(t, "carol@example.com", "dir-pa$$"), http.StatusSeeOther)
+
+	carol, err := users.GetByEmail("carol@example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, carol.Name, "Carol")
+	assert.Equal(t, carol.User, true)
+	assert.Equal(t, carol.Source, models.SourceLDAP)
+
+	code, _, _ := ts.get(t, "/files/create")
+	assert.Equal(t, code, http.StatusOK)
+
+	// The directory decides for the people in it, a password here doesn't get them in.
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	assert.Equal(t, other.tryLogin(t, "alice@example.com", "pa$$word"), http.StatusUnprocessableEntity)
+	assert.Equal(t, other.tryLogin(t, "carol@example.com", "wrong"), http.StatusUnprocessableEntity)
+
+	// Everyone else signs in here as before.
+	assert.Equal(t, other.tryLogin(t, "foo@bar.com", "pa$$word"), http.StatusSeeOther)
+
+	// Their roles follow the directory.
+	directory.people["carol@example.com"] = models.Identity{Email: "carol@example.com", Admin: true}
+
+	admin := newTestServer(t, app.routes())
+	defer admin.Close()
+
+	assert.Equal(t, admin.tryLogin(t, "carol@example.com", "dir-pa$$"), http.StatusSeeOther)
+
+	code, _, _ = admin.get(t, "/admin/policy")
+	assert.Equal(t, code, http.StatusOK)
+
+	// Someone disabled here stays out.
+	if err = users.Insert("Dan", "dan@example.com", "pa$$word", false, true, false, true); err != nil {
+		t.Fatal(err)
+	}
+	directory.people["dan@example.com"] = models.Identity{Email: "dan@example.com", User: true}
+
+	assert.Equal(t, other.tryLogin(t, "dan@example.com", "dir-pa$$"), http.StatusUnprocessableEntity)
+
+	// Alice had a password here before the directory, it doesn't sign in to her account until an
+	// admin links it.
+	linked := newTestServer(t, app.routes())
+	defer linked.Close()
+
+	_, _, body := linked.get(t, "/user/login")
+	form := url.Values{
+		"email":      {"alice@example.com"},
+		"password":   {"dir-pa$$"},
+		"csrf_token": {extractCSRFToken(t, body)},
+	}
+
+	code, _, body = linked.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "ask an admin to link it")
+
+	alice, err := users.GetByEmail("alice@example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, alice.Source, models.SourceLocal)
+
+	if err = app.runCommand([]string{"link-ldap", "-email=alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	audit := app.auditLog.(*mocks.AuditModel)
+	assert.Equal(t, audit.Events[len(audit.Events)-1].Detail, `link-ldap, was ""`)
+
+	assert.Equal(t, linked.tryLogin(t, "alice@example.com", "dir-pa$$"), http.StatusSeeOther)
+
+	// An account single sign-on manages is left to it.
+	if err = users.Insert("Erin", "erin@example.com", "pa$$word", false, true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	erin, err := users.GetByEmail("erin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = users.SetSource(erin.ID, models.SourceSSO); err != nil {
+		t.Fatal(err)
+	}
+	directory.people["erin@example.com"] = models.Identity{Email: "erin@example.com", Admin: true, User: true}
+
+	assert.Equal(t, other.tryLogin(t, "erin@example.com", "dir-pa$$"), http.StatusUnprocessableEntity)
+
+	erin, err = users.GetByEmail("erin@example.com")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, erin.Admin, false)
+
+	// With the directory down guests can still sign in, its users can't, not even with an old
+	// password from here.
+	directory.down = true
+
+	guest := newTestServer(t, app.routes())
+	defer guest.Close()
+
+	assert.Equal(t, guest.tryLogin(t, "foo@bar.com", "pa$$word"), http.StatusSeeOther)
+	assert.Equal(t, guest.tryLogin(t, "carol@example.com", "dir-pa$$"), http.StatusInternalServerError)
+	assert.Equal(t, guest.tryLogin(t, "alice@example.com", "pa$$word"), http.StatusInternalServerError)
+}
@@ -1,14 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
+	"hash"
+	"io"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"path/filepath"
 	"runtime/debug"
+	"strings"
 	"time"
 
+	//Internal
+	"fileshare/internal/envelope"
+	"fileshare/internal/models"
+	"fileshare/internal/scanner"
+	"fileshare/internal/storage"
+
 	//External
 	"github.com/go-playground/form/v4"
 	"github.com/justinas/nosurf"
@@ -26,6 +44,24 @@ func (app *application) serverError(w http.ResponseWriter, r *http.Request, err
 
 }
 
+// background runs fn after the response has gone, for work like sending an email that shouldn't hold
+// it up. The server waits for it to finish when it shuts down.
+func (app *application) background(fn func()) {
+	app.tasks.Add(1)
+
+	go func() {
+		defer app.tasks.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprint(err), "trace", string(debug.Stack()))
+			}
+		}()
+
+		fn()
+	}()
+}
+
 func (app *application) clientError(w http.ResponseWriter, status int) {
 	http.Error(w, http.StatusText(status), status)
 }
@@ -61,7 +97,7 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, status in
 }
 
 func (app *application) newTemplateData(r *http.Request) templateData {
-	return templateData{
+	data := templateData{
 		CurrentYear:     time.Now().Year(),
 		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
 		IsAuthenticated: app.isAuthenticated(r),
@@ -70,13 +106,22 @@ func (app *application) newTemplateData(r *http.Request) templateData {
 		IsUser:          app.isUser(r),
 		CSRFToken:       nosurf.Token(r),
 	}
+
+	// The login page offers single sign-on when it's set up.
+	if app.sso != nil {
+		data.SSOName = app.sso.config.Name
+	}
+
+	return data
 }
 
 func (app *application) decodePostForm(r *http.Request, dst any) error {
 	// Call ParseForm() on the request, in the same way that we did in our
 	// snippetCreatePost handler.
-	err := r.ParseMultipartForm(MaxUploadSize)
-	if err != nil {
+	// Forms that don't upload anything are posted url-encoded, ParseMultipartForm has
+	// already parsed those by the time it complains they aren't multipart.
+	err := r.ParseMultipartForm(multipartMemory)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
 		return err
 	}
 
@@ -137,19 +182,465 @@ func (app *application) isUser(r *http.Request) bool {
 	return isUser
 }
 
-// RandPasswordGen get a random string of alphanum characters based on int length
-func (app *application) RandPasswordGen(length int) string {
+// sharedFileFromContext returns the file that requireFileAccess loaded and authorized for this request.
+func (app *application) sharedFileFromContext(r *http.Request) models.SharedFile {
+	sharedF, ok := r.Context().Value(sharedFileContextKey).(models.SharedFile)
+	if !ok {
+		panic("no shared file in request context")
+	}
 
-	var (
-		seededRand *rand.Rand = rand.New(
-			rand.NewSource(time.Now().UnixNano()))
-		charset = "abcdefghijklmnopqrstuvwxyz" +
-			"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	)
+	return sharedF
+}
+
+// uploadPolicyFromContext returns the upload policy that limitUpload loaded for this request.
+func (app *application) uploadPolicyFromContext(r *http.Request) models.UploadPolicy {
+	policy, ok := r.Context().Value(uploadPolicyContextKey).(models.UploadPolicy)
+	if !ok {
+		panic("no upload policy in request context")
+	}
+
+	return policy
+}
+
+// shareFromContext returns the files of the share that requireShareAccess loaded for this request.
+func (app *application) shareFromContext(r *http.Request) []models.SharedFile {
+	files, ok := r.Context().Value(shareContextKey).([]models.SharedFile)
+	if !ok {
+		panic("no share in request context")
+	}
+
+	return files
+}
+
+// viewableFiles filters files down to the ones the current user can view.
+func (app *application) viewableFiles(r *http.Request, files []models.SharedFile) []models.SharedFile {
+	email := app.sessionManager.GetString(r.Context(), "authenticatedUserEmail")
+	admin := app.isAdmin(r)
+
+	var viewable []models.SharedFile
+
+	for _, f := range files {
+		if f.CanView(email, admin) {
+			viewable = append(viewable, f)
+		}
+	}
+
+	return viewable
+}
+
+// maxUserAgent is as much of the User-Agent header as is kept in the audit log.
+const maxUserAgent = 512
+
+// audit records event in the audit log along with who did it and where from, the actor is whoever is
+// signed in unless event already has one. Failing to record is logged but doesn't stop the request.
+func (app *application) audit(r *http.Request, event models.AuditEvent) {
+	if event.ActorId == 0 && event.ActorEmail == "" {
+		event.ActorId = app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+		event.ActorEmail = app.sessionManager.GetString(r.Context(), "authenticatedUserEmail")
+	}
+
+	event.IP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event.IP = host
+	}
+
+	event.UserAgent = r.UserAgent()
+	if len(event.UserAgent) > maxUserAgent {
+		event.UserAgent = strings.ToValidUTF8(event.UserAgent[:maxUserAgent], "")
+	}
+
+	if err := app.auditLog.Insert(event); err != nil {
+		app.logger.Error("Error recording audit event", "action", event.Action, "target", event.Target,
+			"error", err.Error())
+	}
+}
+
+// storedFile is what storeFile hands back, the fields that need to be kept to read the content again
+// and the size and SHA-256 of the content as it was uploaded. Rejected is set by storeScannedFile
+// when the virus scanner found something.
+type storedFile struct {
+	StorageKey  string
+	WrappedKey  []byte
+	ContentType string
+	Size        int64
+	Checksum    string
+	Rejected    string
+}
+
+// storeFile encrypts r with a new data key and saves it to the storage backend under a new random
+// key. It returns the storage key and the data key wrapped with the master key, both of which need
+// to be kept on the files row, along with the content type sniffed from the start of r and its size
+// and checksum.
+func (app *application) storeFile(r io.Reader) (storedFile, error) {
+	storageKey, err := storage.NewKey()
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	dataKey, err := envelope.NewDataKey()
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	wrappedKey, err := app.masterKey.Wrap(dataKey)
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	// Peek doesn't lose anything, a short read here just means a small file and any real error
+	// comes back again when the rest is read.
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	contentType := sniffType(head)
+
+	digest := &digestWriter{Hash: sha256.New()}
+
+	encrypted, err := envelope.NewEncryptReader(io.TeeReader(br, digest), dataKey)
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	if err = app.storage.Put(storageKey, encrypted); err != nil {
+		return storedFile{}, err
+	}
+
+	return storedFile{
+		StorageKey:  storageKey,
+		WrappedKey:  wrappedKey,
+		ContentType: contentType,
+		Size:        digest.n,
+		Checksum:    hex.EncodeToString(digest.Sum(nil)),
+	}, nil
+}
+
+// quarantinePrefix is where infected files are moved to in the storage backend.
+const quarantinePrefix = "quarantine/"
+
+// storeScannedFile is storeFile for uploads, the content goes through the virus scanner on its way
+// to the storage backend so it's only read once. Infected content is moved to quarantine and the
+// returned file has Rejected set to what was found. If the scan can't be done the upload fails, it's
+// not stored without one. Without a scanner it's the same as storeFile.
+func (app *application) storeScannedFile(r io.Reader) (storedFile, error) {
+	if app.scanner == nil {
+		return app.storeFile(r)
+	}
+
+	type scan struct {
+		result scanner.Result
+		err    error
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan scan, 1)
+
+	go func() {
+		result, err := app.scanner.Scan(pr)
+		// The scanner may stop reading early when it gives up, storing carries on regardless
+		_, _ = io.Copy(io.Discard, pr)
+		done <- scan{result, err}
+	}()
+
+	stored, err := app.storeFile(io.TeeReader(r, pw))
+	pw.CloseWithError(err)
+	s := <-done
+
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	if s.err != nil {
+		app.removeStored(stored.StorageKey)
+		return storedFile{}, fmt.Errorf("scanning upload: %w", s.err)
+	}
+
+	if s.result.Infected() {
+		key, err := app.quarantine(stored.StorageKey)
+		if err != nil {
+			app.removeStored(stored.StorageKey)
+			return storedFile{}, err
+		}
+
+		stored.StorageKey = key
+		stored.Rejected = s.result.Signature
+	}
+
+	return stored, nil
+}
+
+// quarantine moves stored content under quarantinePrefix, where nothing serves it from, and returns
+// its new key. It's still encrypted so it can be looked at later if need be.
+func (app *application) quarantine(key string) (string, error) {
+	f, err := app.storage.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	quarantined := quarantinePrefix + key
+	if err = app.storage.Put(quarantined, f); err != nil {
+		return "", err
+	}
+
+	app.removeStored(key)
+
+	return quarantined, nil
+}
+
+// removeStored deletes stored content, failing to is only logged.
+func (app *application) removeStored(key string) {
+	if err := app.storage.Delete(key); err != nil {
+		app.logger.Info("Error removing file", "key", key, "error", err)
+	}
+}
+
+// digestWriter hashes what's written to it and counts how much there was.
+type digestWriter struct {
+	hash.Hash
+	n int64
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	return d.Hash.Write(p)
+}
+
+// errCorrupt is what reading a stored file back gives when it isn't what was uploaded.
+var errCorrupt = errors.New("stored file doesn't match its checksum")
+
+// verifyingReader checks a stored file against the size and checksum it was uploaded with as it's
+// read. Only a read of the whole thing from the start can be checked, so seeking anywhere but the
+// start (for a Range request, say) turns the check off. When the content doesn't match, the read
+// that gets to the end fails with errCorrupt instead of returning the last of it, so whatever is
+// sending the file cuts it short rather than pass off a corrupt copy as the real thing. Files with
+// no checksum aren't checked.
+type verifyingReader struct {
+	r        io.Reader
+	size     int64
+	checksum string
+	hash     hash.Hash
+	n        int64
+	checking bool
+	corrupt  bool
+}
+
+func newVerifyingReader(r io.Reader, size int64, checksum string) *verifyingReader {
+	return &verifyingReader{r: r, size: size, checksum: checksum, hash: sha256.New(), checking: checksum != ""}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if !v.checking {
+		return n, err
+	}
+
+	v.hash.Write(p[:n])
+	v.n += int64(n)
+
+	if v.n >= v.size || errors.Is(err, io.EOF) {
+		v.checking = false
+		if v.n != v.size || hex.EncodeToString(v.hash.Sum(nil)) != v.checksum {
+			v.corrupt = true
+			return 0, errCorrupt
+		}
+	}
+
+	return n, err
+}
+
+// Seek is for http.ServeContent, the reader has to be an io.Seeker to use it.
+func (v *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := v.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("verifyingReader: can't seek")
+	}
+
+	pos, err := seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	v.hash.Reset()
+	v.n = 0
+	v.checking = v.checksum != "" && pos == 0
+
+	return pos, nil
+}
+
+// setDigest sets the headers that give the SHA-256 of a download, hex encoded as checksum, for the
+// client to check it got the whole thing intact. Repr-Digest is the current standard (RFC 9530) and
+// Digest the older one (RFC 3230) that some clients still look for. Neither is set without a
+// checksum.
+func setDigest(h http.Header, checksum string) {
+	sum, err := hex.DecodeString(checksum)
+	if err != nil || len(sum) != sha256.Size {
+		return
+	}
+
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	h.Set("Repr-Digest", "sha-256=:"+b64+":")
+	h.Set("Digest", "SHA-256="+b64)
+}
+
+// sharedFile makes the files row for a stored upload called docName, the rest of the fields are
+// filled in by shareFiles.
+func (s storedFile) sharedFile(docName string) models.SharedFile {
+	return models.SharedFile{
+		DocName:     docName,
+		StorageKey:  s.StorageKey,
+		WrappedKey:  s.WrappedKey,
+		ContentType: fileContentType(docName, s.ContentType),
+		Size:        s.Size,
+		Checksum:    s.Checksum,
+		Rejected:    s.Rejected,
+	}
+}
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// machOMagics start Mach-O programs, 32 and 64 bit in both byte orders.
+var machOMagics = [][]byte{
+	{0xfe, 0xed, 0xfa, 0xce}, {0xfe, 0xed, 0xfa, 0xcf}, {0xce, 0xfa, 0xed, 0xfe}, {0xcf, 0xfa, 0xed, 0xfe},
+}
+
+// sniffType works out the type of a file from the magic bytes at the start of it, head, whatever
+// the name or the browser say. http.DetectContentType doesn't know programs, they're the main thing
+// an upload policy wants to catch, so those are checked for first.
+func sniffType(head []byte) string {
+	switch {
+	case isPE(head):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	}
+
+	for _, magic := range machOMagics {
+		if bytes.HasPrefix(head, magic) {
+			return "application/x-mach-binary"
+		}
+	}
+
+	return http.DetectContentType(head)
+}
+
+// isPE reports whether head is the start of a Windows program. They begin with MZ, which plenty of
+// other things might, so the PE header it points to has to be there as well.
+func isPE(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+
+	offset := int(binary.LittleEndian.Uint32(head[0x3c:]))
+
+	return offset >= 0x40 && offset+4 <= len(head) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// fileContentType picks the type to send a file as. Sniffing only knows a handful of formats, so
+// when it gives up the file name's extension gets a say.
+func fileContentType(docName, sniffed string) string {
+	if sniffed != "" && sniffed != "application/octet-stream" {
+		return sniffed
+	}
+
+	if byExt := mime.TypeByExtension(filepath.Ext(docName)); byExt != "" {
+		return byExt
+	}
+
+	return "application/octet-stream"
+}
+
+// contentDisposition builds an attachment Content-Disposition header for name as RFC 6266 describes,
+// a plain ASCII filename for old clients and the exact name UTF-8 encoded in filename* for the rest.
+func contentDisposition(name string) string {
+	var fallback, encoded strings.Builder
+
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b can go into an RFC 8187 ext-value without being percent encoded.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// openSharedFile opens the stored content of a file, decrypting it on the fly.
+func (app *application) openSharedFile(sharedF models.SharedFile) (io.ReadSeekCloser, storage.ObjectInfo, error) {
+	return app.openStored(sharedF.StorageKey, sharedF.WrappedKey)
+}
+
+// openStored opens something saved with storeFile, decrypting it on the fly. The returned info has
+// the size of the decrypted content. Files uploaded before encryption at rest have no wrapped key
+// and are read as they are.
+func (app *application) openStored(storageKey string, wrappedKey []byte) (io.ReadSeekCloser, storage.ObjectInfo, error) {
+	info, err := app.storage.Stat(storageKey)
+	if err != nil {
+		return nil, storage.ObjectInfo{}, err
+	}
+
+	f, err := app.storage.Open(storageKey)
+	if err != nil {
+		return nil, storage.ObjectInfo{}, err
+	}
+
+	if len(wrappedKey) == 0 {
+		return f, info, nil
+	}
+
+	dataKey, err := app.masterKey.Unwrap(wrappedKey)
+	if err != nil {
+		f.Close()
+		return nil, storage.ObjectInfo{}, err
+	}
+
+	decrypted, err := envelope.NewDecryptReader(f, info.Size, dataKey)
+	if err != nil {
+		f.Close()
+		return nil, storage.ObjectInfo{}, err
+	}
+
+	info.Size = envelope.PlaintextSize(info.Size)
+
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{decrypted, f}, info, nil
+}
+
+// RandPasswordGen get a random string of alphanum characters based on int length, it comes from
+// crypto/rand as it is used for passwords nobody is ever told
+func (app *application) RandPasswordGen(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyz" +
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
 	b := make([]byte, length)
 	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			panic(err)
+		}
+		b[i] = charset[n.Int64()]
 	}
 	return string(b)
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+)
+
+func TestStoreAndOpenFile(t *testing.T) {
+	app := newTestApplication(t)
+
+	content := strings.Repeat("secret document ", 10000)
+
+	stored, err := app.storeFile(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What ends up in storage must not be the plaintext.
+	raw, err := app.storage.Open(stored.StorageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(raw)
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, bytes.Contains(sealed, []byte("secret document")), false)
+	assert.Equal(t, stored.ContentType, "text/plain; charset=utf-8")
+
+	f, info, err := app.openSharedFile(models.SharedFile{StorageKey: stored.StorageKey, WrappedKey: stored.WrappedKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	assert.Equal(t, info.Size, int64(len(content)))
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(got), content)
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name     string
+		docName  string
+		wantHead string
+	}{
+		{
+			name:     "Plain",
+			docName:  "report.pdf",
+			wantHead: `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`,
+		},
+		{
+			name:     "Spaces",
+			docName:  "Big Important Document.docx",
+			wantHead: `attachment; filename="Big Important Document.docx"; filename*=UTF-8''Big%20Important%20Document.docx`,
+		},
+		{
+			name:     "Quotes",
+			docName:  `say "hi"\.txt`,
+			wantHead: `attachment; filename="say _hi__.txt"; filename*=UTF-8''say%20%22hi%22%5C.txt`,
+		},
+		{
+			name:     "Unicode",
+			docName:  "résumé €.txt",
+			wantHead: `attachment; filename="r_sum_ _.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9%20%E2%82%AC.txt`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, contentDisposition(tt.docName), tt.wantHead)
+		})
+	}
+}
+
+func TestFileContentType(t *testing.T) {
+	assert.Equal(t, fileContentType("a.pdf", "application/pdf"), "application/pdf")
+	assert.Equal(t, fileContentType("a.csv", "application/octet-stream"), "text/csv; charset=utf-8")
+	assert.Equal(t, fileContentType("a.unknown", ""), "application/octet-stream")
+}
+
+// windowsProgram is the start of a Windows program, the MZ header pointing to a PE header.
+func windowsProgram() string {
+	head := make([]byte, 0x80)
+	copy(head, "MZ")
+	binary.LittleEndian.PutUint32(head[0x3c:], 0x40)
+	copy(head[0x40:], "PE\x00\x00")
+
+	return string(head)
+}
+
+func TestSniffType(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{name: "Windows Program", head: windowsProgram(), want: "application/x-msdownload"},
+		{name: "MZ Only", head: "MZ is just some text", want: "text/plain; charset=utf-8"},
+		{name: "Linux Program", head: "\x7fELF\x02\x01\x01", want: "application/x-executable"},
+		{name: "Mac Program", head: "\xcf\xfa\xed\xfe\x07\x00\x00\x01", want: "application/x-mach-binary"},
+		{name: "Shell Script", head: "#!/bin/sh\nrm -rf ~\n", want: "text/x-shellscript"},
+		{name: "PDF", head: "%PDF-1.7\n", want: "application/pdf"},
+		{name: "Text", head: "hello", want: "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, sniffType([]byte(tt.head)), tt.want)
+		})
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	const checksum = "7bb6f9f7a47a63e684925af3608c059edcc371eb81188c48c9714896fb1091fd"
+
+	tests := []struct {
+		name     string
+		content  string
+		size     int64
+		checksum string
+		wantErr  error
+	}{
+		{name: "Intact", content: "file contents", size: 13, checksum: checksum},
+		{name: "Changed", content: "file CONTENTS", size: 13, checksum: checksum, wantErr: errCorrupt},
+		{name: "Truncated", content: "file", size: 13, checksum: checksum, wantErr: errCorrupt},
+		{name: "Too Long", content: "file contents and more", size: 13, checksum: checksum, wantErr: errCorrupt},
+		{name: "No Checksum", content: "anything at all", size: 0, checksum: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVerifyingReader(strings.NewReader(tt.content), tt.size, tt.checksum)
+
+			_, err := io.Copy(io.Discard, v)
+			assert.Equal(t, err, tt.wantErr)
+			assert.Equal(t, v.corrupt, tt.wantErr != nil)
+		})
+	}
+
+	// Seeking away from the start, as for a Range request, stops the check.
+	v := newVerifyingReader(strings.NewReader("file CONTENTS"), 13, checksum)
+	if _, err := v.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(v)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(b), "CONTENTS")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
+	"fileshare/internal/storage"
+)
+
+// janitor removes expired files and resumable uploads every interval until ctx is cancelled.
+// Nothing else ever deletes them, the queries just stop returning them once they've expired. With
+// dryRun set it only logs what it would have removed.
+func (app *application) janitor(ctx context.Context, interval time.Duration, dryRun bool) {
+	app.logger.Info("janitor started", "interval", interval.String(), "dryRun", dryRun)
+
+	app.runEvery(ctx, interval, "janitor", func() error {
+		_, err := app.reapExpired(dryRun)
+		_, uploadsErr := app.reapUploads(dryRun)
+		return errors.Join(err, uploadsErr)
+	})
+}
+
+// runEvery runs job every interval until ctx is cancelled, failures are logged under name. It goes
+// once straight away so a server that was down for a while catches up on start.
+func (app *application) runEvery(ctx context.Context, interval time.Duration, name string, job func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job(); err != nil {
+			app.logger.Error(name+" failed", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			app.logger.Info(name + " stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reapExpired deletes every expired file and the stored content of all its versions, and returns the
+// files removed (or that would be with dryRun). A blob that is already gone counts as removed, one
+// that can't be deleted keeps its row so it's tried again next time.
+func (app *application) reapExpired(dryRun bool) ([]models.SharedFile, error) {
+	if dryRun {
+		expired, err := app.sharedFile.Expired()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range expired {
+			app.logger.Info("janitor would remove expired file", "id", f.Id, "name", f.DocName, "expired", f.Expires)
+		}
+
+		return expired, nil
+	}
+
+	removed, err := app.sharedFile.RemoveExpired(func(f models.SharedFile) error {
+		keys, err := app.storedKeys(f)
+		if err != nil {
+			app.logger.Error("janitor could not find file versions", "id", f.Id, "error", err.Error())
+			return err
+		}
+
+		for _, key := range keys {
+			err := app.storage.Delete(key)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				app.logger.Error("janitor could not remove stored file", "id", f.Id, "key", key, "error", err.Error())
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range removed {
+		app.logger.Info("janitor removed expired file", "id", f.Id, "name", f.DocName, "expired", f.Expires)
+	}
+
+	return removed, nil
+}
+
+// reapUploads deletes the resumable uploads that have expired and the parts they stored, and returns
+// the uploads removed (or that would be with dryRun). The parts go first, an upload with a part that
+// can't be deleted is kept so it's tried again next time.
+func (app *application) reapUploads(dryRun bool) ([]models.Upload, error) {
+	expired, err := app.uploads.Expired(uploadTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		for _, upload := range expired {
+			app.logger.Info("janitor would remove expired upload", "upload", upload.Id, "name", upload.DocName,
+				"started", upload.CreatedAt)
+		}
+
+		return expired, nil
+	}
+
+	var removed []models.Upload
+
+uploads:
+	for _, upload := range expired {
+		parts, err := app.uploads.Parts(upload.Id)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, part := range parts {
+			err := app.storage.Delete(part.StorageKey)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				app.logger.Error("janitor could not remove upload part", "upload", upload.Id, "key", part.StorageKey,
+					"error", err.Error())
+				continue uploads
+			}
+		}
+
+		if err := app.uploads.Remove(upload.Id); err != nil && !errors.Is(err, models.ErrNoRecord) {
+			return removed, err
+		}
+
+		app.logger.Info("janitor removed expired upload", "upload", upload.Id, "name", upload.DocName,
+			"started", upload.CreatedAt)
+
+		removed = append(removed, upload)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/storage"
+)
+
+// The mock's expired file is stored under this key, and the version it replaced under the other.
+const (
+	expiredKey        = "00000000000000000000000000000005"
+	expiredVersionKey = "00000000000000000000000000000004"
+)
+
+func TestReapExpired(t *testing.T) {
+	app := newTestApplication(t)
+
+	for _, key := range []string{expiredKey, expiredVersionKey} {
+		if err := app.storage.Put(key, strings.NewReader("old contents")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dry run only reports the file.
+	expired, err := app.reapExpired(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(expired), 1)
+
+	_, err = app.storage.Stat(expiredKey)
+	assert.Equal(t, err, nil)
+
+	removed, err := app.reapExpired(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(removed), 1)
+
+	// Every version goes with it.
+	for _, key := range []string{expiredKey, expiredVersionKey} {
+		_, err = app.storage.Stat(key)
+		assert.Equal(t, errors.Is(err, storage.ErrNotFound), true)
+	}
+
+	// A blob that's already gone doesn't stop the row going.
+	removed, err = app.reapExpired(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(removed), 1)
+}
+
+func TestExpiredFiles(t *testing.T) {
+	app := newTestApplication(t)
+
+	if err := app.storage.Put(expiredKey, strings.NewReader("old contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "alice@example.com", "pa$$word")
+
+	code, _, _ := ts.get(t, "/admin/expired")
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	ts.login(t, "admin@example.com", "pa$$word")
+
+	code, _, body := ts.get(t, "/admin/expired")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Old Document")
+
+	// Looking doesn't remove anything.
+	_, err := app.storage.Stat(expiredKey)
+	assert.Equal(t, err, nil)
+
+	form := url.Values{"csrf_token": {extractCSRFToken(t, body)}}
+
+	code, header, _ := ts.postForm(t, "/admin/expired", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/admin/expired")
+
+	_, err = app.storage.Stat(expiredKey)
+	assert.Equal(t, errors.Is(err, storage.ErrNotFound), true)
+
+	_, _, body = ts.get(t, "/admin/expired")
+	assert.StringContains(t, body, "Removed 1 expired files")
+}
+
+func TestReapUploads(t *testing.T) {
+	app := newTestApplication(t)
+
+	// One upload was given up on two days ago, the other is still going.
+	for _, upload := range []models.Upload{
+		{Id: "abandoned", Length: 100, CreatedAt: time.Now().Add(-48 * time.Hour)},
+		{Id: "current", Length: 100},
+	} {
+		if err := app.uploads.Insert(upload); err != nil {
+			t.Fatal(err)
+		}
+
+		key := upload.Id + "-part"
+		if err := app.storage.Put(key, strings.NewReader("part of the upload")); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.uploads.AddPart(upload.Id, models.UploadPart{Size: 50, StorageKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dry run only reports it.
+	expired, err := app.reapUploads(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(expired), 1)
+
+	_, err = app.uploads.Get("abandoned")
+	assert.Equal(t, err, nil)
+
+	removed, err := app.reapUploads(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(removed), 1)
+	assert.Equal(t, removed[0].Id, "abandoned")
+
+	_, err = app.uploads.Get("abandoned")
+	assert.Equal(t, errors.Is(err, models.ErrNoRecord), true)
+
+	_, err = app.storage.Stat("abandoned-part")
+	assert.Equal(t, errors.Is(err, storage.ErrNotFound), true)
+
+	// The one still going is left alone.
+	_, err = app.uploads.Get("current")
+	assert.Equal(t, err, nil)
+
+	_, err = app.storage.Stat("current-part")
+	assert.Equal(t, err, nil)
+}
@@ -1,39 +1,67 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
+	"errors"
 	"flag"
 	"html/template"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	//Internal
+	"fileshare/internal/envelope"
+	"fileshare/internal/ldapauth"
 	"fileshare/internal/models"
+	"fileshare/internal/scanner"
+	"fileshare/internal/storage"
 
 	//External
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-playground/form/v4"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 type application struct {
 	logger         *slog.Logger
 	sharedFile     models.SharedFileModelInterface
+	uploads        models.UploadModelInterface
 	users          models.UserModelInterface
+	loginTokens    models.LoginTokenModelInterface
+	passwordResets models.PasswordResetModelInterface
+	auditLog       models.AuditModelInterface
+	uploadPolicy   models.UploadPolicyModelInterface
+	twoFactor      models.TwoFactorModelInterface
+	securityPolicy models.SecurityPolicyModelInterface
+	passkeys       models.PasskeyModelInterface
+	webAuthn       *webauthn.WebAuthn
+	sso            *ssoProvider
 	templateCache  map[string]*template.Template
 	formDecoder    *form.Decoder
 	sessionManager *scs.SessionManager
 	config         models.ServerConfigInterface
+	storage        storage.Backend
+	masterKey      *envelope.MasterKey
+	scanner        scanner.Scanner
+	// tasks is the work still going on after a response has been sent, see background()
+	tasks sync.WaitGroup
 }
 
-// MaxUploadSize defines the largest file that can be uploaded in the system
-const MaxUploadSize = 2024 * 2024
+// multipartMemory is how much of a multipart form is kept in memory while it's parsed, the rest goes
+// to temporary files. How big an upload can be is up to the upload policy.
+const multipartMemory = 32 << 20
+
+// MaxResumableUploadSize defines the largest file that can be sent in chunks with a resumable upload
+const MaxResumableUploadSize = 20 << 30
 
 func main() {
 
@@ -43,14 +71,42 @@ func main() {
 	}))
 
 	//Get the DB Details from the .env file, !TODO: change to OS Vars in prod
-	dbPass, dbUser, dbName, err := readFileEnvs(".env")
+	env, err := readFileEnvs(".env")
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
+	dbPass := getVariable(env, "DB_PASSWORD")
+	dbUser := getVariable(env, "DB_USERNAME")
+	dbName := getVariable(env, "DB_DATABASE")
+
 	addr := flag.String("addr", ":4000", "HTTP network address")
 	dsn := flag.String("dsn", dbUser+":"+dbPass+"@/"+dbName+"?parseTime=true", "MySQL data source name")
+	storageKind := flag.String("storage", "local", "Where uploaded files are kept (local|s3)")
+	uploadDir := flag.String("upload-dir", "./uploads", "Directory for uploaded files when -storage=local")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 compatible endpoint URL, e.g. http://localhost:9000")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket for uploaded files when -storage=s3")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 region used for request signing")
+	janitorInterval := flag.Duration("janitor-interval", time.Hour, "How often expired files are removed, 0 turns it off")
+	janitorDryRun := flag.Bool("janitor-dry-run", false, "Only log the expired files the janitor would remove")
+	reminderDays := flag.Int("reminder-days", 2, "Remind recipients this many days before an undownloaded file expires, 0 turns it off")
+	reminderInterval := flag.Duration("reminder-interval", time.Hour, "How often to look for reminders to send")
+	origin := flag.String("origin", "https://localhost:4000", "URL people reach the site at, passkeys only work there")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect provider staff sign in with, e.g. https://login.example.com/realms/staff, blank turns single sign-on off")
+	oidcClientID := flag.String("oidc-client-id", "", "Client ID registered with the OpenID Connect provider")
+	oidcName := flag.String("oidc-name", "Company Account", "What the login page calls the OpenID Connect provider")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", "groups", "ID token claim listing the groups a user is in")
+	oidcAdminGroup := flag.String("oidc-admin-group", "", "Group that makes staff admins, blank leaves admins to be made here")
+	oidcAllowUnverified := flag.Bool("oidc-allow-unverified-email", false, "Trust emails the provider doesn't send email_verified for, e.g. Entra ID, only if people can't choose their own")
+	ldapURL := flag.String("ldap-url", "", "LDAP or Active Directory server staff sign in with, e.g. ldaps://dc1.example.com, blank turns it off")
+	ldapStartTLS := flag.Bool("ldap-start-tls", false, "Upgrade an ldap:// connection with StartTLS")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "Service account users are looked up as, blank looks them up anonymously")
+	ldapBaseDN := flag.String("ldap-base-dn", "", "Where in the directory to look for users, e.g. dc=example,dc=com")
+	ldapUserFilter := flag.String("ldap-user-filter", "(&(objectClass=person)(mail=%s))", "Filter that finds a user, %s is their email")
+	ldapAdminGroup := flag.String("ldap-admin-group", "", "DN of the group that makes someone an admin")
+	ldapUserGroup := flag.String("ldap-user-group", "", "DN of the group that makes someone a user, blank lets in everyone the filter finds")
+	clamdAddr := flag.String("clamd", "", "clamd to scan uploads with, e.g. tcp://localhost:3310 or unix:///run/clamav/clamd.ctl, blank turns scanning off")
 
 	flag.Parse()
 
@@ -62,6 +118,113 @@ func main() {
 
 	defer db.Close()
 
+	var fileStorage storage.Backend
+
+	switch *storageKind {
+	case "local":
+		fileStorage = &storage.LocalBackend{Dir: *uploadDir}
+	case "s3":
+		if *s3Endpoint == "" || *s3Bucket == "" {
+			logger.Error("-s3-endpoint and -s3-bucket are required when -storage=s3")
+			os.Exit(1)
+		}
+		//Downloads are streamed straight from the bucket, so only waiting for S3 to answer is limited
+		//on the client, how long the body takes to read isn't
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = time.Minute
+
+		fileStorage = &storage.S3Backend{
+			Endpoint:  *s3Endpoint,
+			Bucket:    *s3Bucket,
+			Region:    *s3Region,
+			AccessKey: getVariable(env, "S3_ACCESS_KEY"),
+			SecretKey: getVariable(env, "S3_SECRET_KEY"),
+			Timeout:   time.Minute,
+			Client:    &http.Client{Transport: transport},
+		}
+	default:
+		logger.Error("unknown storage backend", "storage", *storageKind)
+		os.Exit(1)
+	}
+
+	//Uploaded files are encrypted with per-file keys that are wrapped with this one
+	masterKey, err := envelope.ParseMasterKey(getVariable(env, "MASTER_KEY"))
+	if err != nil {
+		logger.Error("MASTER_KEY in the .env file must be 64 hex characters", "error", err.Error())
+		os.Exit(1)
+	}
+
+	//Uploads are only scanned when there's a clamd to do it
+	var virusScanner scanner.Scanner
+
+	if *clamdAddr != "" {
+		clamd, err := scanner.NewClamd(*clamdAddr)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		// clamd can take a while to load its signatures, uploads fail until it's ready
+		if err := clamd.Ping(); err != nil {
+			logger.Warn("clamd isn't answering yet, uploads will fail until it is", "clamd", *clamdAddr,
+				"error", err.Error())
+		}
+
+		virusScanner = clamd
+	}
+
+	webAuthn, err := newWebAuthn(*origin)
+	if err != nil {
+		logger.Error("-origin must be the URL of the site, e.g. https://files.example.com", "error", err.Error())
+		os.Exit(1)
+	}
+
+	//Staff sign in with the company's identity provider when there is one, the client secret is
+	//kept in the .env file with the other secrets
+	var sso *ssoProvider
+
+	if *oidcIssuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		sso, err = newSSOProvider(ctx, ssoConfig{
+			Issuer:               *oidcIssuer,
+			ClientID:             *oidcClientID,
+			ClientSecret:         getVariable(env, "OIDC_CLIENT_SECRET"),
+			RedirectURL:          strings.TrimSuffix(*origin, "/") + "/user/sso/callback",
+			Name:                 *oidcName,
+			GroupsClaim:          *oidcGroupsClaim,
+			AdminGroup:           *oidcAdminGroup,
+			AllowUnverifiedEmail: *oidcAllowUnverified,
+		})
+		cancel()
+		if err != nil {
+			logger.Error("couldn't discover the OpenID Connect provider", "issuer", *oidcIssuer, "error", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	//Passwords are checked with the directory first when there is one, the service account password
+	//is kept in the .env file
+	var authenticators []models.Authenticator
+
+	if *ldapURL != "" {
+		directory, err := ldapauth.New(ldapauth.Config{
+			URL:          *ldapURL,
+			StartTLS:     *ldapStartTLS,
+			BindDN:       *ldapBindDN,
+			BindPassword: getVariable(env, "LDAP_BIND_PASSWORD"),
+			BaseDN:       *ldapBaseDN,
+			UserFilter:   *ldapUserFilter,
+			AdminGroup:   *ldapAdminGroup,
+			UserGroup:    *ldapUserGroup,
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		authenticators = append(authenticators, directory)
+	}
+
 	templateCache, err := newTemplateCache()
 	if err != nil {
 		logger.Error(err.Error())
@@ -79,11 +242,33 @@ func main() {
 	app := &application{
 		logger:         logger,
 		sharedFile:     &models.SharedFileModel{DB: db},
-		users:          &models.UserModel{DB: db},
+		uploads:        &models.UploadModel{DB: db},
+		users:          &models.UserModel{DB: db, Authenticators: authenticators},
+		loginTokens:    &models.LoginTokenModel{DB: db},
+		passwordResets: &models.PasswordResetModel{DB: db},
+		auditLog:       &models.AuditModel{DB: db},
+		uploadPolicy:   &models.UploadPolicyModel{DB: db},
+		twoFactor:      &models.TwoFactorModel{DB: db},
+		securityPolicy: &models.SecurityPolicyModel{DB: db},
+		passkeys:       &models.PasskeyModel{DB: db},
+		webAuthn:       webAuthn,
+		sso:            sso,
 		templateCache:  templateCache,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
 		config:         &models.ServerConfigModel{DB: db},
+		storage:        fileStorage,
+		masterKey:      masterKey,
+		scanner:        virusScanner,
+	}
+
+	//Admin commands (e.g. `go run ./cmd/web rotate-keys -new-key=...`) run instead of the server
+	if flag.NArg() > 0 {
+		if err := app.runCommand(flag.Args()); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		return
 	}
 
 	tlsConfig := &tls.Config{
@@ -110,11 +295,56 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 	}
 
-	logger.Info("starting server", "addr", srv.Addr)
+	//Stop cleanly on Ctrl-C or when docker stops the container
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+
+	if *janitorInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.janitor(ctx, *janitorInterval, *janitorDryRun)
+		}()
+	}
+
+	if *reminderDays > 0 && *reminderInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.reminders(ctx, *reminderInterval, time.Duration(*reminderDays)*24*time.Hour)
+		}()
+	}
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		logger.Info("starting server", "addr", srv.Addr)
+		serveErr <- srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
+	}()
+
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		logger.Info("shutting down server")
 
-	err = srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
-	logger.Error(err.Error())
-	os.Exit(1)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		err = srv.Shutdown(shutdownCtx)
+	}
+
+	stop()
+	wg.Wait()
+	app.tasks.Wait()
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	logger.Info("server stopped")
 }
 
 // openDB open the db and check if the tables exist, if not run first setup.
@@ -132,26 +362,16 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-// readFileEnvs pull the database details from the .ENV file that we are using for Docker init
-func readFileEnvs(fileName string) (dbPass, dbUser, dbName string, err error) {
-
-	file, err := os.Open(fileName)
-	if err != nil {
-		return "", "", "", err
-	}
+// readFileEnvs read the .ENV file that we are using for Docker init, values are pulled out of it
+// with getVariable
+func readFileEnvs(fileName string) (string, error) {
 
-	data, err := io.ReadAll(file)
+	data, err := os.ReadFile(fileName)
 	if err != nil {
-		return "", "", "", err
+		return "", err
 	}
 
-	text := string(data)
-
-	dbName = getVariable(text, "DB_DATABASE")
-	dbPass = getVariable(text, "DB_PASSWORD")
-	dbUser = getVariable(text, "DB_USERNAME")
-
-	return dbPass, dbUser, dbName, nil
+	return string(data), nil
 }
 
 // getVariable get the variables from the ENV file, right now we are assuming they look like this:
@@ -163,9 +383,10 @@ func getVariable(text, key string) string {
 	lines := strings.Split(text, "\n")
 
 	for _, line := range lines {
-		if strings.Contains(line, key) {
-			// Split the line into key-value pairs
-			parts := strings.Split(line, "=")
+		if strings.HasPrefix(strings.TrimSpace(line), key+"=") {
+			// Split the line into key-value pairs, only on the first '=' so
+			// values are allowed to contain one
+			parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
 
 			// Get the value of the variable
 			return parts[1]
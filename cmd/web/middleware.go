@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
 
 	//External
 	"github.com/justinas/nosurf"
@@ -45,6 +51,12 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 			// Use the builtin recover function to check if there has been a
 			// panic or not. If there has...
 			if err := recover(); err != nil {
+				// Handlers panic with http.ErrAbortHandler to cut a response off part way
+				// through, that one is left for the server to deal with.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				// Set a "Connection: close" header on the response.
 				w.Header().Set("Connection", "close")
 				// Call the app.serverError helper method to return a 500
@@ -87,6 +99,28 @@ func (app *application) requireAdmin(next http.Handler) http.Handler {
 			return
 		}
 
+		// Admins signed in from before two-factor was required, or that had it reset, have to set it
+		// up before they can do anything else as an admin. A passkey is two factors already.
+		user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserID"))
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		enrolled, required, err := app.twoFactorStatus(user)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		passkey := app.sessionManager.GetString(r.Context(), "authenticatedMethod") == "passkey"
+
+		if required && !enrolled && !passkey {
+			app.sessionManager.Put(r.Context(), "flash", "Admins have to set up two-factor sign in before they can carry on")
+			http.Redirect(w, r, "/user/2fa/setup", http.StatusSeeOther)
+			return
+		}
+
 		// Otherwise set the "Cache-Control: no-store" header so that pages
 		// require authentication are not stored in the users browser cache (or
 		// other intermediary cache).
@@ -97,6 +131,116 @@ func (app *application) requireAdmin(next http.Handler) http.Handler {
 	})
 }
 
+// requireFileAccess loads the file named by the {token} path value and checks the current user is
+// allowed to act on it with the given policy (e.g. models.SharedFile.CanView). The file is put in
+// the request context so the handlers don't have to look it up again. Users that aren't allowed
+// get the same 404 as a file that doesn't exist, so links can't be probed.
+func (app *application) requireFileAccess(allowed func(models.SharedFile, string, bool) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sharedF, err := app.sharedFile.Get(r.PathValue("token"))
+			if err != nil {
+				if errors.Is(err, models.ErrNoRecord) {
+					http.NotFound(w, r)
+				} else {
+					app.serverError(w, r, err)
+				}
+				return
+			}
+
+			email := app.sessionManager.GetString(r.Context(), "authenticatedUserEmail")
+			if !allowed(sharedF, email, app.isAdmin(r)) {
+				http.NotFound(w, r)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), sharedFileContextKey, sharedF)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requireShareAccess loads the share named by the {token} path value and puts the files in it that
+// the current user can view in the request context. Like requireFileAccess a share the user can't see
+// any of gets a 404.
+func (app *application) requireShareAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files, err := app.sharedFile.GetShare(r.PathValue("token"))
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				http.NotFound(w, r)
+			} else {
+				app.serverError(w, r, err)
+			}
+			return
+		}
+
+		files = app.viewableFiles(r, files)
+		if len(files) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), shareContextKey, files)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// multipartOverhead is room in a request body for the form fields that aren't files and the
+// boundaries between them.
+const multipartOverhead = 1 << 20
+
+// formUploadTimeout replaces the server's ReadTimeout and WriteTimeout for a form that uploads files,
+// there's as long as this to send them and for them to be stored.
+const formUploadTimeout = time.Hour
+
+// limitUpload caps the request body at files files of the biggest size the current user can upload,
+// and puts the upload policy in the request context for the handler to check the files against.
+// It has to come before noSurf, which reads the whole form looking for the CSRF token, so it's also
+// where the form gets longer to arrive in. A body that says up front it's too big isn't read at all,
+// the user is sent back to the form to try again.
+func (app *application) limitUpload(files int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, err := app.uploadPolicy.Get()
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+
+			// A limit so big the cap would overflow is as good as none
+			limit := policy.MaxSize(app.isAdmin(r), app.isUser(r))
+			if limit > 0 && limit <= (math.MaxInt64-multipartOverhead)/int64(files) {
+				maxBody := limit*int64(files) + multipartOverhead
+
+				if r.ContentLength > maxBody {
+					app.sessionManager.Put(r.Context(), "flash",
+						fmt.Sprintf("That's too much to upload, files can be at most %s", humanSize(limit)))
+					http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+					return
+				}
+
+				r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+			}
+
+			// The whole form is read before anything else happens, which takes longer than the
+			// server's ReadTimeout allows for anything but a small file
+			rc := http.NewResponseController(w)
+			if err := rc.SetReadDeadline(time.Now().Add(formUploadTimeout)); err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			if err := rc.SetWriteDeadline(time.Now().Add(formUploadTimeout)); err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), uploadPolicyContextKey, policy)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 func noSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
 	csrfHandler.SetBaseCookie(http.Cookie{
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
+)
+
+// reminders emails recipients about files they haven't downloaded that expire within the given time,
+// checking every interval until ctx is cancelled. Each recipient is only reminded once per file.
+func (app *application) reminders(ctx context.Context, interval, within time.Duration) {
+	app.logger.Info("reminders started", "interval", interval.String(), "within", within.String())
+
+	app.runEvery(ctx, interval, "reminders", func() error {
+		_, err := app.sendReminders(within)
+		return err
+	})
+}
+
+// sendReminders sends the reminders that are due and returns how many went. Guests get a new magic
+// link, the one sent with the file may well have been used or run out, see recipientLink.
+func (app *application) sendReminders(within time.Duration) (int, error) {
+	n, err := app.sharedFile.RemindRecipients(within, func(recipient models.Recipient, files []models.SharedFile) error {
+		user, err := app.users.GetByEmail(recipient.Email)
+		if err != nil {
+			return err
+		}
+
+		path := "/files/view/" + files[0].Token
+		if len(files) > 1 {
+			path = "/shares/view/" + files[0].ShareToken
+		}
+
+		link, err := app.recipientLink(user, path)
+		if err != nil {
+			return err
+		}
+
+		docNames := make([]string, len(files))
+		for i, f := range files {
+			docNames[i] = f.DocName
+		}
+
+		return app.config.SendReminder(recipient.Name, recipient.Email, files[0].SenderName,
+			strings.Join(docNames, ", "), link, files[0].Expires)
+	})
+
+	if n > 0 {
+		app.logger.Info("Expiry reminders sent", "reminders", n)
+	}
+
+	return n, err
+}
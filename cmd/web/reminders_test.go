@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+	"fileshare/internal/models/mocks"
+)
+
+func TestSendReminders(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	n, err := app.sendReminders(48 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, n, 1)
+
+	// Nothing is sent twice.
+	n, err = app.sendReminders(48 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, n, 0)
+
+	// The reminder signs the recipient in and takes them to the share.
+	config := app.config.(*mocks.ServerConfigModel)
+	assert.Equal(t, len(config.Links), 1)
+
+	_, _, body := ts.get(t, config.Links[0])
+	form := url.Values{"csrf_token": {extractCSRFToken(t, body)}}
+
+	code, header, _ := ts.postForm(t, config.Links[0], form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/shares/view/"+mocks.ShareToken)
+}
+
+// staffUsers are the mock accounts with nobody a guest.
+type staffUsers struct {
+	*mocks.UserModel
+}
+
+func (m staffUsers) GetByEmail(email string) (models.User, error) {
+	user, err := m.UserModel.GetByEmail(email)
+	user.Guest = false
+	return user, err
+}
+
+func TestSendRemindersStaff(t *testing.T) {
+	app := newTestApplication(t)
+	app.users = staffUsers{&mocks.UserModel{}}
+
+	n, err := app.sendReminders(48 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, n, 1)
+
+	// Someone with an account of their own gets the share's page, not a link that signs them in.
+	config := app.config.(*mocks.ServerConfigModel)
+	assert.Equal(t, len(config.Links), 1)
+	assert.Equal(t, config.Links[0], "/shares/view/"+mocks.ShareToken)
+}
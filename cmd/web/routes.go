@@ -4,6 +4,9 @@ import (
 	"net/http"
 	"path/filepath"
 
+	//Internal
+	"fileshare/internal/models"
+
 	//External
 	"github.com/justinas/alice"
 )
@@ -29,15 +32,44 @@ func (app *application) routes() http.Handler {
 	//Make Alice Admin Only route
 	admin := dynamic.Append(app.requireAdmin)
 
+	//Make Alice routes for forms that upload files, the body is capped under the upload policy before
+	//noSurf reads it, so who's uploading has to be known first
+	uploader := func(files int) alice.Chain {
+		return alice.New(app.sessionManager.LoadAndSave, app.authenticate, app.limitUpload(files), noSurf,
+			app.requireAuthentication)
+	}
+
 	//Default route
 	mux.Handle("GET /{$}", dynamic.ThenFunc(app.home))
 
+	//Make Alice routes for a single file, only the sender, recipient and admins can see a file and
+	//only the sender and admins can delete it. Files and shares are named by a random token in
+	//their links, never by their ID, so the links can't be guessed
+	fileViewer := protected.Append(app.requireFileAccess(models.SharedFile.CanView))
+	fileOwner := protected.Append(app.requireFileAccess(models.SharedFile.CanDelete))
+
 	//Protected File Create/View Routes
-	mux.Handle("GET /files/view/{id}", dynamic.ThenFunc(app.fileView))
+	mux.Handle("GET /files/view/{token}", fileViewer.ThenFunc(app.fileView))
 	mux.Handle("GET /files/create", protected.ThenFunc(app.fileCreate))
-	mux.Handle("POST /files/create", protected.ThenFunc(app.fileCreatePost))
-	mux.Handle("GET /files/download/{file}", protected.ThenFunc(app.fileDownload))
-	mux.Handle("GET /files/delete/{id}", protected.ThenFunc(app.fileDelete))
+	mux.Handle("POST /files/create", uploader(maxShareFiles).ThenFunc(app.fileCreatePost))
+	mux.Handle("GET /files/download/{token}", fileViewer.ThenFunc(app.fileDownload))
+	mux.Handle("GET /files/download/{token}/{version}", fileViewer.ThenFunc(app.fileDownloadVersion))
+	mux.Handle("GET /files/delete/{token}", fileOwner.ThenFunc(app.fileDelete))
+	mux.Handle("POST /files/extend/{token}", fileOwner.ThenFunc(app.fileExtend))
+	mux.Handle("GET /files/edit/{token}", fileOwner.ThenFunc(app.fileEdit))
+	mux.Handle("POST /files/edit/{token}", uploader(1).Append(app.requireFileAccess(models.SharedFile.CanDelete)).
+		ThenFunc(app.fileEditPost))
+
+	//Files uploaded together, viewed and downloaded as one
+	shareViewer := protected.Append(app.requireShareAccess)
+	mux.Handle("GET /shares/view/{token}", shareViewer.ThenFunc(app.shareView))
+	mux.Handle("GET /shares/download/{token}", shareViewer.ThenFunc(app.shareDownload))
+
+	//Resumable (chunked) uploads for big files
+	mux.Handle("POST /files/uploads", protected.ThenFunc(app.uploadCreate))
+	mux.Handle("HEAD /files/uploads/{id}", protected.ThenFunc(app.uploadStatus))
+	mux.Handle("PATCH /files/uploads/{id}", protected.ThenFunc(app.uploadPatch))
+	mux.Handle("DELETE /files/uploads/{id}", protected.ThenFunc(app.uploadDelete))
 
 	//Protected User Routes
 	mux.Handle("GET /users/", admin.ThenFunc(app.getAllUsers))
@@ -46,6 +78,7 @@ func (app *application) routes() http.Handler {
 	mux.Handle("POST /user/delete/{id}", protected.ThenFunc(app.deleteUser))
 	mux.Handle("GET /user/update/", protected.ThenFunc(app.updateUser))
 	mux.Handle("POST /user/update/", protected.ThenFunc(app.updateUserPost))
+	mux.Handle("POST /user/notifications", protected.ThenFunc(app.notificationsPost))
 
 	//User Sign-up/Login/Logout
 	mux.Handle("GET /user/signup", dynamic.ThenFunc(app.userSignup))
@@ -54,6 +87,58 @@ func (app *application) routes() http.Handler {
 	mux.Handle("POST /user/login", dynamic.ThenFunc(app.userLoginPost))
 	mux.Handle("POST /user/logout", dynamic.ThenFunc(app.userLogoutPost))
 
+	//Magic links emailed to recipients, and asking for a new one
+	mux.Handle("GET /user/magic/{token}", dynamic.ThenFunc(app.magicLink))
+	mux.Handle("POST /user/magic/{token}", dynamic.ThenFunc(app.magicLinkPost))
+	mux.Handle("POST /user/login/link", dynamic.ThenFunc(app.loginLinkPost))
+
+	//Resetting a forgotten password with a link that's emailed
+	mux.Handle("GET /user/password/forgot", dynamic.ThenFunc(app.passwordForgot))
+	mux.Handle("POST /user/password/forgot", dynamic.ThenFunc(app.passwordForgotPost))
+	mux.Handle("GET /user/password/reset/{token}", dynamic.ThenFunc(app.passwordReset))
+	mux.Handle("POST /user/password/reset/{token}", dynamic.ThenFunc(app.passwordResetPost))
+
+	//Two-factor sign in, the code asked for after the password and setting it up. Admins that have
+	//to set it up do so part way through signing in, so setup isn't only for those signed in
+	mux.Handle("GET /user/login/2fa", dynamic.ThenFunc(app.twoFactorLogin))
+	mux.Handle("POST /user/login/2fa", dynamic.ThenFunc(app.twoFactorLoginPost))
+	mux.Handle("GET /user/2fa/setup", dynamic.ThenFunc(app.twoFactorSetup))
+	mux.Handle("POST /user/2fa/setup", dynamic.ThenFunc(app.twoFactorSetupPost))
+	mux.Handle("GET /user/2fa/qr", dynamic.ThenFunc(app.twoFactorQR))
+	mux.Handle("GET /user/2fa", protected.ThenFunc(app.twoFactorSettings))
+	mux.Handle("POST /user/2fa/disable", protected.ThenFunc(app.twoFactorDisablePost))
+	mux.Handle("POST /user/2fa/recovery", protected.ThenFunc(app.twoFactorRecoveryPost))
+	mux.Handle("POST /user/2fa/reset/{id}", admin.ThenFunc(app.twoFactorResetPost))
+
+	//Passkeys, signing in with one and adding and removing them. The ceremonies are driven by
+	//JavaScript that posts JSON
+	mux.Handle("POST /user/passkey/login", dynamic.ThenFunc(app.passkeyLoginBegin))
+	mux.Handle("POST /user/passkey/login/finish", dynamic.ThenFunc(app.passkeyLoginFinish))
+	mux.Handle("GET /user/passkeys", protected.ThenFunc(app.passkeyList))
+	mux.Handle("POST /user/passkeys/register", protected.ThenFunc(app.passkeyRegisterBegin))
+	mux.Handle("POST /user/passkeys/register/finish", protected.ThenFunc(app.passkeyRegisterFinish))
+	mux.Handle("POST /user/passkeys/delete/{id}", protected.ThenFunc(app.passkeyDeletePost))
+
+	//Single sign-on for staff through the company's identity provider
+	mux.Handle("GET /user/sso", dynamic.ThenFunc(app.ssoLogin))
+	mux.Handle("GET /user/sso/callback", dynamic.ThenFunc(app.ssoCallback))
+
+	//What the janitor would remove, and running it now
+	mux.Handle("GET /admin/expired", admin.ThenFunc(app.expiredFiles))
+	mux.Handle("POST /admin/expired", admin.ThenFunc(app.expiredFilesPost))
+
+	//Who did what
+	mux.Handle("GET /admin/audit", admin.ThenFunc(app.auditLogView))
+	mux.Handle("GET /admin/audit.csv", admin.ThenFunc(app.auditLogCSV))
+
+	//What can be uploaded and how big
+	mux.Handle("GET /admin/policy", admin.ThenFunc(app.uploadPolicyView))
+	mux.Handle("POST /admin/policy", admin.ThenFunc(app.uploadPolicyPost))
+
+	//How people have to sign in
+	mux.Handle("GET /admin/security", admin.ThenFunc(app.securityPolicyView))
+	mux.Handle("POST /admin/security", admin.ThenFunc(app.securityPolicyPost))
+
 	standard := alice.New(app.recoverPanic, app.logRequest, commonHeaders)
 	return standard.Then(mux)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"io/fs"
 	"path/filepath"
@@ -15,8 +16,18 @@ type templateData struct {
 	CurrentYear     int
 	SharedFile      models.SharedFile
 	SharedFiles     []models.SharedFile
+	FileVersions    []models.FileVersion
+	ShareToken      string
+	CanManage       bool
 	User            models.User
 	Users           []models.User
+	AuditEvents     []models.AuditEvent
+	TwoFactor       models.TwoFactor
+	TOTPSecret      string
+	RecoveryCodes   []string
+	Next            string
+	Passkeys        []models.Passkey
+	SSOName         string
 	Form            any
 	Flash           string
 	IsAuthenticated bool
@@ -36,8 +47,30 @@ func humanDate(t time.Time) string {
 	return t.UTC().Format("02 Jan 2006 at 15:04")
 }
 
+// humanSize formats a number of bytes the way people usually write file sizes, blank for a size that
+// isn't known.
+func humanSize(n int64) string {
+	if n <= 0 {
+		return ""
+	}
+
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 var functions = template.FuncMap{
 	"humanDate": humanDate,
+	"humanSize": humanSize,
 }
 
 func newTemplateCache() (map[string]*template.Template, error) {
@@ -41,3 +41,23 @@ func TestHumanDate(t *testing.T) {
 		})
 	}
 }
+
+func TestHumanSize(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int64
+		want string
+	}{
+		{name: "Unknown", n: 0, want: ""},
+		{name: "Bytes", n: 1023, want: "1023 B"},
+		{name: "Kilobytes", n: 1536, want: "1.5 KiB"},
+		{name: "Megabytes", n: 5 << 20, want: "5.0 MiB"},
+		{name: "Gigabytes", n: 3 << 30, want: "3.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, humanSize(tt.n), tt.want)
+		})
+	}
+}
@@ -10,11 +10,15 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	//Internal
+	"fileshare/internal/envelope"
 	"fileshare/internal/models/mocks"
+	"fileshare/internal/scanner"
+	"fileshare/internal/storage"
 
 	//External
 	"github.com/alexedwards/scs/v2"
@@ -28,6 +32,18 @@ func newTestApplication(t *testing.T) *application {
 		t.Fatal(err)
 	}
 
+	// Passkeys for the site the fake authenticator in the passkey tests signs for.
+	webAuthn, err := newWebAuthn(testOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A throwaway master key for encrypting uploads.
+	masterKey, err := envelope.ParseMasterKey(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// And a form decoder.
 	formDecoder := form.NewDecoder()
 
@@ -43,9 +59,21 @@ func newTestApplication(t *testing.T) *application {
 		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
 		sharedFile:     &mocks.SharedFileModel{}, // Use the mock.
 		users:          &mocks.UserModel{},       // Use the mock.
+		loginTokens:    &mocks.LoginTokenModel{},
+		passwordResets: &mocks.PasswordResetModel{},
+		auditLog:       &mocks.AuditModel{},
+		uploadPolicy:   &mocks.UploadPolicyModel{},
+		twoFactor:      &mocks.TwoFactorModel{},
+		securityPolicy: &mocks.SecurityPolicyModel{},
+		passkeys:       &mocks.PasskeyModel{},
+		webAuthn:       webAuthn,
+		uploads:        &mocks.UploadModel{},
 		templateCache:  templateCache,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
+		config:         &mocks.ServerConfigModel{},
+		storage:        &storage.LocalBackend{Dir: t.TempDir()},
+		masterKey:      masterKey,
 	}
 
 }
@@ -56,8 +84,17 @@ type testServer struct {
 }
 
 func newTestServer(t *testing.T, h http.Handler) *testServer {
+	return newTimeoutTestServer(t, h, 0)
+}
+
+// newTimeoutTestServer is a test server with a ReadTimeout and WriteTimeout like the real one has,
+// only set to timeout, for the handlers that have to give themselves longer. 0 means none.
+func newTimeoutTestServer(t *testing.T, h http.Handler, timeout time.Duration) *testServer {
 	// Initialize the test server as normal.
-	ts := httptest.NewTLSServer(h)
+	ts := httptest.NewUnstartedServer(h)
+	ts.Config.ReadTimeout = timeout
+	ts.Config.WriteTimeout = timeout
+	ts.StartTLS()
 
 	// Initialize a new cookie jar.
 	jar, err := cookiejar.New(nil)
@@ -100,7 +137,7 @@ func (ts *testServer) get(t *testing.T, urlPath string) (int, http.Header, strin
 	return rs.StatusCode, rs.Header, string(body)
 }
 
-var csrfTokenRX = regexp.MustCompile(`<input type='hidden' name='csrf_token' value='(.+)'>`)
+var csrfTokenRX = regexp.MustCompile(`<input type=['"]hidden['"] name=['"]csrf_token['"] value=['"](.+?)['"]`)
 
 func extractCSRFToken(t *testing.T, body string) string {
 	// Use the FindStringSubmatch method to extract the token from the HTML body.
@@ -116,7 +153,17 @@ func extractCSRFToken(t *testing.T, body string) string {
 }
 
 func (ts *testServer) postForm(t *testing.T, urlPath string, form url.Values) (int, http.Header, string) {
-	rs, err := ts.Client().PostForm(ts.URL+urlPath, form)
+	req, err := http.NewRequest(http.MethodPost, ts.URL+urlPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// nosurf checks that unsafe requests come from our own origin, a browser
+	// would send this header for us.
+	req.Header.Set("Origin", ts.URL)
+
+	rs, err := ts.Client().Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,3 +179,107 @@ func (ts *testServer) postForm(t *testing.T, urlPath string, form url.Values) (i
 	// Return the response status, headers and body.
 	return rs.StatusCode, rs.Header, string(body)
 }
+
+// login signs the test server client in as the given mock user, the session
+// cookie is kept in the client's cookie jar for the following requests.
+func (ts *testServer) login(t *testing.T, email, password string) {
+	_, _, body := ts.get(t, "/user/login")
+
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("password", password)
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, _, _ := ts.postForm(t, "/user/login", form)
+	if code != http.StatusSeeOther {
+		t.Fatalf("login as %s failed with status %d", email, code)
+	}
+}
+
+// request sends any kind of request with the given headers and body, the Origin
+// header is set the same way a browser would.
+func (ts *testServer) request(t *testing.T, method, urlPath string, header http.Header, body io.Reader) (int, http.Header, string) {
+	req, err := http.NewRequest(method, ts.URL+urlPath, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Origin", ts.URL)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Body.Close()
+	resBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, string(bytes.TrimSpace(resBody))
+}
+
+// slowReader trickles r out a few bytes at a time like a slow connection, waiting delay before each.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p[:min(len(p), 64)])
+}
+
+// slowStorage is a storage backend that's slow to read from, like a busy bucket.
+type slowStorage struct {
+	storage.Backend
+	delay time.Duration
+}
+
+func (s *slowStorage) Open(key string) (io.ReadSeekCloser, error) {
+	f, err := s.Backend.Open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowFile{ReadSeekCloser: f, delay: s.delay}, nil
+}
+
+type slowFile struct {
+	io.ReadSeekCloser
+	delay time.Duration
+}
+
+func (f *slowFile) Read(p []byte) (int, error) {
+	return (&slowReader{r: f.ReadSeekCloser, delay: f.delay}).Read(p)
+}
+
+// eicar is the standard antivirus test file.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// testScanner stands in for clamd, it finds the EICAR test string and nothing else. With err set
+// every scan fails with it.
+type testScanner struct {
+	err error
+}
+
+func (s *testScanner) Scan(r io.Reader) (scanner.Result, error) {
+	if s.err != nil {
+		return scanner.Result{}, s.err
+	}
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return scanner.Result{}, err
+	}
+
+	if strings.Contains(string(content), eicar) {
+		return scanner.Result{Signature: "Eicar-Test-Signature"}, nil
+	}
+
+	return scanner.Result{}, nil
+}
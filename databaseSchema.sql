@@ -1,3 +1,27 @@
+create table audit_events
+(
+    Id         bigint auto_increment
+        primary key,
+    Action     varchar(32)  not null,
+    ActorId    int          null,
+    ActorEmail varchar(255) not null,
+    IP         varchar(45)  not null,
+    UserAgent  varchar(512) not null,
+    TargetType varchar(16)  not null,
+    Target     varchar(64)  not null,
+    Detail     text         not null,
+    CreatedAt  datetime     not null
+);
+
+create index audit_events_actor_idx
+    on audit_events (ActorEmail);
+
+create index audit_events_target_idx
+    on audit_events (Target);
+
+create index audit_events_created_idx
+    on audit_events (CreatedAt);
+
 create table config
 (
     mail_server   tinytext not null,
@@ -7,20 +31,132 @@ create table config
     server_name   tinytext not null
 );
 
+create table shares
+(
+    Id        int auto_increment
+        primary key,
+    Token     char(43) not null,
+    CreatedAt datetime not null,
+    constraint shares_uc_token
+        unique (Token)
+);
+
 create table files
 (
     Id             int auto_increment
         primary key,
+    ShareId        int      null,
+    Token          char(43) not null,
     DocName        text     not null,
+    StorageKey     varchar(255) not null,
+    WrappedKey     varbinary(128) null,
+    ContentType    varchar(255) not null default 'application/octet-stream',
+    Version        int      not null default 1,
+    Size           bigint   null,
+    Checksum       char(64) null,
     SenderName     text     not null,
     SenderEmail    text     not null,
-    RecipientName  text     not null,
-    RecipientEmail text     not null,
-    Password       char(60) not null,
-    CreatedAt      datetime not null on update CURRENT_TIMESTAMP,
-    Expires        datetime not null
+    MaxDownloads   int      null,
+    Downloads      int      not null default 0,
+    Rejected       varchar(255) null,
+    CreatedAt      datetime not null,
+    Expires        datetime not null,
+    constraint files_uc_token
+        unique (Token),
+    constraint files_shares_fk
+        foreign key (ShareId) references shares (Id)
+            on delete set null
+);
+
+create table file_versions
+(
+    FileId      int            not null,
+    Version     int            not null,
+    DocName     text           not null,
+    StorageKey  varchar(255)   not null,
+    WrappedKey  varbinary(128) null,
+    ContentType varchar(255)   not null default 'application/octet-stream',
+    Size        bigint         null,
+    Checksum    char(64)       null,
+    UploadedAt  datetime       not null,
+    primary key (FileId, Version),
+    constraint file_versions_files_fk
+        foreign key (FileId) references files (Id)
+            on delete cascade
 );
 
+create table file_recipients
+(
+    FileId       int          not null,
+    Name         text         not null,
+    Email        varchar(255) not null,
+    Downloads    int          not null default 0,
+    DownloadedAt datetime     null,
+    RemindedAt   datetime     null,
+    primary key (FileId, Email),
+    constraint file_recipients_files_fk
+        foreign key (FileId) references files (Id)
+            on delete cascade
+);
+
+create index file_recipients_email_idx
+    on file_recipients (Email);
+
+create table upload_policy
+(
+    id                 tinyint      not null
+        primary key,
+    allowed_extensions text         not null,
+    blocked_extensions text         not null,
+    allowed_types      text         not null,
+    blocked_types      text         not null,
+    guest_max_size     bigint       not null,
+    user_max_size      bigint       not null,
+    admin_max_size     bigint       not null
+);
+
+create table uploads
+(
+    Id             char(32)     not null
+        primary key,
+    UserId         int          not null,
+    UploadLength   bigint       not null,
+    UploadOffset   bigint       not null,
+    DocName        text         not null,
+    SenderName     text         not null,
+    SenderEmail    text         not null,
+    RecipientName  text         not null,
+    RecipientEmail text         not null,
+    MaxDownloads   int          not null default 0,
+    Expires        int          not null,
+    CreatedAt      datetime     not null
+);
+
+create table upload_parts
+(
+    UploadId   char(32)       not null,
+    PartOffset bigint         not null,
+    Size       bigint         not null,
+    StorageKey varchar(255)   not null,
+    WrappedKey varbinary(128) not null,
+    primary key (UploadId, PartOffset),
+    constraint upload_parts_uploads_fk
+        foreign key (UploadId) references uploads (Id)
+            on delete cascade
+);
+
+create table login_tokens
+(
+    TokenHash binary(32)   not null
+        primary key,
+    UserId    int          not null,
+    Path      varchar(255) not null,
+    Expires   datetime     not null
+);
+
+create index login_tokens_expires_idx
+    on login_tokens (Expires);
+
 create table sessions
 (
     token  char(43)     not null
@@ -34,17 +170,78 @@ create index sessions_expiry_idx
 
 create table users
 (
-    id              int auto_increment
+    id               int auto_increment
         primary key,
-    name            varchar(255)         not null,
-    email           varchar(255)         not null,
-    hashed_password char(60)             not null,
-    created         datetime             not null,
-    admin           tinyint(1) default 0 not null,
-    user            tinyint(1)           not null,
-    guest           tinyint(1)           not null,
-    disabled        tinyint(1)           not null,
+    name             varchar(255)         not null,
+    email            varchar(255)         not null,
+    hashed_password  char(60)             not null,
+    created          datetime             not null,
+    admin            tinyint(1) default 0 not null,
+    user             tinyint(1)           not null,
+    guest            tinyint(1)           not null,
+    disabled         tinyint(1)           not null,
+    notify_downloads tinyint(1) default 1 not null,
+    source           varchar(16) default '' not null,
     constraint users_uc_email
         unique (email)
 );
 
+create table two_factor
+(
+    UserId    int         not null
+        primary key,
+    Secret    varchar(64) not null,
+    LastStep  bigint      not null default 0,
+    CreatedAt datetime    not null,
+    constraint two_factor_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
+
+create table recovery_codes
+(
+    UserId   int        not null,
+    CodeHash binary(32) not null,
+    primary key (UserId, CodeHash),
+    constraint recovery_codes_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
+
+create table security_policy
+(
+    id                tinyint    not null
+        primary key,
+    require_admin_2fa tinyint(1) not null default 0
+);
+
+create table passkeys
+(
+    id           int auto_increment
+        primary key,
+    UserId       int             not null,
+    CredentialId varbinary(1023) not null,
+    Name         varchar(100)    not null,
+    Credential   json            not null,
+    CreatedAt    datetime        not null,
+    LastUsedAt   datetime        null,
+    constraint passkeys_uc_credential
+        unique (CredentialId),
+    constraint passkeys_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
+
+create table password_resets
+(
+    TokenHash binary(32) not null
+        primary key,
+    UserId    int        not null,
+    Expires   datetime   not null,
+    constraint password_resets_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
+
+create index password_resets_expires_idx
+    on password_resets (Expires);
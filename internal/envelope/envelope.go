@@ -0,0 +1,296 @@
+// Package envelope does the encryption at rest for uploaded files. Every file is
+// encrypted with its own random data key, and that data key is stored wrapped
+// (encrypted) with the master key from the server config. Rotating the master key
+// only means re-wrapping the data keys, the file contents are left alone.
+//
+// File contents are encrypted with AES-256-GCM in fixed size chunks so large files
+// never have to sit in memory, and so a reader can seek to any chunk to serve a
+// range request. Each chunk's nonce is its index plus a flag marking the final
+// chunk, which stops chunks being reordered, dropped or the file being truncated.
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// ChunkSize is the amount of plaintext sealed in each chunk.
+const ChunkSize = 64 << 10
+
+const (
+	keySize         = 32
+	tagSize         = 16
+	sealedChunkSize = ChunkSize + tagSize
+)
+
+var (
+	ErrInvalidKey = errors.New("envelope: keys must be 32 bytes")
+	ErrDecrypt    = errors.New("envelope: message authentication failed")
+)
+
+// MasterKey wraps and unwraps the per-file data keys.
+type MasterKey struct {
+	aead cipher.AEAD
+}
+
+// ParseMasterKey takes the hex encoded master key from the config, e.g. the output
+// of `openssl rand -hex 32`.
+func ParseMasterKey(hexKey string) (*MasterKey, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != keySize {
+		return nil, ErrInvalidKey
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MasterKey{aead: aead}, nil
+}
+
+// Wrap encrypts a data key, the random nonce is stored in front of it.
+func (k *MasterKey) Wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(dataKey)+tagSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return k.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (k *MasterKey) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < k.aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	nonce, sealed := wrapped[:k.aead.NonceSize()], wrapped[k.aead.NonceSize():]
+
+	dataKey, err := k.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return dataKey, nil
+}
+
+// NewDataKey returns a fresh random key for a single file.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// PlaintextSize works out the size of the original file from the size of its
+// encrypted form.
+func PlaintextSize(size int64) int64 {
+	return size - chunkCount(size)*tagSize
+}
+
+func chunkCount(size int64) int64 {
+	return (size + sealedChunkSize - 1) / sealedChunkSize
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+type encryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	index int64
+	plain []byte
+	out   []byte
+	buf   []byte
+	done  bool
+}
+
+// NewEncryptReader returns a reader of the encrypted form of everything read
+// from r.
+func NewEncryptReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		src:   bufio.NewReader(r),
+		aead:  aead,
+		plain: make([]byte, ChunkSize),
+		out:   make([]byte, 0, sealedChunkSize),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+
+	return n, nil
+}
+
+// seal reads and encrypts the next chunk. A chunk is the last one when the source
+// runs dry filling it, or there's nothing left to read after it.
+func (e *encryptReader) seal() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	last := err != nil
+	if !last {
+		if _, err := e.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	e.buf = e.aead.Seal(e.out[:0], chunkNonce(e.index, last), e.plain[:n], nil)
+	e.index++
+	e.done = last
+
+	return nil
+}
+
+type decryptReader struct {
+	src        io.ReadSeeker
+	aead       cipher.AEAD
+	sealedSize int64
+	size       int64
+	chunks     int64
+	offset     int64
+	index      int64
+	chunk      []byte
+	sealed     []byte
+}
+
+// NewDecryptReader returns a reader of the plaintext of src, which holds size
+// bytes of encrypted data. Seeking only decrypts the chunk that is read next.
+func NewDecryptReader(src io.ReadSeeker, size int64, dataKey []byte) (io.ReadSeeker, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < tagSize {
+		return nil, ErrDecrypt
+	}
+
+	return &decryptReader{
+		src:        src,
+		aead:       aead,
+		sealedSize: size,
+		size:       PlaintextSize(size),
+		chunks:     chunkCount(size),
+		index:      -1,
+		sealed:     make([]byte, sealedChunkSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		// An empty file is still one sealed chunk that needs checking.
+		if d.size == 0 && d.index < 0 {
+			if err := d.open(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+
+	index := d.offset / ChunkSize
+	if index != d.index {
+		if err := d.open(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.chunk[d.offset-index*ChunkSize:])
+	d.offset += int64(n)
+
+	return n, nil
+}
+
+func (d *decryptReader) open(index int64) error {
+	start := index * sealedChunkSize
+	length := min(int64(sealedChunkSize), d.sealedSize-start)
+
+	if _, err := d.src.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(d.src, d.sealed[:length]); err != nil {
+		return err
+	}
+
+	chunk, err := d.aead.Open(d.chunk[:0], chunkNonce(index, index == d.chunks-1), d.sealed[:length], nil)
+	if err != nil {
+		d.index = -1
+		return ErrDecrypt
+	}
+
+	d.chunk = chunk
+	d.index = index
+
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = d.offset + offset
+	case io.SeekEnd:
+		abs = d.size + offset
+	default:
+		return 0, errors.New("envelope: invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("envelope: negative position")
+	}
+
+	d.offset = abs
+	return abs, nil
+}
@@ -0,0 +1,140 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+)
+
+func encrypt(t *testing.T, plain, dataKey []byte) []byte {
+	t.Helper()
+
+	r, err := NewEncryptReader(bytes.NewReader(plain), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "Empty", size: 0},
+		{name: "One Byte", size: 1},
+		{name: "One Chunk", size: ChunkSize},
+		{name: "Chunk Plus One", size: ChunkSize + 1},
+		{name: "Several Chunks", size: 3*ChunkSize + 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataKey, err := NewDataKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plain := make([]byte, tt.size)
+			rand.Read(plain)
+
+			sealed := encrypt(t, plain, dataKey)
+			assert.Equal(t, PlaintextSize(int64(len(sealed))), int64(tt.size))
+
+			d, err := NewDecryptReader(bytes.NewReader(sealed), int64(len(sealed)), dataKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, bytes.Equal(got, plain), true)
+
+			// Seek somewhere in the middle, like a range request would.
+			if tt.size > 2 {
+				offset := int64(tt.size / 2)
+				if _, err := d.Seek(offset, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+
+				got, err = io.ReadAll(d)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, bytes.Equal(got, plain[offset:]), true)
+			}
+		})
+	}
+}
+
+func TestTampering(t *testing.T) {
+	dataKey, _ := NewDataKey()
+	plain := bytes.Repeat([]byte("a"), 2*ChunkSize+10)
+	sealed := encrypt(t, plain, dataKey)
+
+	tests := []struct {
+		name   string
+		sealed []byte
+	}{
+		{name: "Flipped Bit", sealed: append(append([]byte{}, sealed[:10]...), append([]byte{sealed[10] ^ 1}, sealed[11:]...)...)},
+		{name: "Truncated", sealed: sealed[:2*(ChunkSize+tagSize)]},
+		{name: "Swapped Chunks", sealed: append(append(append([]byte{}, sealed[ChunkSize+tagSize:2*(ChunkSize+tagSize)]...),
+			sealed[:ChunkSize+tagSize]...), sealed[2*(ChunkSize+tagSize):]...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDecryptReader(bytes.NewReader(tt.sealed), int64(len(tt.sealed)), dataKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = io.ReadAll(d)
+			assert.Equal(t, errors.Is(err, ErrDecrypt), true)
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	master, err := ParseMasterKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ParseMasterKey("ff0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey, _ := NewDataKey()
+
+	wrapped, err := master.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := master.Unwrap(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, bytes.Equal(got, dataKey), true)
+
+	_, err = other.Unwrap(wrapped)
+	assert.Equal(t, errors.Is(err, ErrDecrypt), true)
+
+	_, err = ParseMasterKey("too short")
+	assert.Equal(t, errors.Is(err, ErrInvalidKey), true)
+}
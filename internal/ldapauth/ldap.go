@@ -0,0 +1,201 @@
+package ldapauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
+
+	//External
+	"github.com/go-ldap/ldap/v3"
+)
+
+var ErrAmbiguousUser = errors.New("ldapauth: more than one entry matches the user filter")
+
+// Config is how to find people in the directory. The service account in BindDN looks the user up
+// by email under BaseDN with UserFilter, then their password is checked by binding as them.
+type Config struct {
+	// URL is the directory server, e.g. ldaps://dc1.example.com or ldap://dc1.example.com:389.
+	URL string
+	// StartTLS upgrades an ldap:// connection to TLS before anything is sent.
+	StartTLS bool
+	// BindDN and BindPassword are the service account searches are done as, blank searches
+	// anonymously.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the user, %s is replaced with their email, e.g.
+	// (&(objectClass=user)(mail=%s)).
+	UserFilter string
+	// AdminGroup and UserGroup are the DNs of the groups that make someone an Admin or a User here.
+	// Without a UserGroup everyone the filter finds is a User, someone in neither can't sign in.
+	AdminGroup string
+	UserGroup  string
+	// Timeout is how long to wait for the server, 10 seconds if it's 0.
+	Timeout time.Duration
+}
+
+// LDAP signs people in with their LDAP or Active Directory password.
+type LDAP struct {
+	config     Config
+	adminGroup *ldap.DN
+	userGroup  *ldap.DN
+}
+
+// New checks config and returns an LDAP authenticator for it, nothing is sent to the server until
+// someone signs in.
+func New(config Config) (*LDAP, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("ldapauth: %q should look like ldaps://host or ldap://host:port", config.URL)
+	}
+
+	if config.BaseDN == "" {
+		return nil, errors.New("ldapauth: a base DN is needed")
+	}
+
+	if strings.Count(config.UserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("ldapauth: the user filter %q should have one %%s for the email", config.UserFilter)
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	l := &LDAP{config: config}
+
+	if config.AdminGroup != "" {
+		if l.adminGroup, err = ldap.ParseDN(config.AdminGroup); err != nil {
+			return nil, fmt.Errorf("ldapauth: admin group: %w", err)
+		}
+	}
+
+	if config.UserGroup != "" {
+		if l.userGroup, err = ldap.ParseDN(config.UserGroup); err != nil {
+			return nil, fmt.Errorf("ldapauth: user group: %w", err)
+		}
+	}
+
+	return l, nil
+}
+
+// Authenticate looks the user up by email and checks their password. Someone the filter doesn't
+// find is ErrNoRecord, so they can still sign in with a password here.
+func (l *LDAP) Authenticate(email, password string) (models.Identity, error) {
+	// Most servers take a bind with no password as an anonymous one that always works.
+	if password == "" {
+		return models.Identity{}, models.ErrInvalidCredentials
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return models.Identity{}, err
+	}
+
+	defer conn.Close()
+
+	if l.config.BindDN != "" {
+		if err = conn.Bind(l.config.BindDN, l.config.BindPassword); err != nil {
+			return models.Identity{}, fmt.Errorf("ldapauth: service account bind: %w", err)
+		}
+	}
+
+	search := ldap.NewSearchRequest(l.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2,
+		int(l.config.Timeout/time.Second), false, fmt.Sprintf(l.config.UserFilter, ldap.EscapeFilter(email)),
+		[]string{"mail", "displayName", "cn", "memberOf"}, nil)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return models.Identity{}, ErrAmbiguousUser
+		}
+		return models.Identity{}, err
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return models.Identity{}, models.ErrNoRecord
+	case 1:
+	default:
+		return models.Identity{}, ErrAmbiguousUser
+	}
+
+	entry := result.Entries[0]
+
+	// Binding as them is what checks the password, disabled and locked accounts fail here too.
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return models.Identity{}, models.ErrInvalidCredentials
+		}
+		return models.Identity{}, err
+	}
+
+	identity := models.Identity{
+		Name:  entry.GetAttributeValue("displayName"),
+		Email: entry.GetAttributeValue("mail"),
+	}
+
+	if identity.Name == "" {
+		identity.Name = entry.GetAttributeValue("cn")
+	}
+
+	// The directory's spelling of the email is the one kept, it's what they'll be found by next time.
+	if identity.Email == "" {
+		identity.Email = email
+	}
+
+	groups := entry.GetAttributeValues("memberOf")
+
+	identity.Admin = memberOf(groups, l.adminGroup)
+	identity.User = l.userGroup == nil || memberOf(groups, l.userGroup)
+
+	if !identity.Admin && !identity.User {
+		return models.Identity{}, models.ErrInvalidCredentials
+	}
+
+	return identity, nil
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	u, _ := url.Parse(l.config.URL)
+
+	conn, err := ldap.DialURL(l.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: l.config.Timeout}),
+		ldap.DialWithTLSConfig(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(l.config.Timeout)
+
+	if l.config.StartTLS {
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// memberOf reports whether group is one of the DNs in groups. Only groups they're in directly
+// count, not groups in groups.
+func memberOf(groups []string, group *ldap.DN) bool {
+	if group == nil {
+		return false
+	}
+
+	for _, g := range groups {
+		dn, err := ldap.ParseDN(g)
+		if err == nil && dn.EqualFold(group) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,390 @@
+package ldapauth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+	"fileshare/internal/models"
+
+	//External
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeEntry is someone in the fake directory.
+type fakeEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+// fakeDirectory is just enough of an LDAP server to bind and search. Searches only see anything
+// once the service account has bound, like in Active Directory.
+type fakeDirectory struct {
+	listener net.Listener
+	entries  map[string]fakeEntry
+
+	mu      sync.Mutex
+	filters []string
+	binds   []string
+}
+
+const (
+	testBaseDN      = "dc=example,dc=com"
+	testServiceDN   = "cn=fileshare,ou=Services,dc=example,dc=com"
+	testServicePass = "svc-pa$$"
+	testAdminGroup  = "cn=FileShare Admins,ou=Groups,dc=example,dc=com"
+	testUserGroup   = "cn=Staff,ou=Groups,dc=example,dc=com"
+)
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	person := func(password, mail, name string, groups ...string) fakeEntry {
+		return fakeEntry{password: password, attributes: map[string][]string{
+			"objectClass": {"top", "person", "user"},
+			"mail":        {mail},
+			"displayName": {name},
+			"memberOf":    groups,
+		}}
+	}
+
+	d := &fakeDirectory{listener: l, entries: map[string]fakeEntry{
+		testServiceDN: {password: testServicePass, attributes: map[string][]string{"objectClass": {"top"}}},
+		"cn=Carol,ou=People,dc=example,dc=com": person("carol-pw", "Carol@example.com", "Carol Jones",
+			testUserGroup),
+		// Group names in memberOf aren't always spelt the same way as in the config.
+		"cn=Dave,ou=People,dc=example,dc=com": person("dave-pw", "dave@example.com", "Dave",
+			"CN=Staff,OU=Groups,DC=example,DC=com", "cn=fileshare admins,ou=groups,dc=example,dc=com"),
+		"cn=Erin,ou=People,dc=example,dc=com": person("erin-pw", "erin@example.com", "Erin",
+			"cn=Finance,ou=Groups,dc=example,dc=com"),
+		"cn=Twin A,ou=People,dc=example,dc=com": person("twin-pw", "twin@example.com", "Twin A", testUserGroup),
+		"cn=Twin B,ou=People,dc=example,dc=com": person("twin-pw", "twin@example.com", "Twin B", testUserGroup),
+	}}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+
+	return d
+}
+
+func (d *fakeDirectory) url() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var bound string
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			d.mu.Lock()
+			d.binds = append(d.binds, dn)
+			d.mu.Unlock()
+
+			code := ldap.LDAPResultInvalidCredentials
+			if entry, ok := d.entries[dn]; ok && password != "" && entry.password == password {
+				code = ldap.LDAPResultSuccess
+				bound = dn
+			}
+
+			d.reply(conn, id, ldap.ApplicationBindResponse, code)
+
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+
+			d.mu.Lock()
+			d.filters = append(d.filters, filter)
+			d.mu.Unlock()
+
+			base := strings.ToLower(op.Children[0].Value.(string))
+			sizeLimit := op.Children[3].Value.(int64)
+
+			var found []string
+			for dn, entry := range d.entries {
+				if bound == testServiceDN && strings.HasSuffix(strings.ToLower(dn), base) &&
+					matches(op.Children[6], entry) {
+					found = append(found, dn)
+				}
+			}
+
+			if sizeLimit > 0 && int64(len(found)) > sizeLimit {
+				found = found[:sizeLimit]
+			}
+
+			for _, dn := range found {
+				d.entry(conn, id, dn, d.entries[dn])
+			}
+
+			d.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		default:
+			return
+		}
+	}
+}
+
+// matches evaluates the and, or, not, equality and present parts of a search filter against entry,
+// which is all the authenticator uses.
+func matches(filter *ber.Packet, entry fakeEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, f := range filter.Children {
+			if !matches(f, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, f := range filter.Children {
+			if matches(f, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matches(filter.Children[0], entry)
+	case ldap.FilterEqualityMatch:
+		for _, v := range attribute(entry, filter.Children[0].Value.(string)) {
+			if strings.EqualFold(v, filter.Children[1].Value.(string)) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attribute(entry, filter.Data.String())) > 0
+	}
+
+	return false
+}
+
+// attribute is the values of name in entry, attribute names aren't case sensitive.
+func attribute(entry fakeEntry, name string) []string {
+	for k, v := range entry.attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (d *fakeDirectory) write(conn net.Conn, id int64, op *ber.Packet) {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	message.AppendChild(op)
+
+	conn.Write(message.Bytes())
+}
+
+func (d *fakeDirectory) reply(conn net.Conn, id int64, tag ber.Tag, code int) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+
+	d.write(conn, id, op)
+}
+
+func (d *fakeDirectory) entry(conn net.Conn, id int64, dn string, entry fakeEntry) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+
+	attributes := ber.NewSequence("Attributes")
+	for name, values := range entry.attributes {
+		attr := ber.NewSequence("Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+
+		attr.AppendChild(vals)
+		attributes.AppendChild(attr)
+	}
+	op.AppendChild(attributes)
+
+	d.write(conn, id, op)
+}
+
+func newTestLDAP(t *testing.T, url string) *LDAP {
+	l, err := New(Config{
+		URL:          url,
+		BindDN:       testServiceDN,
+		BindPassword: testServicePass,
+		BaseDN:       testBaseDN,
+		UserFilter:   "(&(objectClass=person)(mail=%s))",
+		AdminGroup:   testAdminGroup,
+		UserGroup:    testUserGroup,
+		Timeout:      time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestAuthenticate(t *testing.T) {
+	directory := newFakeDirectory(t)
+	l := newTestLDAP(t, directory.url())
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		want     models.Identity
+		wantErr  error
+	}{
+		{
+			name:     "Staff",
+			email:    "carol@example.com",
+			password: "carol-pw",
+			want:     models.Identity{Name: "Carol Jones", Email: "Carol@example.com", User: true},
+		},
+		{
+			name:     "Admin",
+			email:    "dave@example.com",
+			password: "dave-pw",
+			want:     models.Identity{Name: "Dave", Email: "dave@example.com", Admin: true, User: true},
+		},
+		{
+			name:     "Wrong password",
+			email:    "carol@example.com",
+			password: "dave-pw",
+			wantErr:  models.ErrInvalidCredentials,
+		},
+		{
+			name:     "No password",
+			email:    "carol@example.com",
+			password: "",
+			wantErr:  models.ErrInvalidCredentials,
+		},
+		{
+			name:     "Not in a group",
+			email:    "erin@example.com",
+			password: "erin-pw",
+			wantErr:  models.ErrInvalidCredentials,
+		},
+		{
+			name:     "Not in the directory",
+			email:    "guest@elsewhere.com",
+			password: "pa$$word",
+			wantErr:  models.ErrNoRecord,
+		},
+		{
+			name:     "Filter injection",
+			email:    "*)(mail=*",
+			password: "carol-pw",
+			wantErr:  models.ErrNoRecord,
+		},
+		{
+			name:     "Two entries",
+			email:    "twin@example.com",
+			password: "twin-pw",
+			wantErr:  ErrAmbiguousUser,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := l.Authenticate(tt.email, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			assert.Equal(t, identity, tt.want)
+		})
+	}
+
+	directory.mu.Lock()
+	defer directory.mu.Unlock()
+
+	// The email is escaped so it can't change what's searched for.
+	assert.Equal(t, directory.filters[len(directory.filters)-2], `(&(objectClass=person)(mail=\2a\29\28mail=\2a))`)
+
+	// Carol's password was only checked with the server for the right and wrong password, an empty
+	// one is never sent as the server could take it as an anonymous bind.
+	assert.Equal(t, strings.Count(strings.Join(directory.binds, "|"), "cn=Carol"), 2)
+}
+
+func TestAuthenticateServerProblems(t *testing.T) {
+	directory := newFakeDirectory(t)
+
+	// A wrong service account password isn't the user's fault.
+	l, err := New(Config{
+		URL:          directory.url(),
+		BindDN:       testServiceDN,
+		BindPassword: "wrong",
+		BaseDN:       testBaseDN,
+		UserFilter:   "(mail=%s)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = l.Authenticate("carol@example.com", "carol-pw")
+	if err == nil || errors.Is(err, models.ErrInvalidCredentials) || errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("got error %v; want a service account error", err)
+	}
+
+	// Nor is the server being down.
+	addr := directory.url()
+	directory.listener.Close()
+
+	_, err = newTestLDAP(t, addr).Authenticate("carol@example.com", "carol-pw")
+	if err == nil || errors.Is(err, models.ErrInvalidCredentials) || errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("got error %v; want a connection error", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"Not LDAP", Config{URL: "https://dc1.example.com", BaseDN: testBaseDN, UserFilter: "(mail=%s)"}},
+		{"No base DN", Config{URL: "ldaps://dc1.example.com", UserFilter: "(mail=%s)"}},
+		{"No %s", Config{URL: "ldaps://dc1.example.com", BaseDN: testBaseDN, UserFilter: "(mail=x)"}},
+		{"Bad group", Config{URL: "ldaps://dc1.example.com", BaseDN: testBaseDN, UserFilter: "(mail=%s)",
+			AdminGroup: "admins"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The things that get recorded in the audit log.
+const (
+	AuditUpload        = "upload"
+	AuditView          = "view"
+	AuditDownload      = "download"
+	AuditEdit          = "edit"
+	AuditDelete        = "delete"
+	AuditRejected      = "rejected"
+	AuditLogin         = "login"
+	AuditLoginFailed   = "login-failed"
+	AuditUserEdit      = "user-edit"
+	AuditUserDelete    = "user-delete"
+	AuditTwoFactor     = "two-factor"
+	AuditPasskey       = "passkey"
+	AuditPasswordReset = "password-reset"
+)
+
+// What an audit event was done to.
+const (
+	AuditTargetFile  = "file"
+	AuditTargetShare = "share"
+	AuditTargetUser  = "user"
+)
+
+type AuditModelInterface interface {
+	Insert(event AuditEvent) error
+	List(filter AuditFilter) ([]AuditEvent, error)
+}
+
+// AuditEvent is one thing someone did. The actor is whoever was signed in, or for a failed login
+// the email that was tried with ActorId 0. Target is the token of a file or share or the ID of a
+// user, Detail is something a person can read like the file name, as the target may be long gone
+// by the time anyone looks.
+type AuditEvent struct {
+	Id         int
+	Action     string
+	ActorId    int
+	ActorEmail string
+	IP         string
+	UserAgent  string
+	TargetType string
+	Target     string
+	Detail     string
+	CreatedAt  time.Time
+}
+
+// AuditFilter narrows down a List, blank fields match everything. From and To are inclusive
+// times, and Limit caps how many of the newest events come back, 0 for all of them.
+type AuditFilter struct {
+	Email  string
+	Target string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// AuditModel is the audit log, events are only ever added to it.
+type AuditModel struct {
+	DB *sql.DB
+}
+
+func (m *AuditModel) Insert(event AuditEvent) error {
+	stmt := `INSERT INTO audit_events (Action, ActorId, ActorEmail, IP, UserAgent, TargetType, Target, Detail,
+                          CreatedAt)
+VALUES (?, NULLIF(?, 0), ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())`
+
+	_, err := m.DB.Exec(stmt, event.Action, event.ActorId, event.ActorEmail, event.IP, event.UserAgent,
+		event.TargetType, event.Target, event.Detail)
+
+	return err
+}
+
+// List returns the events that match filter, newest first.
+func (m *AuditModel) List(filter AuditFilter) ([]AuditEvent, error) {
+	stmt := `SELECT Id, Action, IFNULL(ActorId, 0), ActorEmail, IP, UserAgent, TargetType, Target, Detail, CreatedAt
+       FROM audit_events WHERE 1 = 1`
+
+	var args []any
+
+	if filter.Email != "" {
+		stmt += ` AND ActorEmail = ?`
+		args = append(args, filter.Email)
+	}
+	if filter.Target != "" {
+		stmt += ` AND Target = ?`
+		args = append(args, filter.Target)
+	}
+	if !filter.From.IsZero() {
+		stmt += ` AND CreatedAt >= ?`
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		stmt += ` AND CreatedAt <= ?`
+		args = append(args, filter.To.UTC())
+	}
+
+	stmt += ` ORDER BY Id DESC`
+
+	if filter.Limit > 0 {
+		stmt += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var events []AuditEvent
+
+	for rows.Next() {
+		var e AuditEvent
+		err = rows.Scan(&e.Id, &e.Action, &e.ActorId, &e.ActorEmail, &e.IP, &e.UserAgent, &e.TargetType,
+			&e.Target, &e.Detail, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Authenticator checks a password somewhere other than the users table, like a company's Active
+// Directory. Authenticate returns who they are if the password is right, ErrInvalidCredentials if
+// it knows them and it isn't, and ErrNoRecord if it doesn't know them so the next one can be tried.
+type Authenticator interface {
+	Authenticate(email, password string) (Identity, error)
+}
+
+// Identity is who an Authenticator says signed in, and what they're allowed to be here.
+type Identity struct {
+	Name  string
+	Email string
+	Admin bool
+	User  bool
+}
+
+// AuthenticateChain tries each of the authenticators in turn, then local, which checks the password
+// in the users table. The first that knows the user decides, so someone in a directory can't get
+// in with an old password from before it was set up. Users from a directory are kept in users so
+// the rest of the app works off users.id like for everyone else, their roles follow the directory
+// each time they sign in. The directory only signs in to accounts it made, or that an admin has
+// linked to it, anyone else with an account for the same email gets ErrNotLinked.
+//
+// A directory that can't be reached doesn't stop guests signing in with their password here, the
+// error is only returned if that fails too. Accounts the directory manages never pass local, so
+// while it's down they're kept out rather than let in with an old password.
+func AuthenticateChain(users UserModelInterface, authenticators []Authenticator, email, password string,
+	local func(email, password string) (int, error)) (int, error) {
+	var directoryErr error
+
+	for _, a := range authenticators {
+		identity, err := a.Authenticate(email, password)
+		switch {
+		case err == nil:
+			return cacheIdentity(users, identity)
+		case errors.Is(err, ErrNoRecord):
+			continue
+		case errors.Is(err, ErrInvalidCredentials):
+			return 0, ErrInvalidCredentials
+		default:
+			directoryErr = errors.Join(directoryErr, err)
+		}
+	}
+
+	id, err := local(email, password)
+	if err != nil && directoryErr != nil {
+		return 0, directoryErr
+	}
+
+	return id, err
+}
+
+// cacheIdentity keeps the users row for identity up to date, making it the first time they sign in.
+// Someone disabled here stays disabled whatever the directory says. An account the directory doesn't
+// manage, a local admin or one single sign-on manages, isn't touched.
+func cacheIdentity(users UserModelInterface, identity Identity) (int, error) {
+	user, err := users.GetByEmail(identity.Email)
+	if errors.Is(err, ErrNoRecord) {
+		name := identity.Name
+		if name == "" {
+			name = identity.Email
+		}
+
+		// They always sign in through the directory, so the password here is random and never used.
+		err = users.Insert(name, identity.Email, rand.Text(), identity.Admin, identity.User, false, false)
+		if err != nil {
+			return 0, err
+		}
+
+		user, err = users.GetByEmail(identity.Email)
+		if err != nil {
+			return 0, err
+		}
+
+		if err = users.SetSource(user.ID, SourceLDAP); err != nil {
+			return 0, err
+		}
+		user.Source = SourceLDAP
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if user.Disabled {
+		return 0, ErrInvalidCredentials
+	}
+
+	if user.Source != SourceLDAP {
+		return 0, ErrNotLinked
+	}
+
+	if user.Admin != identity.Admin || user.User != identity.User || user.Guest {
+		if err = users.SetRoles(user.ID, identity.Admin, identity.User, false); err != nil {
+			return 0, err
+		}
+	}
+
+	return user.ID, nil
+}
@@ -5,11 +5,19 @@ import (
 	"errors"
 	"net/smtp"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type ServerConfigInterface interface {
 	GetConfig() (ServerConfig, error)
-	SendMail(rName, sName, rEmail, sEmail, fName, password string) error
+	SendMail(rName, sName, rEmail, sEmail, fName, linkPath string) error
+	SendLoginLink(name, email, linkPath string) error
+	SendPasswordReset(name, email, linkPath string) error
+	SendDownloadNotice(sName, sEmail, rName, rEmail, fName, linkPath string) error
+	SendReminder(rName, rEmail, sName, fName, linkPath string, expires time.Time) error
+	SendRejectedNotice(sName, sEmail, fName, signature string) error
 }
 
 type ServerConfig struct {
@@ -46,38 +54,124 @@ func (m *ServerConfigModel) GetConfig() (ServerConfig, error) {
 	return c, nil
 }
 
-func (m *ServerConfigModel) SendMail(rName, sName, rEmail, sEmail, fName, password string) error {
+// SendMail lets a recipient know a file has been shared with them. linkPath is the path of the file,
+// or for a guest a magic link that signs them in and takes them to it, it is made into a full link to
+// this server.
+func (m *ServerConfigModel) SendMail(rName, sName, rEmail, sEmail, fName, linkPath string) error {
+	s, err := m.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	body := rName + ", " + sName + " has shared " + fName + " with you.\r\n" +
+		"\r\n" +
+		"Follow this link to get it:\r\n" +
+		"https://" + s.serverName + linkPath + "\r\n"
 
+	return m.send(s, sEmail, rEmail, sName+" has sent you "+fName, body)
+}
+
+// SendLoginLink emails a magic link that signs someone in, linkPath is made into a full link to
+// this server.
+func (m *ServerConfigModel) SendLoginLink(name, email, linkPath string) error {
 	s, err := m.GetConfig()
 	if err != nil {
 		return err
 	}
-	server := s.mailServer + ":" + strconv.Itoa(s.mailPort)
-	auth := smtp.PlainAuth("", s.mailUsername, s.mailPassword, s.mailServer)
 
-	// Here we do it all: connect to our server, set up a message and send it
+	body := name + ", follow this link to sign in, it only works once:\r\n" +
+		"https://" + s.serverName + linkPath + "\r\n"
+
+	return m.send(s, s.mailUsername, email, "Your sign in link", body)
+}
+
+// SendPasswordReset emails a link to reset a forgotten password, linkPath is made into a full link to
+// this server.
+func (m *ServerConfigModel) SendPasswordReset(name, email, linkPath string) error {
+	s, err := m.GetConfig()
+	if err != nil {
+		return err
+	}
 
-	to := []string{rEmail}
+	body := name + ", someone asked to reset your password. Follow this link within the hour to choose\r\n" +
+		"a new one, it only works once:\r\n" +
+		"https://" + s.serverName + linkPath + "\r\n" +
+		"\r\n" +
+		"If it wasn't you, you can ignore this email and your password won't change.\r\n"
+
+	return m.send(s, s.mailUsername, email, "Reset your password", body)
+}
+
+// SendDownloadNotice lets a sender know one of their recipients has downloaded a file, linkPath is the
+// file's page.
+func (m *ServerConfigModel) SendDownloadNotice(sName, sEmail, rName, rEmail, fName, linkPath string) error {
+	s, err := m.GetConfig()
+	if err != nil {
+		return err
+	}
 
-	MsgFile := []byte("To: " + rEmail + "\r\n" +
-		"Subject: " + sName + " has sent you" + fName + "\r\n" +
+	body := sName + ", " + rName + " (" + rEmail + ") has downloaded " + fName + ".\r\n" +
 		"\r\n" +
-		rName + " go to webapp https://" + s.serverName + " for your file!\r\n")
+		"See who else has at:\r\n" +
+		"https://" + s.serverName + linkPath + "\r\n" +
+		"\r\n" +
+		"You can turn these emails off on your profile page.\r\n"
+
+	return m.send(s, s.mailUsername, sEmail, rName+" has downloaded "+fName, body)
+}
 
-	err = smtp.SendMail(server, auth, sEmail, to, MsgFile)
+// SendReminder reminds a recipient about a file they haven't downloaded before it expires, linkPath is
+// a link like the one SendMail sends.
+func (m *ServerConfigModel) SendReminder(rName, rEmail, sName, fName, linkPath string, expires time.Time) error {
+	s, err := m.GetConfig()
 	if err != nil {
 		return err
 	}
 
-	MsgPassword := []byte("To: " + rEmail + "\r\n" +
-		"Subject: " + sName + " has sent you" + fName + "\r\n" +
+	body := rName + ", " + sName + " sent you " + fName + " and it hasn't been downloaded yet.\r\n" +
 		"\r\n" +
-		rName + " here is your password " + password + "\r\n")
+		"It will be deleted on " + expires.UTC().Format("02 Jan 2006 at 15:04") + " UTC. Follow this link to get it:\r\n" +
+		"https://" + s.serverName + linkPath + "\r\n"
+
+	return m.send(s, s.mailUsername, rEmail, "Reminder: "+fName+" will be deleted soon", body)
+}
 
-	err = smtp.SendMail(server, auth, sEmail, to, MsgPassword)
+// SendRejectedNotice tells a sender that the virus scanner found signature in a file they uploaded,
+// so it wasn't sent to anyone.
+func (m *ServerConfigModel) SendRejectedNotice(sName, sEmail, fName, signature string) error {
+	s, err := m.GetConfig()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	body := sName + ", the virus scanner found " + signature + " in " + fName + ".\r\n" +
+		"\r\n" +
+		"It has been quarantined and was not sent to anyone. If you think this is a mistake\r\n" +
+		"please contact the administrator of https://" + s.serverName + ".\r\n"
+
+	return m.send(s, s.mailUsername, sEmail, fName+" was not sent", body)
+}
+
+func (m *ServerConfigModel) send(s ServerConfig, from, to, subject, body string) error {
+	server := s.mailServer + ":" + strconv.Itoa(s.mailPort)
+	auth := smtp.PlainAuth("", s.mailUsername, s.mailPassword, s.mailServer)
+
+	msg := []byte("To: " + headerValue(to) + "\r\n" +
+		"Subject: " + headerValue(subject) + "\r\n" +
+		"\r\n" +
+		body)
+
+	return smtp.SendMail(server, auth, from, []string{to}, msg)
+}
+
+// headerValue makes s safe to put in an email header, the names of files and people in subjects come
+// from users and a line break in one would start a header of their own. Control characters are
+// swapped for spaces.
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
 }
@@ -8,4 +8,9 @@ var (
 	ErrNoRecord           = errors.New("models: no matching record found")
 	ErrInvalidCredentials = errors.New("models: invalid credentials")
 	ErrDuplicateEmail     = errors.New("models: duplicate email")
+	ErrUploadOffset       = errors.New("models: upload offset mismatch")
+	ErrDownloadLimit      = errors.New("models: download limit reached")
+	ErrCodeUsed           = errors.New("models: two-factor code already used")
+	ErrDuplicatePasskey   = errors.New("models: duplicate passkey")
+	ErrNotLinked          = errors.New("models: account not linked to the directory")
 )
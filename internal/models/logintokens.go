@@ -0,0 +1,81 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type LoginTokenModelInterface interface {
+	Insert(userId int, path string, ttl time.Duration) (string, error)
+	Consume(token string) (userId int, path string, err error)
+}
+
+// LoginTokenModel keeps the tokens of magic links, which sign someone in without a password and take
+// them to path. Only a SHA-256 hash of each token is stored so the database can't be used to sign in,
+// and a token can only be used once.
+type LoginTokenModel struct {
+	DB *sql.DB
+}
+
+// Insert makes a new token for the user that lasts for ttl and returns it.
+func (m *LoginTokenModel) Insert(userId int, path string, ttl time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	stmt := `INSERT INTO login_tokens (TokenHash, UserId, Path, Expires)
+VALUES (?, ?, ?, DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+
+	if _, err = m.DB.Exec(stmt, hash[:], userId, path, int(ttl.Seconds())); err != nil {
+		return "", err
+	}
+
+	// Tidy up while we're here, nothing can use an expired token.
+	if _, err = m.DB.Exec(`DELETE FROM login_tokens WHERE Expires <= UTC_TIMESTAMP()`); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Consume uses up a token, returning who it signs in and where it takes them. A token that doesn't
+// exist, has expired or has been used already gives ErrNoRecord.
+func (m *LoginTokenModel) Consume(token string) (int, string, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer tx.Rollback()
+
+	var (
+		userId int
+		path   string
+	)
+
+	stmt := `SELECT UserId, Path FROM login_tokens WHERE TokenHash = ? AND Expires > UTC_TIMESTAMP() FOR UPDATE`
+
+	if err = tx.QueryRow(stmt, hash[:]).Scan(&userId, &path); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", ErrNoRecord
+		}
+		return 0, "", err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM login_tokens WHERE TokenHash = ?`, hash[:]); err != nil {
+		return 0, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, "", err
+	}
+
+	return userId, path, nil
+}
@@ -0,0 +1,53 @@
+package mocks
+
+import (
+	"sync"
+
+	"fileshare/internal/models"
+)
+
+// AuditModel keeps events in memory so tests can check what was recorded.
+type AuditModel struct {
+	mu     sync.Mutex
+	Events []models.AuditEvent
+}
+
+func (m *AuditModel) Insert(event models.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event.Id = len(m.Events) + 1
+	m.Events = append(m.Events, event)
+
+	return nil
+}
+
+// List only filters on email and target, the tests don't need dates.
+func (m *AuditModel) List(filter models.AuditFilter) ([]models.AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []models.AuditEvent
+
+	for i := len(m.Events) - 1; i >= 0; i-- {
+		e := m.Events[i]
+		if (filter.Email == "" || e.ActorEmail == filter.Email) && (filter.Target == "" || e.Target == filter.Target) {
+			events = append(events, e)
+		}
+	}
+
+	return events, nil
+}
+
+// Actions lists the actions recorded so far, oldest first.
+func (m *AuditModel) Actions() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	actions := make([]string, len(m.Events))
+	for i, e := range m.Events {
+		actions[i] = e.Action
+	}
+
+	return actions
+}
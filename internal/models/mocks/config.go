@@ -0,0 +1,48 @@
+package mocks
+
+import (
+	"time"
+
+	"fileshare/internal/models"
+)
+
+// ServerConfigModel doesn't send anything, it keeps the links it was asked to send so tests can
+// follow them, and the notices it was asked to send senders.
+type ServerConfigModel struct {
+	Links   []string
+	Notices []string
+}
+
+func (m *ServerConfigModel) GetConfig() (models.ServerConfig, error) {
+	return models.ServerConfig{}, nil
+}
+
+func (m *ServerConfigModel) SendMail(rName, sName, rEmail, sEmail, fName, linkPath string) error {
+	m.Links = append(m.Links, linkPath)
+	return nil
+}
+
+func (m *ServerConfigModel) SendLoginLink(name, email, linkPath string) error {
+	m.Links = append(m.Links, linkPath)
+	return nil
+}
+
+func (m *ServerConfigModel) SendPasswordReset(name, email, linkPath string) error {
+	m.Links = append(m.Links, linkPath)
+	return nil
+}
+
+func (m *ServerConfigModel) SendDownloadNotice(sName, sEmail, rName, rEmail, fName, linkPath string) error {
+	m.Notices = append(m.Notices, sEmail+": "+rEmail+" downloaded "+fName)
+	return nil
+}
+
+func (m *ServerConfigModel) SendRejectedNotice(sName, sEmail, fName, signature string) error {
+	m.Notices = append(m.Notices, sEmail+": "+fName+" rejected for "+signature)
+	return nil
+}
+
+func (m *ServerConfigModel) SendReminder(rName, rEmail, sName, fName, linkPath string, expires time.Time) error {
+	m.Links = append(m.Links, linkPath)
+	return nil
+}
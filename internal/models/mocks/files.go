@@ -1,39 +1,164 @@
 package mocks
 
 import (
+	"slices"
 	"time"
 
 	"fileshare/internal/models"
 )
 
+// Tokens of the mock files and their share for tests to use in URLs, NewToken is what Insert and
+// InsertShare hand back.
+const (
+	FileToken        = "DZqTdjnzogNOgsHwIWP6h0dK6MCkZ-vIAtEbrHQaSNA"
+	ShareFileToken   = "4ILcBvTCF_zCChpi4AQfJ4xvTOUKJtj957L9dND4BGw"
+	ShareToken       = "u3y942Tf5xc8uOqWO8IINuGVfFTruXLOEDUBZQMk1hw"
+	LimitedFileToken = "ofhQ2kFqdnSuEOuGeJj83QfXbWUUJ9rTim2YMC9NJSQ"
+	NewToken         = "2ygrgmCDmarsxouSY65i-5vaW_W3h5ASCMGWLNMZh6c"
+)
+
 var mockFile = models.SharedFile{
-	Id:             1,
-	DocName:        "Big Important Document",
-	SenderEmail:    "Abar@example.com",
-	SenderName:     "Cheryl Smith",
-	RecipientEmail: "foo@bar.com",
-	RecipientName:  "Susan Smith",
-	Password:       "password",
-	CreatedAt:      time.Now(),
-	Expires:        time.Now().Add(24 * time.Hour),
+	Id:          1,
+	Token:       FileToken,
+	ShareId:     1,
+	ShareToken:  ShareToken,
+	DocName:     "Big Important Document",
+	StorageKey:  "0123456789abcdef0123456789abcdef",
+	ContentType: "text/plain; charset=utf-8",
+	Version:     2,
+	Size:        13,
+	Checksum:    "7bb6f9f7a47a63e684925af3608c059edcc371eb81188c48c9714896fb1091fd",
+	SenderEmail: "Abar@example.com",
+	SenderName:  "Cheryl Smith",
+	Recipients: []models.Recipient{
+		{Name: "Susan Smith", Email: "foo@bar.com"},
+	},
+	CreatedAt: time.Now(),
+	Expires:   time.Now().Add(24 * time.Hour),
 }
 
-type SharedFileModel struct{}
+// mockFileVersions are the two uploads of mockFile, the draft was replaced by what's there now.
+var mockFileVersions = []models.FileVersion{
+	{
+		Version:     2,
+		DocName:     mockFile.DocName,
+		StorageKey:  mockFile.StorageKey,
+		ContentType: mockFile.ContentType,
+		Size:        mockFile.Size,
+		Checksum:    mockFile.Checksum,
+		UploadedAt:  mockFile.CreatedAt,
+	},
+	{
+		Version:     1,
+		DocName:     "Draft Document.txt",
+		StorageKey:  "11111111111111111111111111111111",
+		ContentType: mockFile.ContentType,
+		Size:        14,
+		Checksum:    "5f26f4490e0380380ff36f1a56076163597ddf52cad6549da9800feef0deaa34",
+		UploadedAt:  mockFile.CreatedAt.Add(-time.Hour),
+	},
+}
 
-func (m *SharedFileModel) Insert(docName, senderUserName, senderEmail, recipientUserName, recipientEmail,
-	password string, expiresAt int) (int, error) {
-	return 2, nil
+// mockShareFile was uploaded along with mockFile.
+var mockShareFile = models.SharedFile{
+	Id:          3,
+	Token:       ShareFileToken,
+	ShareId:     1,
+	ShareToken:  ShareToken,
+	DocName:     "Appendix.txt",
+	StorageKey:  "fedcba9876543210fedcba9876543210",
+	ContentType: "text/plain; charset=utf-8",
+	SenderEmail: mockFile.SenderEmail,
+	SenderName:  mockFile.SenderName,
+	Recipients:  mockFile.Recipients,
+	CreatedAt:   mockFile.CreatedAt,
+	Expires:     mockFile.Expires,
 }
 
-func (m *SharedFileModel) Get(id int) (models.SharedFile, error) {
-	switch id {
-	case 1:
+// mockLimitedFile can only be downloaded once.
+var mockLimitedFile = models.SharedFile{
+	Id:           6,
+	Token:        LimitedFileToken,
+	DocName:      "Burn After Reading",
+	StorageKey:   "66666666666666666666666666666666",
+	ContentType:  "text/plain; charset=utf-8",
+	SenderEmail:  mockFile.SenderEmail,
+	SenderName:   mockFile.SenderName,
+	Recipients:   mockFile.Recipients,
+	MaxDownloads: 1,
+	CreatedAt:    mockFile.CreatedAt,
+	Expires:      mockFile.Expires,
+}
+
+// mockExpiredFile has expired but hasn't been removed yet.
+var mockExpiredFile = models.SharedFile{
+	Id:          5,
+	Token:       "x9Xk1bQ1o6m7m0Yk6b2cHq9c2mV0XxjT3k8zX5dQ2rA",
+	DocName:     "Old Document",
+	StorageKey:  "00000000000000000000000000000005",
+	SenderEmail: mockFile.SenderEmail,
+	Expires:     time.Now().Add(-24 * time.Hour),
+}
+
+// mockExpiredVersions are mockExpiredFile and the version it replaced.
+var mockExpiredVersions = []models.FileVersion{
+	{Version: 2, DocName: mockExpiredFile.DocName, StorageKey: mockExpiredFile.StorageKey},
+	{Version: 1, DocName: mockExpiredFile.DocName, StorageKey: "00000000000000000000000000000004"},
+}
+
+// SharedFileModel keeps the files inserted and downloads recorded so tests can check on them.
+type SharedFileModel struct {
+	Inserted   []models.SharedFile
+	Downloaded []string
+
+	limitedDownloads int
+	downloadedIds    []int
+	reminded         bool
+
+	// Extended is how many days each file was extended by.
+	Extended map[int]int
+	// Updated is the files as they were saved by Update.
+	Updated []models.SharedFile
+}
+
+func (m *SharedFileModel) Insert(file models.SharedFile, expiresAt int) (string, error) {
+	m.Inserted = append(m.Inserted, file)
+	return NewToken, nil
+}
+
+func (m *SharedFileModel) InsertShare(files []models.SharedFile, expiresAt int) (string, error) {
+	m.Inserted = append(m.Inserted, files...)
+	return NewToken, nil
+}
+
+func (m *SharedFileModel) Get(token string) (models.SharedFile, error) {
+	switch token {
+	case FileToken:
 		return mockFile, nil
+	case ShareFileToken:
+		return mockShareFile, nil
+	case LimitedFileToken:
+		// Once it's used up it's gone, like an expired file
+		if m.limitedDownloads >= mockLimitedFile.MaxDownloads {
+			return models.SharedFile{}, models.ErrNoRecord
+		}
+		f := mockLimitedFile
+		f.Downloads = m.limitedDownloads
+		return f, nil
 	default:
 		return models.SharedFile{}, models.ErrNoRecord
 	}
 }
 
+func (m *SharedFileModel) GetShare(token string) ([]models.SharedFile, error) {
+	switch token {
+	case ShareToken:
+		return []models.SharedFile{mockFile, mockShareFile}, nil
+	default:
+		return nil, models.ErrNoRecord
+	}
+}
+
 func (m *SharedFileModel) Latest() ([]models.SharedFile, error) {
 	return []models.SharedFile{mockFile}, nil
 }
@@ -45,7 +170,117 @@ func (m *SharedFileModel) GetCreatedFiles(email string) ([]models.SharedFile, er
 	return []models.SharedFile{mockFile}, nil
 }
 
+// RecordDownload treats each download as the recipient's first until one of the same file has been
+// recorded.
+func (m *SharedFileModel) RecordDownload(id int, email string) (bool, error) {
+	if !mockFile.IsRecipient(email) {
+		return false, nil
+	}
+
+	switch id {
+	case mockFile.Id, mockShareFile.Id:
+	case mockLimitedFile.Id:
+		if m.limitedDownloads >= mockLimitedFile.MaxDownloads {
+			return false, models.ErrDownloadLimit
+		}
+		m.limitedDownloads++
+	default:
+		return false, nil
+	}
+
+	first := !slices.Contains(m.downloadedIds, id)
+	m.downloadedIds = append(m.downloadedIds, id)
+	m.Downloaded = append(m.Downloaded, email)
+
+	return first, nil
+}
+
 func (m *SharedFileModel) Remove(id int) error {
 
 	return nil
 }
+
+func (m *SharedFileModel) Expired() ([]models.SharedFile, error) {
+	return []models.SharedFile{mockExpiredFile}, nil
+}
+
+func (m *SharedFileModel) RemoveExpired(remove func(models.SharedFile) error) ([]models.SharedFile, error) {
+	if err := remove(mockExpiredFile); err != nil {
+		return nil, nil
+	}
+	return []models.SharedFile{mockExpiredFile}, nil
+}
+
+// RemindRecipients pretends the mock share is about to expire, its recipient is reminded once.
+func (m *SharedFileModel) RemindRecipients(within time.Duration, send func(models.Recipient, []models.SharedFile) error) (int, error) {
+	if m.reminded {
+		return 0, nil
+	}
+
+	if err := send(mockFile.Recipients[0], []models.SharedFile{mockFile, mockShareFile}); err != nil {
+		return 0, err
+	}
+	m.reminded = true
+
+	return 1, nil
+}
+
+func (m *SharedFileModel) Extend(id int, days int) error {
+	if m.Extended == nil {
+		m.Extended = map[int]int{}
+	}
+	m.Extended[id] += days
+	m.reminded = false
+	return nil
+}
+
+func (m *SharedFileModel) Update(file models.SharedFile) error {
+	m.Updated = append(m.Updated, file)
+	return nil
+}
+
+func (m *SharedFileModel) RewrapKeys(rewrap func(wrappedKey []byte) ([]byte, error)) (int, error) {
+	return 0, nil
+}
+
+func (m *SharedFileModel) Versions(id int) ([]models.FileVersion, error) {
+	switch id {
+	case mockFile.Id:
+		return mockFileVersions, nil
+	case mockExpiredFile.Id:
+		return mockExpiredVersions, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (m *SharedFileModel) GetVersion(id int, version int) (models.FileVersion, error) {
+	versions, _ := m.Versions(id)
+	for _, v := range versions {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+
+	return models.FileVersion{}, models.ErrNoRecord
+}
+
+// AllVersions is the files inserted so far, each as its first version, so tests can store real
+// content to check.
+func (m *SharedFileModel) AllVersions() ([]models.FileVersion, error) {
+	var versions []models.FileVersion
+	for i, f := range m.Inserted {
+		versions = append(versions, models.FileVersion{
+			FileId:      100 + i,
+			Version:     1,
+			DocName:     f.DocName,
+			StorageKey:  f.StorageKey,
+			WrappedKey:  f.WrappedKey,
+			ContentType: f.ContentType,
+			Size:        f.Size,
+			Checksum:    f.Checksum,
+		})
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,50 @@
+package mocks
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"fileshare/internal/models"
+)
+
+type loginToken struct {
+	userId int
+	path   string
+}
+
+// LoginTokenModel keeps tokens in memory, each can be used once like the real thing.
+type LoginTokenModel struct {
+	mu     sync.Mutex
+	n      int
+	tokens map[string]loginToken
+}
+
+func (m *LoginTokenModel) Insert(userId int, path string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = map[string]loginToken{}
+	}
+
+	m.n++
+	token := "login-token-" + strconv.Itoa(m.n)
+	m.tokens[token] = loginToken{userId: userId, path: path}
+
+	return token, nil
+}
+
+func (m *LoginTokenModel) Consume(token string) (int, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[token]
+	if !ok {
+		return 0, "", models.ErrNoRecord
+	}
+
+	delete(m.tokens, token)
+
+	return t.userId, t.path, nil
+}
@@ -0,0 +1,77 @@
+package mocks
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	//Internal
+	"fileshare/internal/models"
+
+	//External
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// PasskeyModel keeps passkeys in memory.
+type PasskeyModel struct {
+	mu       sync.Mutex
+	passkeys []models.Passkey
+}
+
+func (m *PasskeyModel) Insert(userId int, name string, credential webauthn.Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.passkeys {
+		if bytes.Equal(p.Credential.ID, credential.ID) {
+			return models.ErrDuplicatePasskey
+		}
+	}
+
+	m.passkeys = append(m.passkeys, models.Passkey{ID: len(m.passkeys) + 1, UserId: userId, Name: name,
+		Credential: credential, Created: time.Now(), LastUsed: time.Now()})
+
+	return nil
+}
+
+func (m *PasskeyModel) GetAll(userId int) ([]models.Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var passkeys []models.Passkey
+	for _, p := range m.passkeys {
+		if p.UserId == userId {
+			passkeys = append(passkeys, p)
+		}
+	}
+
+	return passkeys, nil
+}
+
+func (m *PasskeyModel) Used(userId int, credential webauthn.Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, p := range m.passkeys {
+		if p.UserId == userId && bytes.Equal(p.Credential.ID, credential.ID) {
+			m.passkeys[i].Credential = credential
+			m.passkeys[i].LastUsed = time.Now()
+		}
+	}
+
+	return nil
+}
+
+func (m *PasskeyModel) Delete(userId, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, p := range m.passkeys {
+		if p.ID == id && p.UserId == userId {
+			m.passkeys = append(m.passkeys[:i], m.passkeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return models.ErrNoRecord
+}
@@ -0,0 +1,73 @@
+package mocks
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"fileshare/internal/models"
+)
+
+type passwordReset struct {
+	userId  int
+	expires time.Time
+}
+
+// PasswordResetModel keeps tokens in memory, each can be used once and only the latest for a user
+// works like the real thing.
+type PasswordResetModel struct {
+	mu     sync.Mutex
+	n      int
+	tokens map[string]passwordReset
+}
+
+func (m *PasswordResetModel) Insert(userId int, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = map[string]passwordReset{}
+	}
+
+	for token, t := range m.tokens {
+		if t.userId == userId {
+			delete(m.tokens, token)
+		}
+	}
+
+	m.n++
+	token := "reset-token-" + strconv.Itoa(m.n)
+	m.tokens[token] = passwordReset{userId: userId, expires: time.Now().Add(ttl)}
+
+	return token, nil
+}
+
+func (m *PasswordResetModel) Get(token string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[token]
+	if !ok || !time.Now().Before(t.expires) {
+		return 0, models.ErrNoRecord
+	}
+
+	return t.userId, nil
+}
+
+func (m *PasswordResetModel) Consume(token string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[token]
+	if !ok || !time.Now().Before(t.expires) {
+		return 0, models.ErrNoRecord
+	}
+
+	for token, other := range m.tokens {
+		if other.userId == t.userId {
+			delete(m.tokens, token)
+		}
+	}
+
+	return t.userId, nil
+}
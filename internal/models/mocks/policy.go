@@ -0,0 +1,23 @@
+package mocks
+
+import (
+	"fileshare/internal/models"
+)
+
+// UploadPolicyModel starts out with the default policy and keeps whatever it's updated to.
+type UploadPolicyModel struct {
+	policy *models.UploadPolicy
+}
+
+func (m *UploadPolicyModel) Get() (models.UploadPolicy, error) {
+	if m.policy == nil {
+		return models.DefaultUploadPolicy, nil
+	}
+
+	return *m.policy, nil
+}
+
+func (m *UploadPolicyModel) Update(policy models.UploadPolicy) error {
+	m.policy = &policy
+	return nil
+}
@@ -0,0 +1,19 @@
+package mocks
+
+import (
+	"fileshare/internal/models"
+)
+
+// SecurityPolicyModel keeps the policy it's updated to, nothing is required to begin with.
+type SecurityPolicyModel struct {
+	Policy models.SecurityPolicy
+}
+
+func (m *SecurityPolicyModel) Get() (models.SecurityPolicy, error) {
+	return m.Policy, nil
+}
+
+func (m *SecurityPolicyModel) Update(policy models.SecurityPolicy) error {
+	m.Policy = policy
+	return nil
+}
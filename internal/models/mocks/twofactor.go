@@ -0,0 +1,104 @@
+package mocks
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"fileshare/internal/models"
+)
+
+// TwoFactorModel keeps second factors in memory. Recovery codes are numbered so tests can guess
+// them, "recov-ery01" and on.
+type TwoFactorModel struct {
+	mu      sync.Mutex
+	n       int
+	factors map[int]*models.TwoFactor
+	codes   map[int][]string
+}
+
+func (m *TwoFactorModel) Get(userId int) (models.TwoFactor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.factors[userId]
+	if !ok {
+		return models.TwoFactor{}, models.ErrNoRecord
+	}
+
+	t := *f
+	t.RecoveryCodes = len(m.codes[userId])
+
+	return t, nil
+}
+
+func (m *TwoFactorModel) Enable(userId int, secret string, step int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.factors == nil {
+		m.factors = map[int]*models.TwoFactor{}
+		m.codes = map[int][]string{}
+	}
+
+	m.factors[userId] = &models.TwoFactor{UserId: userId, Secret: secret, LastStep: step}
+
+	return m.newCodes(userId), nil
+}
+
+func (m *TwoFactorModel) Disable(userId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.factors, userId)
+	delete(m.codes, userId)
+
+	return nil
+}
+
+func (m *TwoFactorModel) UseStep(userId int, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.factors[userId]
+	if !ok || step <= f.LastStep {
+		return models.ErrCodeUsed
+	}
+	f.LastStep = step
+
+	return nil
+}
+
+func (m *TwoFactorModel) UseRecoveryCode(userId int, code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.Index(m.codes[userId], models.NormalizeRecoveryCode(code))
+	if i < 0 {
+		return models.ErrNoRecord
+	}
+	m.codes[userId] = slices.Delete(m.codes[userId], i, i+1)
+
+	return nil
+}
+
+func (m *TwoFactorModel) NewRecoveryCodes(userId int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.newCodes(userId), nil
+}
+
+func (m *TwoFactorModel) newCodes(userId int) []string {
+	var codes []string
+	m.codes[userId] = nil
+
+	for range 10 {
+		m.n++
+		code := fmt.Sprintf("recov-ery%02d", m.n)
+		codes = append(codes, code)
+		m.codes[userId] = append(m.codes[userId], models.NormalizeRecoveryCode(code))
+	}
+
+	return codes
+}
@@ -0,0 +1,96 @@
+package mocks
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"fileshare/internal/models"
+)
+
+// UploadModel keeps uploads in memory so tests can go through a whole resumable upload.
+type UploadModel struct {
+	mu      sync.Mutex
+	uploads map[string]models.Upload
+	parts   map[string][]models.UploadPart
+}
+
+func (m *UploadModel) Insert(upload models.Upload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.uploads == nil {
+		m.uploads = map[string]models.Upload{}
+		m.parts = map[string][]models.UploadPart{}
+	}
+
+	// Tests can start an upload in the past to make it expire
+	if upload.CreatedAt.IsZero() {
+		upload.CreatedAt = time.Now().UTC()
+	}
+
+	m.uploads[upload.Id] = upload
+	return nil
+}
+
+func (m *UploadModel) Get(id string) (models.Upload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.uploads[id]
+	if !ok {
+		return models.Upload{}, models.ErrNoRecord
+	}
+	return upload, nil
+}
+
+func (m *UploadModel) AddPart(id string, part models.UploadPart) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.uploads[id]
+	if !ok || upload.Offset != part.Offset || upload.Offset+part.Size > upload.Length {
+		return models.ErrUploadOffset
+	}
+
+	upload.Offset += part.Size
+	m.uploads[id] = upload
+	m.parts[id] = append(m.parts[id], part)
+	return nil
+}
+
+func (m *UploadModel) Parts(id string) ([]models.UploadPart, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.parts[id], nil
+}
+
+func (m *UploadModel) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.uploads[id]; !ok {
+		return models.ErrNoRecord
+	}
+
+	delete(m.uploads, id)
+	delete(m.parts, id)
+	return nil
+}
+
+func (m *UploadModel) Expired(ttl time.Duration) ([]models.Upload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []models.Upload
+	for _, upload := range m.uploads {
+		if !upload.CreatedAt.After(time.Now().Add(-ttl)) {
+			expired = append(expired, upload)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i].CreatedAt.Before(expired[j].CreatedAt) })
+
+	return expired, nil
+}
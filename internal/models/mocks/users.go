@@ -4,31 +4,79 @@ import (
 	"fileshare/internal/models"
 )
 
+// UserModel is the mock accounts. Accounts can be added, and who has turned off download emails,
+// passwords, where accounts are managed and the roles of added accounts can be changed.
+// Authenticators are tried before the mock passwords.
 type UserModel struct {
+	Authenticators []models.Authenticator
+
+	quiet     map[int]bool
+	added     []models.User
+	passwords map[int]string
+	sources   map[int]string
 }
 
 func (m *UserModel) Insert(name, email, password string, admin, user, guest, disabled bool) error {
-	switch email {
-	case "dupe@example.com":
+	if _, err := m.GetByEmail(email); err == nil || email == "dupe@example.com" {
 		return models.ErrDuplicateEmail
-	default:
-		return nil
 	}
+
+	m.added = append(m.added, models.User{ID: 100 + len(m.added), Name: name, Email: email, Admin: admin,
+		User: user, Guest: guest, Disabled: disabled})
+
+	return nil
+}
+
+// Mock accounts, the sender and recipient match mockFile. They all share the password "pa$$word".
+var mockUsers = map[string]int{
+	"alice@example.com": 1,
+	"Abar@example.com":  2,
+	"foo@bar.com":       3,
+	"admin@example.com": 4,
 }
 
 func (m *UserModel) Authenticate(email, password string) (int, error) {
-	if email == "alice@example.com" && password == "pa$$word" {
-		return 1, nil
+	return models.AuthenticateChain(m, m.Authenticators, email, password, m.authenticatePassword)
+}
+
+func (m *UserModel) authenticatePassword(email, password string) (int, error) {
+	user, err := m.GetByEmail(email)
+	if err != nil || user.Source != models.SourceLocal {
+		return 0, models.ErrInvalidCredentials
+	}
+
+	want, ok := m.passwords[user.ID]
+	if !ok {
+		// Added accounts don't have a password until one is set.
+		if _, fixed := mockUsers[email]; !fixed {
+			return 0, models.ErrInvalidCredentials
+		}
+		want = "pa$$word"
+	}
+
+	if password != want {
+		return 0, models.ErrInvalidCredentials
 	}
 
-	return 0, models.ErrInvalidCredentials
+	return user.ID, nil
 }
 
 func (m *UserModel) Exists(id int) (exist bool, admin bool, user bool, guest bool, disabled bool, error error) {
 	switch id {
 	case 1:
 		return true, false, false, false, false, nil
+	case 2:
+		return true, false, true, false, false, nil
+	case 3:
+		return true, false, false, true, false, nil
+	case 4:
+		return true, true, false, false, false, nil
 	default:
+		for _, u := range m.added {
+			if u.ID == id {
+				return true, u.Admin, u.User, u.Guest, u.Disabled, nil
+			}
+		}
 		return false, false, false, false, false, nil
 	}
 }
@@ -42,10 +90,39 @@ func (m *UserModel) GetAllUsers() ([]models.User, error) {
 }
 
 func (m *UserModel) Get(id int) (models.User, error) {
+	for email, mockId := range mockUsers {
+		if mockId == id {
+			return models.User{ID: id, Email: email, Guest: id == 3, Admin: id == 4, NotifyDownloads: !m.quiet[id],
+				Source: m.sources[id]}, nil
+		}
+	}
+
+	for _, u := range m.added {
+		if u.ID == id {
+			u.NotifyDownloads = !m.quiet[id]
+			u.Source = m.sources[id]
+			return u, nil
+		}
+	}
+
 	var u models.User
 	return u, nil
 }
 
+func (m *UserModel) GetByEmail(email string) (models.User, error) {
+	if id, ok := mockUsers[email]; ok {
+		return m.Get(id)
+	}
+
+	for _, u := range m.added {
+		if u.Email == email {
+			return m.Get(u.ID)
+		}
+	}
+
+	return models.User{}, models.ErrNoRecord
+}
+
 func (m *UserModel) UpdateUser(id int, name, email, password string, admin, user, guest bool) (models.User, error) {
 	return models.User{}, nil
 }
@@ -54,3 +131,37 @@ func (m *UserModel) DeleteUser(id int) error {
 
 	return nil
 }
+
+func (m *UserModel) SetNotifyDownloads(id int, notify bool) error {
+	if m.quiet == nil {
+		m.quiet = map[int]bool{}
+	}
+	m.quiet[id] = !notify
+	return nil
+}
+
+func (m *UserModel) SetRoles(id int, admin, user, guest bool) error {
+	for i, u := range m.added {
+		if u.ID == id {
+			m.added[i].Admin, m.added[i].User, m.added[i].Guest = admin, user, guest
+		}
+	}
+
+	return nil
+}
+
+func (m *UserModel) SetPassword(id int, password string) error {
+	if m.passwords == nil {
+		m.passwords = map[int]string{}
+	}
+	m.passwords[id] = password
+	return nil
+}
+
+func (m *UserModel) SetSource(id int, source string) error {
+	if m.sources == nil {
+		m.sources = map[int]string{}
+	}
+	m.sources[id] = source
+	return nil
+}
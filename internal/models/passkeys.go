@@ -0,0 +1,130 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	//External
+	"github.com/go-sql-driver/mysql"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+type PasskeyModelInterface interface {
+	Insert(userId int, name string, credential webauthn.Credential) error
+	GetAll(userId int) ([]Passkey, error)
+	Used(userId int, credential webauthn.Credential) error
+	Delete(userId, id int) error
+}
+
+// Passkey is a WebAuthn credential someone has registered to sign in with, Name is what they called
+// it so they can tell their phone from their security key.
+type Passkey struct {
+	ID         int
+	UserId     int
+	Name       string
+	Credential webauthn.Credential
+	Created    time.Time
+	LastUsed   time.Time
+}
+
+// PasskeyModel keeps passkeys in the passkeys table. The credential (public key, sign count, flags
+// and the rest) is kept as JSON as it's only ever used whole, its ID is kept on its own as well so
+// the same one can't be registered twice.
+type PasskeyModel struct {
+	DB *sql.DB
+}
+
+// Insert registers a passkey for the user, ErrDuplicatePasskey if it's registered already.
+func (m *PasskeyModel) Insert(userId int, name string, credential webauthn.Credential) error {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO passkeys (UserId, CredentialId, Name, Credential, CreatedAt)
+VALUES (?, ?, ?, ?, UTC_TIMESTAMP())`
+
+	_, err = m.DB.Exec(stmt, userId, credential.ID, name, data)
+	if err != nil {
+		var mySQLError *mysql.MySQLError
+		if errors.As(err, &mySQLError) {
+			if mySQLError.Number == 1062 && strings.Contains(mySQLError.Message, "passkeys_uc_credential") {
+				return ErrDuplicatePasskey
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// GetAll returns the user's passkeys, oldest first.
+func (m *PasskeyModel) GetAll(userId int) ([]Passkey, error) {
+	stmt := `SELECT id, UserId, Name, Credential, CreatedAt, IFNULL(LastUsedAt, CreatedAt)
+       FROM passkeys WHERE UserId = ? ORDER BY id`
+
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var passkeys []Passkey
+
+	for rows.Next() {
+		var (
+			p    Passkey
+			data []byte
+		)
+
+		if err = rows.Scan(&p.ID, &p.UserId, &p.Name, &data, &p.Created, &p.LastUsed); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(data, &p.Credential); err != nil {
+			return nil, err
+		}
+
+		passkeys = append(passkeys, p)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// Used saves the credential as it is after the user signed in with it, the authenticator's sign
+// count goes up each time and a count that goes backwards is how a cloned key shows up.
+func (m *PasskeyModel) Used(userId int, credential webauthn.Credential) error {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE passkeys SET Credential = ?, LastUsedAt = UTC_TIMESTAMP() WHERE UserId = ? AND CredentialId = ?`
+
+	_, err = m.DB.Exec(stmt, data, userId, credential.ID)
+
+	return err
+}
+
+// Delete removes one of the user's passkeys, ErrNoRecord if they don't have one with that ID.
+func (m *PasskeyModel) Delete(userId, id int) error {
+	result, err := m.DB.Exec(`DELETE FROM passkeys WHERE id = ? AND UserId = ?`, id, userId)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
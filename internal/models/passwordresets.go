@@ -0,0 +1,100 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type PasswordResetModelInterface interface {
+	Insert(userId int, ttl time.Duration) (string, error)
+	Get(token string) (userId int, err error)
+	Consume(token string) (userId int, err error)
+}
+
+// PasswordResetModel keeps the tokens of the links emailed to people that have forgotten their
+// password. Like magic links only a SHA-256 hash of each token is stored, and a token can only be
+// used once. Only the latest link sent to someone works.
+type PasswordResetModel struct {
+	DB *sql.DB
+}
+
+// Insert makes a new token for the user that lasts for ttl and returns it, any they had before stop
+// working.
+func (m *PasswordResetModel) Insert(userId int, ttl time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	// Tidy up while we're here, nothing can use an expired token.
+	stmt := `DELETE FROM password_resets WHERE UserId = ? OR Expires <= UTC_TIMESTAMP()`
+	if _, err = m.DB.Exec(stmt, userId); err != nil {
+		return "", err
+	}
+
+	stmt = `INSERT INTO password_resets (TokenHash, UserId, Expires)
+VALUES (?, ?, DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+
+	if _, err = m.DB.Exec(stmt, hash[:], userId, int(ttl.Seconds())); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Get returns who a token resets the password of without using it up. A token that doesn't exist or
+// has expired gives ErrNoRecord.
+func (m *PasswordResetModel) Get(token string) (int, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	var userId int
+
+	stmt := `SELECT UserId FROM password_resets WHERE TokenHash = ? AND Expires > UTC_TIMESTAMP()`
+
+	if err := m.DB.QueryRow(stmt, hash[:]).Scan(&userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+
+	return userId, nil
+}
+
+// Consume uses up a token, returning who it resets the password of. A token that doesn't exist, has
+// expired or has been used already gives ErrNoRecord.
+func (m *PasswordResetModel) Consume(token string) (int, error) {
+	hash := sha256.Sum256([]byte(token))
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	var userId int
+
+	stmt := `SELECT UserId FROM password_resets WHERE TokenHash = ? AND Expires > UTC_TIMESTAMP() FOR UPDATE`
+
+	if err = tx.QueryRow(stmt, hash[:]).Scan(&userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM password_resets WHERE UserId = ?`, userId); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userId, nil
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"mime"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type UploadPolicyModelInterface interface {
+	Get() (UploadPolicy, error)
+	Update(policy UploadPolicy) error
+}
+
+// UploadPolicy is what can be uploaded. Extensions are lower case without the dot and types are
+// MIME types like application/pdf, or image/* for all images, sniffed from the content rather than
+// taken from the browser. Anything blocked is refused, and when there are allowed ones anything
+// else is too. The max sizes are in bytes for each role, 0 for no limit.
+type UploadPolicy struct {
+	AllowedExtensions []string
+	BlockedExtensions []string
+	AllowedTypes      []string
+	BlockedTypes      []string
+	GuestMaxSize      int64
+	UserMaxSize       int64
+	AdminMaxSize      int64
+}
+
+// DefaultUploadPolicy is used until an admin saves one, it keeps out programs that would run on
+// whoever downloads them.
+var DefaultUploadPolicy = UploadPolicy{
+	BlockedExtensions: []string{"exe", "com", "scr", "bat", "cmd", "msi", "vbs", "ps1"},
+	BlockedTypes:      []string{"application/x-msdownload", "application/x-executable", "application/x-mach-binary"},
+	GuestMaxSize:      100 << 20,
+	UserMaxSize:       2 << 30,
+	AdminMaxSize:      20 << 30,
+}
+
+// AllowsExtension reports whether a file called name can be uploaded, going by its extension.
+func (p UploadPolicy) AllowsExtension(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+
+	if slices.Contains(p.BlockedExtensions, ext) {
+		return false
+	}
+
+	return len(p.AllowedExtensions) == 0 || slices.Contains(p.AllowedExtensions, ext)
+}
+
+// AllowsType reports whether content sniffed as contentType can be uploaded.
+func (p UploadPolicy) AllowsType(contentType string) bool {
+	base, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		base, _, _ = strings.Cut(contentType, ";")
+	}
+	base = strings.ToLower(strings.TrimSpace(base))
+
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if p == base || (strings.HasSuffix(p, "/*") && strings.HasPrefix(base, strings.TrimSuffix(p, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if matches(p.BlockedTypes) {
+		return false
+	}
+
+	return len(p.AllowedTypes) == 0 || matches(p.AllowedTypes)
+}
+
+// MaxSize is the biggest file someone can upload, 0 for no limit. Admins go by the admin limit
+// whatever other roles they have, then users, and anyone else is a guest.
+func (p UploadPolicy) MaxSize(admin, user bool) int64 {
+	switch {
+	case admin:
+		return p.AdminMaxSize
+	case user:
+		return p.UserMaxSize
+	default:
+		return p.GuestMaxSize
+	}
+}
+
+// UploadPolicyModel keeps the policy in the upload_policy table, which like config has a single row.
+type UploadPolicyModel struct {
+	DB *sql.DB
+}
+
+// Get returns the policy, or DefaultUploadPolicy if one hasn't been saved yet.
+func (m *UploadPolicyModel) Get() (UploadPolicy, error) {
+	stmt := `SELECT allowed_extensions, blocked_extensions, allowed_types, blocked_types, guest_max_size,
+       user_max_size, admin_max_size FROM upload_policy WHERE id = 1`
+
+	var (
+		p                                                  UploadPolicy
+		allowedExt, blockedExt, allowedTypes, blockedTypes string
+	)
+
+	err := m.DB.QueryRow(stmt).Scan(&allowedExt, &blockedExt, &allowedTypes, &blockedTypes, &p.GuestMaxSize,
+		&p.UserMaxSize, &p.AdminMaxSize)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DefaultUploadPolicy, nil
+		}
+		return UploadPolicy{}, err
+	}
+
+	p.AllowedExtensions = splitList(allowedExt)
+	p.BlockedExtensions = splitList(blockedExt)
+	p.AllowedTypes = splitList(allowedTypes)
+	p.BlockedTypes = splitList(blockedTypes)
+
+	return p, nil
+}
+
+func (m *UploadPolicyModel) Update(p UploadPolicy) error {
+	stmt := `INSERT INTO upload_policy (id, allowed_extensions, blocked_extensions, allowed_types, blocked_types,
+                           guest_max_size, user_max_size, admin_max_size)
+VALUES (1, ?, ?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE allowed_extensions = VALUES(allowed_extensions),
+                        blocked_extensions = VALUES(blocked_extensions),
+                        allowed_types      = VALUES(allowed_types),
+                        blocked_types      = VALUES(blocked_types),
+                        guest_max_size     = VALUES(guest_max_size),
+                        user_max_size      = VALUES(user_max_size),
+                        admin_max_size     = VALUES(admin_max_size)`
+
+	_, err := m.DB.Exec(stmt, strings.Join(p.AllowedExtensions, ","), strings.Join(p.BlockedExtensions, ","),
+		strings.Join(p.AllowedTypes, ","), strings.Join(p.BlockedTypes, ","), p.GuestMaxSize, p.UserMaxSize,
+		p.AdminMaxSize)
+
+	return err
+}
+
+// splitList undoes the strings.Join the lists are saved with.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type SecurityPolicyModelInterface interface {
+	Get() (SecurityPolicy, error)
+	Update(policy SecurityPolicy) error
+}
+
+// SecurityPolicy is how admins want people to sign in. RequireAdminTwoFactor makes anyone with the
+// Admin flag set up two-factor before they can sign in.
+type SecurityPolicy struct {
+	RequireAdminTwoFactor bool
+}
+
+// SecurityPolicyModel keeps the policy in the security_policy table, which has a single row like
+// upload_policy. Nothing is required until an admin saves a policy.
+type SecurityPolicyModel struct {
+	DB *sql.DB
+}
+
+func (m *SecurityPolicyModel) Get() (SecurityPolicy, error) {
+	stmt := `SELECT require_admin_2fa FROM security_policy WHERE id = 1`
+
+	var p SecurityPolicy
+
+	err := m.DB.QueryRow(stmt).Scan(&p.RequireAdminTwoFactor)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return SecurityPolicy{}, err
+	}
+
+	return p, nil
+}
+
+func (m *SecurityPolicyModel) Update(p SecurityPolicy) error {
+	stmt := `INSERT INTO security_policy (id, require_admin_2fa) VALUES (1, ?)
+ON DUPLICATE KEY UPDATE require_admin_2fa = VALUES(require_admin_2fa)`
+
+	_, err := m.DB.Exec(stmt, p.RequireAdminTwoFactor)
+
+	return err
+}
@@ -1,65 +1,280 @@
 package models
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"errors"
+	"strings"
 	"time"
 )
 
 type SharedFileModelInterface interface {
-	Insert(docName, senderUserName, senderEmail, recipientUserName, recipientEmail,
-		password string, expiresAt int) (int, error)
-	Get(id int) (SharedFile, error)
+	Insert(file SharedFile, expiresAt int) (string, error)
+	InsertShare(files []SharedFile, expiresAt int) (string, error)
+	Get(token string) (SharedFile, error)
+	GetShare(token string) ([]SharedFile, error)
 	Latest() ([]SharedFile, error)
 	GetFileFromEmail(email string) ([]SharedFile, error)
 	GetCreatedFiles(email string) ([]SharedFile, error)
+	RecordDownload(id int, email string) (first bool, err error)
 	Remove(id int) error
+	RewrapKeys(rewrap func(wrappedKey []byte) ([]byte, error)) (int, error)
+	Expired() ([]SharedFile, error)
+	RemoveExpired(remove func(SharedFile) error) ([]SharedFile, error)
+	RemindRecipients(within time.Duration, send func(Recipient, []SharedFile) error) (int, error)
+	Extend(id int, days int) error
+	Update(file SharedFile) error
+	Versions(id int) ([]FileVersion, error)
+	GetVersion(id int, version int) (FileVersion, error)
+	AllVersions() ([]FileVersion, error)
 }
 
+// SharedFile is an uploaded file. Links to it use Token, a random string that can't be guessed, the
+// Id is only used inside the application. ShareToken is the token of the share the file was uploaded
+// as part of, if any. MaxDownloads is how many times the recipients can download it, 0 for no limit,
+// and Downloads is how many times they have. Once a file is out of downloads it's treated like it has
+// expired. The content fields, from DocName to Checksum, are those of the latest version. Rejected is
+// what the virus scanner found in the file, a rejected file is in quarantine and is never returned
+// by Get or the lists.
 type SharedFile struct {
-	Id             int
-	DocName        string
-	SenderName     string
-	SenderEmail    string
-	RecipientName  string
-	RecipientEmail string
-	Password       string
-	CreatedAt      time.Time
-	Expires        time.Time
+	Id           int
+	Token        string
+	ShareId      int
+	ShareToken   string
+	DocName      string
+	StorageKey   string
+	WrappedKey   []byte
+	ContentType  string
+	Version      int
+	Size         int64
+	Checksum     string
+	SenderName   string
+	SenderEmail  string
+	Recipients   []Recipient
+	MaxDownloads int
+	Downloads    int
+	Rejected     string
+	CreatedAt    time.Time
+	Expires      time.Time
+}
+
+// Recipient is someone a file has been shared with. Downloads counts how many times they have
+// downloaded it and DownloadedAt is the last time they did, zero if they haven't yet.
+type Recipient struct {
+	Name         string
+	Email        string
+	Downloads    int
+	DownloadedAt time.Time
+}
+
+// FileVersion is one upload of a file, replacing a file adds a version rather than losing what was
+// there. Checksum is the hex SHA-256 of the content, it and Size are blank for files uploaded before
+// versions were kept.
+type FileVersion struct {
+	FileId      int
+	Version     int
+	DocName     string
+	StorageKey  string
+	WrappedKey  []byte
+	ContentType string
+	Size        int64
+	Checksum    string
+	UploadedAt  time.Time
+}
+
+// IsRecipient reports whether the file was shared with email.
+func (s SharedFile) IsRecipient(email string) bool {
+	for _, r := range s.Recipients {
+		if strings.EqualFold(email, r.Email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RecipientNames is the names of everyone the file was shared with, for showing in lists.
+func (s SharedFile) RecipientNames() string {
+	names := make([]string, len(s.Recipients))
+	for i, r := range s.Recipients {
+		names[i] = r.Name
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// LastDownload is the recipient that downloaded the file most recently, or a zero Recipient if
+// nobody has yet.
+func (s SharedFile) LastDownload() Recipient {
+	var last Recipient
+
+	for _, r := range s.Recipients {
+		if r.DownloadedAt.After(last.DownloadedAt) {
+			last = r
+		}
+	}
+
+	return last
+}
+
+// CanView reports whether the user with the given email may view and download the file, that is
+// the sender, a recipient or any admin.
+func (s SharedFile) CanView(email string, admin bool) bool {
+	return admin || strings.EqualFold(email, s.SenderEmail) || s.IsRecipient(email)
+}
+
+// CanDelete reports whether the user with the given email may delete the file, only the sender
+// and admins can.
+func (s SharedFile) CanDelete(email string, admin bool) bool {
+	return admin || strings.EqualFold(email, s.SenderEmail)
 }
 
 type SharedFileModel struct {
 	DB *sql.DB
 }
 
-func (m *SharedFileModel) Insert(docName, senderUserName, senderEmail, recipientUserName, recipientEmail,
-	password string, expiresAt int) (int, error) {
-	stmt := `INSERT INTO files (DocName, SenderName, SenderEmail, RecipientName, RecipientEmail, Password,
-                  CreatedAt, Expires) 
-VALUES (?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY))`
+// Insert adds a new file along with its recipients and gives it a token, which is returned. The Id,
+// Token, share and CreatedAt fields are ignored and Expires is set from expiresAt, the number of days
+// it should be kept.
+func (m *SharedFileModel) Insert(file SharedFile, expiresAt int) (string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
 
-	result, err := m.DB.Exec(stmt, docName, senderUserName, senderEmail, recipientUserName, recipientEmail,
-		password, expiresAt)
+	token, err := insertFile(tx, file, nil, expiresAt)
 	if err != nil {
-		return 0, err
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// InsertShare adds files that were uploaded together as one share, each is inserted like Insert does
+// and they all expire at the same time. It returns the token of the share.
+func (m *SharedFileModel) InsertShare(files []SharedFile, expiresAt int) (string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := tx.Exec(`INSERT INTO shares (Token, CreatedAt) VALUES (?, UTC_TIMESTAMP())`, token)
+	if err != nil {
+		return "", err
+	}
+
+	shareId, err := result.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		if _, err = insertFile(tx, file, shareId, expiresAt); err != nil {
+			return "", err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// insertFile adds a file and its recipients as part of tx and returns the file's new token, shareId
+// is nil for a file on its own.
+func insertFile(tx *sql.Tx, file SharedFile, shareId any, expiresAt int) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	stmt := `INSERT INTO files (ShareId, Token, DocName, StorageKey, WrappedKey, ContentType, Size, Checksum,
+                  SenderName, SenderEmail, MaxDownloads, Rejected, CreatedAt, Expires) 
+VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, NULLIF(?, 0), NULLIF(?, ''), UTC_TIMESTAMP(),
+        DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY))`
+
+	result, err := tx.Exec(stmt, shareId, token, file.DocName, file.StorageKey, file.WrappedKey, file.ContentType,
+		file.Size, file.Checksum, file.SenderName, file.SenderEmail, file.MaxDownloads, file.Rejected, expiresAt)
+	if err != nil {
+		return "", err
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		return 0, err
+		return "", err
+	}
+
+	for _, r := range file.Recipients {
+		if _, err = tx.Exec(`INSERT INTO file_recipients (FileId, Name, Email) VALUES (?, ?, ?)`,
+			id, r.Name, r.Email); err != nil {
+			return "", err
+		}
+	}
+
+	if err = insertVersion(tx, id, 1, file); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// insertVersion records the content of file as version of the file with the given id.
+func insertVersion(tx *sql.Tx, id any, version int, file SharedFile) error {
+	stmt := `INSERT INTO file_versions (FileId, Version, DocName, StorageKey, WrappedKey, ContentType, Size,
+                           Checksum, UploadedAt)
+VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), UTC_TIMESTAMP())`
+
+	_, err := tx.Exec(stmt, id, version, file.DocName, file.StorageKey, file.WrappedKey, file.ContentType,
+		file.Size, file.Checksum)
+
+	return err
+}
+
+// live is the condition for a file that hasn't expired or used up its downloads. Files are always
+// aliased as f.
+const live = `f.Expires > UTC_TIMESTAMP() AND (f.MaxDownloads IS NULL OR f.Downloads < f.MaxDownloads)`
+
+// available is the condition for a file that can still be downloaded, it's live and it wasn't
+// rejected by the virus scanner.
+const available = live + ` AND f.Rejected IS NULL`
+
+// newToken returns 256 random bits encoded for use in a URL.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
 
-	return int(id), nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func (m *SharedFileModel) Get(id int) (SharedFile, error) {
-	stmt := `SELECT Id, DocName, RecipientName, SenderName, CreatedAt, 
-       SenderEmail, RecipientEmail FROM files WHERE Expires > UTC_TIMESTAMP() AND id = ?`
+func (m *SharedFileModel) Get(token string) (SharedFile, error) {
+	stmt := `SELECT f.Id, f.Token, IFNULL(f.ShareId, 0), IFNULL(s.Token, ''), f.DocName, f.StorageKey, f.WrappedKey,
+       f.ContentType, f.Version, IFNULL(f.Size, 0), IFNULL(f.Checksum, ''), f.SenderName,
+       IFNULL(f.MaxDownloads, 0), f.Downloads, f.CreatedAt, f.Expires, f.SenderEmail
+       FROM files f LEFT JOIN shares s ON s.Id = f.ShareId
+       WHERE ` + available + ` AND f.Token = ?`
 
 	var s SharedFile
 
-	if err := m.DB.QueryRow(stmt, id).Scan(&s.Id, &s.DocName, &s.RecipientName, &s.SenderName, &s.CreatedAt,
-		&s.SenderEmail, &s.RecipientEmail); err != nil {
+	if err := m.DB.QueryRow(stmt, token).Scan(&s.Id, &s.Token, &s.ShareId, &s.ShareToken, &s.DocName,
+		&s.StorageKey, &s.WrappedKey, &s.ContentType, &s.Version, &s.Size, &s.Checksum, &s.SenderName,
+		&s.MaxDownloads, &s.Downloads, &s.CreatedAt, &s.Expires, &s.SenderEmail); err != nil {
 		// If the query returns no rows, then row.Scan() will return a
 		// sql.ErrNoRows error. We use the errors.Is() function check for that
 		// error specifically, and return our own ErrNoRecord error
@@ -71,15 +286,23 @@ func (m *SharedFileModel) Get(id int) (SharedFile, error) {
 		}
 	}
 
-	return s, nil
-}
+	files := []SharedFile{s}
+	if err := m.addRecipients(files); err != nil {
+		return SharedFile{}, err
+	}
 
-func (m *SharedFileModel) Latest() ([]SharedFile, error) {
+	return files[0], nil
+}
 
-	stmt := `SELECT Id, DocName, RecipientName, SenderName, CreatedAt, 
-       SenderEmail, RecipientEmail FROM files WHERE Expires > UTC_TIMESTAMP() ORDER BY id DESC LIMIT 10`
+// GetShare returns the files in a share that can still be downloaded, in the order they were uploaded.
+func (m *SharedFileModel) GetShare(token string) ([]SharedFile, error) {
+	stmt := `SELECT f.Id, f.Token, f.ShareId, s.Token, f.DocName, f.StorageKey, f.WrappedKey, f.ContentType,
+       f.Version, IFNULL(f.Size, 0), IFNULL(f.Checksum, ''), f.SenderName, IFNULL(f.MaxDownloads, 0),
+       f.Downloads, f.CreatedAt, f.Expires, f.SenderEmail
+       FROM files f JOIN shares s ON s.Id = f.ShareId
+       WHERE ` + available + ` AND s.Token = ? ORDER BY f.Id`
 
-	rows, err := m.DB.Query(stmt)
+	rows, err := m.DB.Query(stmt, token)
 	if err != nil {
 		return nil, err
 	}
@@ -90,8 +313,9 @@ func (m *SharedFileModel) Latest() ([]SharedFile, error) {
 
 	for rows.Next() {
 		var s SharedFile
-		err = rows.Scan(&s.Id, &s.DocName, &s.RecipientName, &s.SenderName, &s.CreatedAt,
-			&s.SenderEmail, &s.RecipientEmail)
+		err = rows.Scan(&s.Id, &s.Token, &s.ShareId, &s.ShareToken, &s.DocName, &s.StorageKey, &s.WrappedKey,
+			&s.ContentType, &s.Version, &s.Size, &s.Checksum, &s.SenderName, &s.MaxDownloads, &s.Downloads,
+			&s.CreatedAt, &s.Expires, &s.SenderEmail)
 		if err != nil {
 			return nil, err
 		}
@@ -102,9 +326,96 @@ func (m *SharedFileModel) Latest() ([]SharedFile, error) {
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+
+	if len(sharedFiles) == 0 {
+		return nil, ErrNoRecord
+	}
+
+	if err := m.addRecipients(sharedFiles); err != nil {
+		return nil, err
+	}
+
 	return sharedFiles, nil
 }
 
+func (m *SharedFileModel) Latest() ([]SharedFile, error) {
+	stmt := `SELECT f.Id, f.Token, f.DocName, f.SenderName, f.CreatedAt, f.SenderEmail FROM files f
+       WHERE ` + available + ` ORDER BY f.Id DESC LIMIT 10`
+
+	return m.list(stmt)
+}
+
+// GetFileFromEmail returns the files that have been shared with email.
+func (m *SharedFileModel) GetFileFromEmail(email string) ([]SharedFile, error) {
+	stmt := `SELECT f.Id, f.Token, f.DocName, f.SenderName, f.CreatedAt, f.SenderEmail FROM files f
+       JOIN file_recipients r ON r.FileId = f.Id
+       WHERE ` + available + ` AND r.Email = ? ORDER BY f.Id DESC`
+
+	return m.list(stmt, email)
+}
+
+// GetCreatedFiles returns the files that email has shared.
+func (m *SharedFileModel) GetCreatedFiles(email string) ([]SharedFile, error) {
+	stmt := `SELECT f.Id, f.Token, f.DocName, f.SenderName, f.CreatedAt, f.SenderEmail FROM files f
+       WHERE ` + available + ` AND f.SenderEmail = ? ORDER BY f.Id DESC`
+
+	return m.list(stmt, email)
+}
+
+// RecordDownload counts a download of the file by one of its recipients, downloads by anyone else
+// (the sender or an admin) aren't tracked and are ignored. first reports whether it was the
+// recipient's first download of the file. It returns ErrDownloadLimit, without counting anything, if
+// the file has no downloads left. The check and the count are one UPDATE so two recipients racing for
+// the last download can't both get it.
+func (m *SharedFileModel) RecordDownload(id int, email string) (bool, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	var downloads int
+
+	stmt := `SELECT Downloads FROM file_recipients WHERE FileId = ? AND Email = ? FOR UPDATE`
+
+	if err = tx.QueryRow(stmt, id, email).Scan(&downloads); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	stmt = `UPDATE files SET Downloads = Downloads + 1
+               WHERE Id = ? AND (MaxDownloads IS NULL OR Downloads < MaxDownloads)`
+
+	result, err := tx.Exec(stmt, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, ErrDownloadLimit
+	}
+
+	stmt = `UPDATE file_recipients SET Downloads = Downloads + 1, DownloadedAt = UTC_TIMESTAMP()
+               WHERE FileId = ? AND Email = ?`
+
+	if _, err = tx.Exec(stmt, id, email); err != nil {
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return downloads == 0, nil
+}
+
 func (m *SharedFileModel) Remove(id int) error {
 	result, err := m.DB.Exec(`DELETE FROM files WHERE Id = ?`, id)
 	if err != nil {
@@ -120,47 +431,443 @@ func (m *SharedFileModel) Remove(id int) error {
 	return nil
 }
 
-func (m *SharedFileModel) GetFileFromEmail(email string) ([]SharedFile, error) {
-	stmt := `SELECT Id, DocName, RecipientName, SenderName, CreatedAt, 
-       SenderEmail, RecipientEmail FROM files WHERE Expires > UTC_TIMESTAMP() AND RecipientEmail = ?`
+// RewrapKeys runs every wrapped data key, of files, their older versions and the parts of uploads
+// still in progress, through rewrap and saves the result, all in one transaction so a failure part
+// way through leaves everything readable with the old master key. Files from before encryption at
+// rest have no key and are skipped. It returns the number of keys re-wrapped.
+func (m *SharedFileModel) RewrapKeys(rewrap func(wrappedKey []byte) ([]byte, error)) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	// Each table is done with the same statements, the rows are picked out by their primary key
+	tables := []struct{ key, table string }{
+		{"Id", "files"},
+		{"CONCAT(FileId, '/', Version)", "file_versions"},
+		{"CONCAT(UploadId, '/', PartOffset)", "upload_parts"},
+	}
+
+	var n int
+
+	for _, t := range tables {
+		rows, err := tx.Query(`SELECT ` + t.key + `, WrappedKey FROM ` + t.table +
+			` WHERE WrappedKey IS NOT NULL FOR UPDATE`)
+		if err != nil {
+			return 0, err
+		}
+
+		keys := map[string][]byte{}
+
+		for rows.Next() {
+			var (
+				id         string
+				wrappedKey []byte
+			)
+
+			if err = rows.Scan(&id, &wrappedKey); err != nil {
+				rows.Close()
+				return 0, err
+			}
+
+			keys[id] = wrappedKey
+		}
+
+		if err = rows.Err(); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		rows.Close()
+
+		for id, wrappedKey := range keys {
+			rewrapped, err := rewrap(wrappedKey)
+			if err != nil {
+				return 0, err
+			}
+
+			stmt := `UPDATE ` + t.table + ` SET WrappedKey = ? WHERE ` + t.key + ` = ?`
+			if _, err = tx.Exec(stmt, rewrapped, id); err != nil {
+				return 0, err
+			}
+		}
+
+		n += len(keys)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// RemindRecipients calls send for each recipient that hasn't downloaded a file that expires within
+// the given time, so they can be reminded about it. Files in the same share go to send together.
+// Each reminder is marked as sent before send is called so another server can't send it too, and
+// unmarked again if send fails so it's tried next time. It returns how many reminders were sent, and
+// carries on past a failed send, returning the errors at the end.
+func (m *SharedFileModel) RemindRecipients(within time.Duration, send func(Recipient, []SharedFile) error) (int, error) {
+	stmt := `SELECT f.Id, f.Token, IFNULL(f.ShareId, 0), IFNULL(s.Token, ''), f.DocName, f.SenderName,
+       f.SenderEmail, f.Expires, r.Name, r.Email
+       FROM files f JOIN file_recipients r ON r.FileId = f.Id LEFT JOIN shares s ON s.Id = f.ShareId
+       WHERE ` + available + ` AND f.Expires <= DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND)
+         AND r.Downloads = 0 AND r.RemindedAt IS NULL
+       ORDER BY r.Email, f.ShareId, f.Id`
+
+	rows, err := m.DB.Query(stmt, int(within.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	type reminder struct {
+		recipient Recipient
+		files     []SharedFile
+	}
+
+	var (
+		reminders []*reminder
+		batches   = map[string]*reminder{}
+	)
+
+	for rows.Next() {
+		var (
+			f SharedFile
+			r Recipient
+		)
+
+		err = rows.Scan(&f.Id, &f.Token, &f.ShareId, &f.ShareToken, &f.DocName, &f.SenderName, &f.SenderEmail,
+			&f.Expires, &r.Name, &r.Email)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		// A file on its own is a batch of one
+		key := r.Email + "/file/" + f.Token
+		if f.ShareId != 0 {
+			key = r.Email + "/share/" + f.ShareToken
+		}
+
+		if batches[key] == nil {
+			batches[key] = &reminder{recipient: r}
+			reminders = append(reminders, batches[key])
+		}
+		batches[key].files = append(batches[key].files, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	var (
+		sent int
+		errs []error
+	)
+
+	for _, rem := range reminders {
+		var claimed []SharedFile
+
+		for _, f := range rem.files {
+			result, err := m.DB.Exec(`UPDATE file_recipients SET RemindedAt = UTC_TIMESTAMP()
+               WHERE FileId = ? AND Email = ? AND RemindedAt IS NULL`, f.Id, rem.recipient.Email)
+			if err != nil {
+				return sent, err
+			}
+
+			if n, err := result.RowsAffected(); err != nil {
+				return sent, err
+			} else if n == 1 {
+				claimed = append(claimed, f)
+			}
+		}
+
+		if len(claimed) == 0 {
+			continue
+		}
+
+		if err := send(rem.recipient, claimed); err != nil {
+			errs = append(errs, err)
+
+			for _, f := range claimed {
+				if _, err := m.DB.Exec(`UPDATE file_recipients SET RemindedAt = NULL WHERE FileId = ? AND Email = ?`,
+					f.Id, rem.recipient.Email); err != nil {
+					return sent, err
+				}
+			}
+			continue
+		}
+
+		sent++
+	}
+
+	return sent, errors.Join(errs...)
+}
+
+// Extend pushes the expiry of a file back by days, or for a file in a share the whole share as they
+// expire together. Recipients that were reminded it was about to go can be reminded again.
+func (m *SharedFileModel) Extend(id int, days int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	stmt := `UPDATE files f JOIN files t ON t.Id = ? AND (f.Id = t.Id OR f.ShareId = t.ShareId)
+       SET f.Expires = DATE_ADD(f.Expires, INTERVAL ? DAY)`
+
+	result, err := tx.Exec(stmt, id, days)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	stmt = `UPDATE file_recipients r JOIN files f ON f.Id = r.FileId JOIN files t ON t.Id = ?
+         AND (f.Id = t.Id OR f.ShareId = t.ShareId)
+       SET r.RemindedAt = NULL`
+
+	if _, err = tx.Exec(stmt, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Update saves changes to a file: its name, content (StorageKey, WrappedKey, ContentType, Size and
+// Checksum), when it expires and who it's shared with. New content is added as the next version, the
+// old one is kept. Recipients that are kept keep their download counts, anyone not in file.Recipients
+// any more loses access.
+func (m *SharedFileModel) Update(file SharedFile) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var (
+		storageKey string
+		version    int
+	)
 
-	rows, err := m.DB.Query(stmt, email)
+	stmt := `SELECT StorageKey, Version FROM files WHERE Id = ? FOR UPDATE`
+
+	if err = tx.QueryRow(stmt, file.Id).Scan(&storageKey, &version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+
+	if file.StorageKey != storageKey {
+		version++
+		if err = insertVersion(tx, file.Id, version, file); err != nil {
+			return err
+		}
+	}
+
+	stmt = `UPDATE files SET DocName = ?, StorageKey = ?, WrappedKey = ?, ContentType = ?, Version = ?,
+                 Size = ?, Checksum = NULLIF(?, ''), Expires = ?
+       WHERE Id = ?`
+
+	if _, err = tx.Exec(stmt, file.DocName, file.StorageKey, file.WrappedKey, file.ContentType, version,
+		file.Size, file.Checksum, file.Expires.UTC(), file.Id); err != nil {
+		return err
+	}
+
+	stmt = `DELETE FROM file_recipients WHERE FileId = ?`
+	args := []any{file.Id}
+
+	if len(file.Recipients) > 0 {
+		stmt += ` AND Email NOT IN (?` + strings.Repeat(`, ?`, len(file.Recipients)-1) + `)`
+		for _, r := range file.Recipients {
+			args = append(args, r.Email)
+		}
+	}
+
+	if _, err = tx.Exec(stmt, args...); err != nil {
+		return err
+	}
+
+	for _, r := range file.Recipients {
+		if _, err = tx.Exec(`INSERT INTO file_recipients (FileId, Name, Email) VALUES (?, ?, ?)
+               ON DUPLICATE KEY UPDATE Name = VALUES(Name)`, file.Id, r.Name, r.Email); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Versions returns every version of a file, newest first. The first is the content the files row has.
+func (m *SharedFileModel) Versions(id int) ([]FileVersion, error) {
+	return m.versions(versionStmt+` WHERE FileId = ? ORDER BY Version DESC`, id)
+}
+
+// AllVersions returns every version of every file there is, rejected and expired ones included, in
+// the order they were uploaded.
+func (m *SharedFileModel) AllVersions() ([]FileVersion, error) {
+	return m.versions(versionStmt + ` ORDER BY FileId, Version`)
+}
+
+// versionStmt selects the versions of files, for versions to scan.
+const versionStmt = `SELECT FileId, Version, DocName, StorageKey, WrappedKey, ContentType, IFNULL(Size, 0),
+       IFNULL(Checksum, ''), UploadedAt FROM file_versions`
+
+// versions runs a query built on versionStmt.
+func (m *SharedFileModel) versions(stmt string, args ...any) ([]FileVersion, error) {
+	rows, err := m.DB.Query(stmt, args...)
 	if err != nil {
 		return nil, err
 	}
 
+	defer rows.Close()
+
+	var versions []FileVersion
+
+	for rows.Next() {
+		var v FileVersion
+		err = rows.Scan(&v.FileId, &v.Version, &v.DocName, &v.StorageKey, &v.WrappedKey, &v.ContentType, &v.Size,
+			&v.Checksum, &v.UploadedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// GetVersion returns one version of a file.
+func (m *SharedFileModel) GetVersion(id int, version int) (FileVersion, error) {
+	stmt := versionStmt + ` WHERE FileId = ? AND Version = ?`
+
+	var v FileVersion
+
+	err := m.DB.QueryRow(stmt, id, version).Scan(&v.FileId, &v.Version, &v.DocName, &v.StorageKey, &v.WrappedKey,
+		&v.ContentType, &v.Size, &v.Checksum, &v.UploadedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return FileVersion{}, ErrNoRecord
+		}
+		return FileVersion{}, err
+	}
+
+	return v, nil
+}
+
+// expiredStmt selects the files that have expired or used up their downloads, Get and the lists don't
+// return these any more but they are still there until RemoveExpired gets to them. Rejected files are
+// left in quarantine until they expire like any other.
+const expiredStmt = `SELECT f.Id, f.Token, f.DocName, f.StorageKey, f.SenderEmail, f.Expires FROM files f
+       WHERE NOT (` + live + `) ORDER BY f.Expires`
+
+// Expired returns the files that have expired, without changing anything.
+func (m *SharedFileModel) Expired() ([]SharedFile, error) {
+	rows, err := m.DB.Query(expiredStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return scanExpired(rows)
+}
+
+// RemoveExpired deletes the files that have expired. remove is called with each one first to clean up
+// its stored content, and only the rows it succeeds for are deleted, so a file whose content couldn't
+// be removed is tried again next time rather than forgotten about. It's all one transaction, the rows
+// are locked so two servers can't both work on the same files. It returns the files removed.
+func (m *SharedFileModel) RemoveExpired(remove func(SharedFile) error) ([]SharedFile, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	rows, err := tx.Query(expiredStmt + ` FOR UPDATE`)
+	if err != nil {
+		return nil, err
+	}
+
+	expired, err := scanExpired(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []SharedFile
+
+	for _, f := range expired {
+		if err := remove(f); err != nil {
+			continue
+		}
+
+		if _, err = tx.Exec(`DELETE FROM files WHERE Id = ?`, f.Id); err != nil {
+			return nil, err
+		}
+
+		removed = append(removed, f)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+func scanExpired(rows *sql.Rows) ([]SharedFile, error) {
 	var sharedFiles []SharedFile
 
 	for rows.Next() {
 		var s SharedFile
-		err = rows.Scan(&s.Id, &s.DocName, &s.RecipientName, &s.SenderName, &s.CreatedAt,
-			&s.SenderEmail, &s.RecipientEmail)
-		if err != nil {
+		if err := rows.Scan(&s.Id, &s.Token, &s.DocName, &s.StorageKey, &s.SenderEmail, &s.Expires); err != nil {
 			return nil, err
 		}
 
 		sharedFiles = append(sharedFiles, s)
 	}
 
-	return sharedFiles, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
+	return sharedFiles, nil
 }
 
-func (m *SharedFileModel) GetCreatedFiles(email string) ([]SharedFile, error) {
-	stmt := `SELECT Id, DocName, RecipientName, SenderName, CreatedAt, 
-       SenderEmail, RecipientEmail FROM files WHERE Expires > UTC_TIMESTAMP() AND SenderEmail = ?`
-
-	rows, err := m.DB.Query(stmt, email)
+// list runs a query for files that selects Id, Token, DocName, SenderName, CreatedAt and SenderEmail,
+// and fills in the recipients of each one.
+func (m *SharedFileModel) list(stmt string, args ...any) ([]SharedFile, error) {
+	rows, err := m.DB.Query(stmt, args...)
 	if err != nil {
 		return nil, err
 	}
 
+	defer rows.Close()
+
 	var sharedFiles []SharedFile
 
 	for rows.Next() {
 		var s SharedFile
-		err = rows.Scan(&s.Id, &s.DocName, &s.RecipientName, &s.SenderName, &s.CreatedAt,
-			&s.SenderEmail, &s.RecipientEmail)
+		err = rows.Scan(&s.Id, &s.Token, &s.DocName, &s.SenderName, &s.CreatedAt, &s.SenderEmail)
 		if err != nil {
 			return nil, err
 		}
@@ -168,6 +875,57 @@ func (m *SharedFileModel) GetCreatedFiles(email string) ([]SharedFile, error) {
 		sharedFiles = append(sharedFiles, s)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := m.addRecipients(sharedFiles); err != nil {
+		return nil, err
+	}
+
 	return sharedFiles, nil
+}
+
+// addRecipients loads the recipients of all the files in one query.
+func (m *SharedFileModel) addRecipients(files []SharedFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	index := map[int]int{}
+	args := make([]any, len(files))
+
+	for i, f := range files {
+		index[f.Id] = i
+		args[i] = f.Id
+	}
+
+	stmt := `SELECT FileId, Name, Email, Downloads, DownloadedAt FROM file_recipients
+       WHERE FileId IN (?` + strings.Repeat(", ?", len(files)-1) + `) ORDER BY Name`
+
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			fileId       int
+			r            Recipient
+			downloadedAt sql.NullTime
+		)
+
+		if err = rows.Scan(&fileId, &r.Name, &r.Email, &r.Downloads, &downloadedAt); err != nil {
+			return err
+		}
+
+		r.DownloadedAt = downloadedAt.Time
+
+		i := index[fileId]
+		files[i].Recipients = append(files[i].Recipients, r)
+	}
 
+	return rows.Err()
 }
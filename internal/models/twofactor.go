@@ -0,0 +1,215 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+type TwoFactorModelInterface interface {
+	Get(userId int) (TwoFactor, error)
+	Enable(userId int, secret string, step int64) ([]string, error)
+	Disable(userId int) error
+	UseStep(userId int, step int64) error
+	UseRecoveryCode(userId int, code string) error
+	NewRecoveryCodes(userId int) ([]string, error)
+}
+
+// TwoFactor is someone's second factor, the secret their authenticator app makes codes from.
+// LastStep is the time step of the last code they used, a code can't be used twice. RecoveryCodes
+// is how many of their recovery codes are left.
+type TwoFactor struct {
+	UserId        int
+	Secret        string
+	LastStep      int64
+	RecoveryCodes int
+}
+
+// recoveryCodeCount is how many recovery codes someone gets at a time.
+const recoveryCodeCount = 10
+
+// TwoFactorModel keeps the TOTP secrets of those that have turned on two-factor, and their recovery
+// codes for when they don't have their authenticator app. Like magic link tokens, only a SHA-256
+// hash of each recovery code is stored and each one can only be used once.
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Get returns the user's second factor, ErrNoRecord if they haven't turned it on.
+func (m *TwoFactorModel) Get(userId int) (TwoFactor, error) {
+	stmt := `SELECT t.UserId, t.Secret, t.LastStep, (SELECT COUNT(*) FROM recovery_codes r WHERE r.UserId = t.UserId)
+       FROM two_factor t WHERE t.UserId = ?`
+
+	var t TwoFactor
+
+	err := m.DB.QueryRow(stmt, userId).Scan(&t.UserId, &t.Secret, &t.LastStep, &t.RecoveryCodes)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TwoFactor{}, ErrNoRecord
+		}
+		return TwoFactor{}, err
+	}
+
+	return t, nil
+}
+
+// Enable turns on two-factor for the user with secret, once they've shown they have it set up with
+// the code for step. Any they had before is replaced. It returns their new recovery codes, which
+// can't be got back later.
+func (m *TwoFactorModel) Enable(userId int, secret string, step int64) ([]string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO two_factor (UserId, Secret, LastStep, CreatedAt) VALUES (?, ?, ?, UTC_TIMESTAMP())
+ON DUPLICATE KEY UPDATE Secret = VALUES(Secret), LastStep = VALUES(LastStep), CreatedAt = VALUES(CreatedAt)`
+
+	if _, err = tx.Exec(stmt, userId, secret, step); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// Disable turns off two-factor for the user, their recovery codes go with it.
+func (m *TwoFactorModel) Disable(userId int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE UserId = ?`, userId); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM two_factor WHERE UserId = ?`, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records that the user has used the code for step. A code for the same step or an earlier
+// one than the last they used gives ErrCodeUsed, so a code someone has seen over their shoulder is
+// no good to them.
+func (m *TwoFactorModel) UseStep(userId int, step int64) error {
+	stmt := `UPDATE two_factor SET LastStep = ? WHERE UserId = ? AND LastStep < ?`
+
+	result, err := m.DB.Exec(stmt, step, userId, step)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrCodeUsed
+	}
+
+	return nil
+}
+
+// UseRecoveryCode uses up one of the user's recovery codes, ErrNoRecord if it isn't one of theirs
+// or has been used already.
+func (m *TwoFactorModel) UseRecoveryCode(userId int, code string) error {
+	stmt := `DELETE FROM recovery_codes WHERE UserId = ? AND CodeHash = ?`
+
+	result, err := m.DB.Exec(stmt, userId, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// NewRecoveryCodes replaces the user's recovery codes with new ones and returns them.
+func (m *TwoFactorModel) NewRecoveryCodes(userId int) ([]string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// replaceRecoveryCodes makes new recovery codes for the user as part of tx, the old ones stop
+// working.
+func replaceRecoveryCodes(tx *sql.Tx, userId int) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE UserId = ?`, userId); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = tx.Exec(`INSERT INTO recovery_codes (UserId, CodeHash) VALUES (?, ?)`,
+			userId, hashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+
+		codes[i] = code
+	}
+
+	return codes, nil
+}
+
+// newRecoveryCode returns a random recovery code, 50 bits in lower case base32 (which leaves out 0, 1
+// and 8 so they can't be mistaken for letters) as two groups of five like "k7p2m-x4wqa".
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+
+	return code[:5] + "-" + code[5:], nil
+}
+
+// NormalizeRecoveryCode is a recovery code the way it's stored, whatever case it's typed in and with
+// or without the dash and spaces.
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(NormalizeRecoveryCode(code)))
+	return hash[:]
+}
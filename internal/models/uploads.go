@@ -0,0 +1,191 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type UploadModelInterface interface {
+	Insert(upload Upload) error
+	Get(id string) (Upload, error)
+	AddPart(id string, part UploadPart) error
+	Parts(id string) ([]UploadPart, error)
+	Remove(id string) error
+	Expired(ttl time.Duration) ([]Upload, error)
+}
+
+// Upload is a resumable upload that is still in progress, it holds everything from the create form
+// so the files row can be made once the last chunk arrives. With more than one recipient their names
+// and emails are kept as comma separated lists.
+type Upload struct {
+	Id             string
+	UserId         int
+	Length         int64
+	Offset         int64
+	DocName        string
+	SenderName     string
+	SenderEmail    string
+	RecipientName  string
+	RecipientEmail string
+	MaxDownloads   int
+	Expires        int
+	CreatedAt      time.Time
+}
+
+// UploadPart is one chunk of an upload, stored encrypted in the storage backend like any other file.
+type UploadPart struct {
+	Offset     int64
+	Size       int64
+	StorageKey string
+	WrappedKey []byte
+}
+
+type UploadModel struct {
+	DB *sql.DB
+}
+
+func (m *UploadModel) Insert(upload Upload) error {
+	stmt := `INSERT INTO uploads (Id, UserId, UploadLength, UploadOffset, DocName, SenderName, SenderEmail,
+                     RecipientName, RecipientEmail, MaxDownloads, Expires, CreatedAt)
+VALUES (?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())`
+
+	_, err := m.DB.Exec(stmt, upload.Id, upload.UserId, upload.Length, upload.DocName, upload.SenderName,
+		upload.SenderEmail, upload.RecipientName, upload.RecipientEmail, upload.MaxDownloads, upload.Expires)
+
+	return err
+}
+
+func (m *UploadModel) Get(id string) (Upload, error) {
+	stmt := `SELECT Id, UserId, UploadLength, UploadOffset, DocName, SenderName, SenderEmail, RecipientName,
+       RecipientEmail, MaxDownloads, Expires, CreatedAt FROM uploads WHERE Id = ?`
+
+	var u Upload
+
+	err := m.DB.QueryRow(stmt, id).Scan(&u.Id, &u.UserId, &u.Length, &u.Offset, &u.DocName, &u.SenderName,
+		&u.SenderEmail, &u.RecipientName, &u.RecipientEmail, &u.MaxDownloads, &u.Expires,
+		&u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Upload{}, ErrNoRecord
+		} else {
+			return Upload{}, err
+		}
+	}
+
+	return u, nil
+}
+
+// AddPart records a stored chunk and moves the upload offset past it. The part has to start at the
+// current offset and fit in the upload, otherwise ErrUploadOffset is returned and nothing changes,
+// that way two requests racing with the same chunk can't both be counted.
+func (m *UploadModel) AddPart(id string, part UploadPart) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	stmt := `UPDATE uploads SET UploadOffset = UploadOffset + ?
+               WHERE Id = ? AND UploadOffset = ? AND UploadOffset + ? <= UploadLength`
+
+	result, err := tx.Exec(stmt, part.Size, id, part.Offset, part.Size)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUploadOffset
+	}
+
+	stmt = `INSERT INTO upload_parts (UploadId, PartOffset, Size, StorageKey, WrappedKey) VALUES (?, ?, ?, ?, ?)`
+
+	if _, err = tx.Exec(stmt, id, part.Offset, part.Size, part.StorageKey, part.WrappedKey); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *UploadModel) Parts(id string) ([]UploadPart, error) {
+	stmt := `SELECT PartOffset, Size, StorageKey, WrappedKey FROM upload_parts WHERE UploadId = ? ORDER BY PartOffset`
+
+	rows, err := m.DB.Query(stmt, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var parts []UploadPart
+
+	for rows.Next() {
+		var p UploadPart
+		if err = rows.Scan(&p.Offset, &p.Size, &p.StorageKey, &p.WrappedKey); err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// Remove deletes the upload, its parts go with it through the foreign key.
+func (m *UploadModel) Remove(id string) error {
+	result, err := m.DB.Exec(`DELETE FROM uploads WHERE Id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// Expired returns the uploads that were started more than ttl ago, finished or not. Removing them and
+// their stored parts is left to the caller.
+func (m *UploadModel) Expired(ttl time.Duration) ([]Upload, error) {
+	stmt := `SELECT Id, UserId, UploadLength, UploadOffset, DocName, SenderName, SenderEmail, RecipientName,
+       RecipientEmail, MaxDownloads, Expires, CreatedAt FROM uploads
+       WHERE CreatedAt <= DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? SECOND) ORDER BY CreatedAt`
+
+	rows, err := m.DB.Query(stmt, int(ttl.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var uploads []Upload
+
+	for rows.Next() {
+		var u Upload
+		err = rows.Scan(&u.Id, &u.UserId, &u.Length, &u.Offset, &u.DocName, &u.SenderName, &u.SenderEmail,
+			&u.RecipientName, &u.RecipientEmail, &u.MaxDownloads, &u.Expires, &u.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		uploads = append(uploads, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return uploads, nil
+}
@@ -17,10 +17,22 @@ type UserModelInterface interface {
 	Exists(id int) (exist bool, admin bool, user bool, guest bool, disabled bool, error error)
 	GetAllUsers() ([]User, error)
 	Get(id int) (User, error)
+	GetByEmail(email string) (User, error)
 	UpdateUser(id int, name, email, password string, admin, user, guest bool) (User, error)
 	DeleteUser(id int) error
+	SetNotifyDownloads(id int, notify bool) error
+	SetRoles(id int, admin, user, guest bool) error
+	SetPassword(id int, password string) error
+	SetSource(id int, source string) error
 }
 
+// Where an account is managed, see User.Source.
+const (
+	SourceLocal = ""
+	SourceSSO   = "sso"
+	SourceLDAP  = "ldap"
+)
+
 type User struct {
 	ID             int
 	Name           string
@@ -31,10 +43,17 @@ type User struct {
 	User           bool
 	Guest          bool
 	Disabled       bool
+	// NotifyDownloads is whether they get an email when someone downloads a file they sent.
+	NotifyDownloads bool
+	// Source is where the account is managed, SourceLocal for one with a password here. Any other
+	// account can only be signed in to through where it's managed.
+	Source string
 }
 
 type UserModel struct {
 	DB *sql.DB
+	// Authenticators are tried before the passwords in the users table, see AuthenticateChain.
+	Authenticators []Authenticator
 }
 
 // Insert The usual user page sign-up no admins can be created this way explicitly declaring it false
@@ -70,15 +89,21 @@ func (m *UserModel) Insert(name, email, password string, admin, user, guest, dis
 	return nil
 }
 
+// Authenticate checks the password with the directories in Authenticators, then the users table.
 func (m *UserModel) Authenticate(email, password string) (int, error) {
+	return AuthenticateChain(m, m.Authenticators, email, password, m.authenticatePassword)
+}
+
+func (m *UserModel) authenticatePassword(email, password string) (int, error) {
 	// Retrieve the id and hashed password associated with the given email. If
 	// no matching email exists we return the ErrInvalidCredentials error.
 	var id int
 	var hashedPassword []byte
+	var source string
 
-	stmt := "SELECT id, hashed_password FROM users WHERE email = ?"
+	stmt := "SELECT id, hashed_password, source FROM users WHERE email = ?"
 
-	err := m.DB.QueryRow(stmt, email).Scan(&id, &hashedPassword)
+	err := m.DB.QueryRow(stmt, email).Scan(&id, &hashedPassword, &source)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return 0, ErrInvalidCredentials
@@ -87,6 +112,12 @@ func (m *UserModel) Authenticate(email, password string) (int, error) {
 		}
 	}
 
+	// Whatever password is kept for an account managed somewhere else doesn't count, turning it off
+	// there has to keep them out.
+	if source != SourceLocal {
+		return 0, ErrInvalidCredentials
+	}
+
 	// Check whether the hashed password and plain-text password provided match.
 	// If they don't, we return the ErrInvalidCredentials error.
 	// We want to return the same error so that someone can't mine
@@ -167,12 +198,13 @@ func (m *UserModel) GetAllUsers() ([]User, error) {
 }
 
 func (m *UserModel) Get(id int) (User, error) {
-	stmt := `SELECT id, name, email, created, admin, user, guest, disabled FROM users WHERE id = ?`
+	stmt := `SELECT id, name, email, created, admin, user, guest, disabled, notify_downloads, source FROM users
+    WHERE id = ?`
 
 	var u User
 
 	err := m.DB.QueryRow(stmt, id).Scan(&u.ID, &u.Name, &u.Email, &u.Created,
-		&u.Admin, &u.User, &u.Guest, &u.Disabled)
+		&u.Admin, &u.User, &u.Guest, &u.Disabled, &u.NotifyDownloads, &u.Source)
 
 	if err != nil {
 		// If the query returns no rows, then row.Scan() will return a
@@ -189,6 +221,25 @@ func (m *UserModel) Get(id int) (User, error) {
 	return u, nil
 }
 
+func (m *UserModel) GetByEmail(email string) (User, error) {
+	stmt := `SELECT id, name, email, created, admin, user, guest, disabled, notify_downloads, source FROM users
+    WHERE email = ?`
+
+	var u User
+
+	err := m.DB.QueryRow(stmt, email).Scan(&u.ID, &u.Name, &u.Email, &u.Created,
+		&u.Admin, &u.User, &u.Guest, &u.Disabled, &u.NotifyDownloads, &u.Source)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, ErrNoRecord
+		} else {
+			return User{}, err
+		}
+	}
+
+	return u, nil
+}
+
 func (m *UserModel) UpdateUser(id int, name, email, password string, admin, user, guest bool) (User, error) {
 	var usr User
 
@@ -231,6 +282,44 @@ func (m *UserModel) DeleteUser(id int) error {
 	return nil
 }
 
+// SetNotifyDownloads turns the emails about downloads of the user's files on or off.
+func (m *UserModel) SetNotifyDownloads(id int, notify bool) error {
+	stmt := `UPDATE users SET notify_downloads = ? WHERE id = ?`
+	_, err := m.DB.Exec(stmt, notify, id)
+
+	return err
+}
+
+// SetRoles changes what the user is without touching anything else, for when it's decided somewhere
+// else like single sign-on.
+func (m *UserModel) SetRoles(id int, admin, user, guest bool) error {
+	stmt := `UPDATE users SET admin = ?, user = ?, guest = ? WHERE id = ?`
+	_, err := m.DB.Exec(stmt, admin, user, guest, id)
+
+	return err
+}
+
+// SetPassword changes the user's password and nothing else.
+func (m *UserModel) SetPassword(id int, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET hashed_password = ? WHERE id = ?`
+	_, err = m.DB.Exec(stmt, hashedPassword, id)
+
+	return err
+}
+
+// SetSource changes where the account is managed, see User.Source.
+func (m *UserModel) SetSource(id int, source string) error {
+	stmt := `UPDATE users SET source = ? WHERE id = ?`
+	_, err := m.DB.Exec(stmt, source, id)
+
+	return err
+}
+
 func hashPassword(password string) ([]byte, error) {
 	return bcrypt.GenerateFromPassword([]byte(password), 14)
 }
@@ -0,0 +1,166 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultTimeout is how long Clamd waits on clamd for any one step when Timeout isn't set.
+const defaultTimeout = 30 * time.Second
+
+// chunkSize is how much of the content goes to clamd in each INSTREAM chunk.
+const chunkSize = 64 << 10
+
+// Clamd scans content with a ClamAV daemon, streaming it over INSTREAM so clamd doesn't need to be
+// able to see our files. Network is "tcp" or "unix".
+type Clamd struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// NewClamd makes a Clamd from an address like tcp://localhost:3310 or unix:///run/clamav/clamd.ctl,
+// one with no scheme is taken to be TCP.
+func NewClamd(addr string) (*Clamd, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return &Clamd{Network: "unix", Address: strings.TrimPrefix(addr, "unix://")}, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		return &Clamd{Network: "tcp", Address: strings.TrimPrefix(addr, "tcp://")}, nil
+	case strings.Contains(addr, "://"), addr == "":
+		return nil, fmt.Errorf("scanner: unsupported clamd address %q", addr)
+	default:
+		return &Clamd{Network: "tcp", Address: addr}, nil
+	}
+}
+
+// Ping checks that clamd is there and answering.
+func (c *Clamd) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = io.WriteString(conn, "zPING\x00"); err != nil {
+		return err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: clamd answered %q to PING", ErrScanFailed, reply)
+	}
+
+	return nil
+}
+
+func (c *Clamd) Scan(r io.Reader) (Result, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	if _, err = io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+
+	// Each chunk is its length as 4 big endian bytes followed by the data, a zero length ends the
+	// stream. clamd hangs up part way if the content is over its StreamMaxLength, when a write
+	// fails its reply says why.
+	buf := make([]byte, 4+chunkSize)
+
+	var writeErr error
+
+	for writeErr == nil {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			writeErr = c.write(conn, buf[:4+n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	if writeErr == nil {
+		writeErr = c.write(conn, []byte{0, 0, 0, 0})
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		if writeErr != nil {
+			return Result{}, writeErr
+		}
+		return Result{}, err
+	}
+
+	return parseReply(reply)
+}
+
+func (c *Clamd) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	// Whole scans can take a while, the deadline is pushed back as each chunk goes
+	if err = conn.SetDeadline(time.Now().Add(c.timeout())); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *Clamd) write(conn net.Conn, b []byte) error {
+	if err := conn.SetDeadline(time.Now().Add(c.timeout())); err != nil {
+		return err
+	}
+
+	_, err := conn.Write(b)
+	return err
+}
+
+func (c *Clamd) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+// readReply reads one reply to a z command, they end with a NUL.
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+// parseReply makes sense of clamd's answer to INSTREAM, which is "stream: OK", "stream: <signature>
+// FOUND" or something ending in ERROR.
+func parseReply(reply string) (Result, error) {
+	status := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("%w: %s", ErrScanFailed, reply)
+	}
+}
@@ -0,0 +1,235 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	//Internal
+	"fileshare/internal/assert"
+)
+
+// eicar is the standard antivirus test file, every scanner reports it and it does no harm.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd is just enough of clamd to answer PING and INSTREAM. It finds the EICAR test string and
+// nothing else, and like the real thing gives up on streams over maxLength.
+type fakeClamd struct {
+	listener  net.Listener
+	maxLength int
+}
+
+func newFakeClamd(t *testing.T, network, address string) *fakeClamd {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeClamd{listener: l, maxLength: 1 << 20}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	cmd, err := br.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case "zPING\x00":
+		io.WriteString(conn, "PONG\x00")
+	case "zINSTREAM\x00":
+		var content bytes.Buffer
+
+		for {
+			var size uint32
+			if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+
+			if content.Len()+int(size) > f.maxLength {
+				// Hanging up straight away can lose the reply to a reset, so let the client finish
+				io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+				io.Copy(io.Discard, br)
+				return
+			}
+
+			if _, err := io.CopyN(&content, br, int64(size)); err != nil {
+				return
+			}
+		}
+
+		if bytes.Contains(content.Bytes(), []byte(eicar)) {
+			io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+		} else {
+			io.WriteString(conn, "stream: OK\x00")
+		}
+	default:
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	tcp := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	unix := newFakeClamd(t, "unix", filepath.Join(t.TempDir(), "clamd.sock"))
+
+	scanners := map[string]*Clamd{
+		"TCP":  {Network: "tcp", Address: tcp.listener.Addr().String()},
+		"Unix": {Network: "unix", Address: unix.listener.Addr().String()},
+	}
+
+	tests := []struct {
+		name          string
+		content       string
+		wantSignature string
+		wantErr       bool
+	}{
+		{
+			name:    "Clean",
+			content: "just some text",
+		},
+		{
+			name:    "Empty",
+			content: "",
+		},
+		{
+			name:          "Infected",
+			content:       "some text then " + eicar,
+			wantSignature: "Eicar-Test-Signature",
+		},
+		{
+			name:          "Infected Across Chunks",
+			content:       strings.Repeat("a", chunkSize-10) + eicar,
+			wantSignature: "Eicar-Test-Signature",
+		},
+		{
+			name:    "Too Big",
+			content: strings.Repeat("a", 3<<20),
+			wantErr: true,
+		},
+	}
+
+	for name, c := range scanners {
+		if err := c.Ping(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for _, tt := range tests {
+			t.Run(name+" "+tt.name, func(t *testing.T) {
+				result, err := c.Scan(strings.NewReader(tt.content))
+				if tt.wantErr {
+					assert.Equal(t, err != nil, true)
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				assert.Equal(t, result.Signature, tt.wantSignature)
+				assert.Equal(t, result.Infected(), tt.wantSignature != "")
+			})
+		}
+	}
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	fake := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	c := &Clamd{Network: "tcp", Address: fake.listener.Addr().String()}
+
+	_, err := c.Scan(strings.NewReader(strings.Repeat("a", 2<<20)))
+	assert.Equal(t, errors.Is(err, ErrScanFailed), true)
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := &Clamd{Network: "tcp", Address: addr}
+
+	_, err = c.Scan(strings.NewReader("anything"))
+	assert.Equal(t, err != nil, true)
+}
+
+func TestNewClamd(t *testing.T) {
+	tests := []struct {
+		name        string
+		addr        string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{
+			name:        "TCP",
+			addr:        "tcp://localhost:3310",
+			wantNetwork: "tcp",
+			wantAddress: "localhost:3310",
+		},
+		{
+			name:        "Unix",
+			addr:        "unix:///run/clamav/clamd.ctl",
+			wantNetwork: "unix",
+			wantAddress: "/run/clamav/clamd.ctl",
+		},
+		{
+			name:        "No Scheme",
+			addr:        "clamav:3310",
+			wantNetwork: "tcp",
+			wantAddress: "clamav:3310",
+		},
+		{
+			name:    "Other Scheme",
+			addr:    "http://localhost:3310",
+			wantErr: true,
+		},
+		{
+			name:    "Empty",
+			addr:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClamd(tt.addr)
+			if tt.wantErr {
+				assert.Equal(t, err != nil, true)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, c.Network, tt.wantNetwork)
+			assert.Equal(t, c.Address, tt.wantAddress)
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package scanner
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrScanFailed = errors.New("scanner: scan failed")
+
+// Scanner is the interface every virus scanner we can check uploads with has to implement. Scan
+// reads r to the end, or until it gives up with an error.
+type Scanner interface {
+	Scan(r io.Reader) (Result, error)
+}
+
+// Result is what a scanner made of some content, Signature names what was found in it and is blank
+// when it's clean.
+type Result struct {
+	Signature string
+}
+
+// Infected reports whether the scanner found something.
+func (r Result) Infected() bool {
+	return r.Signature != ""
+}
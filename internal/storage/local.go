@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	//External
+	"github.com/google/safeopen"
+)
+
+// LocalBackend keeps files on the local disk beneath Dir, this is what a single
+// node install uses.
+type LocalBackend struct {
+	Dir string
+}
+
+func (b *LocalBackend) Put(key string, r io.Reader) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	if err := os.MkdirAll(filepath.Join(b.Dir, filepath.Dir(filepath.FromSlash(key))), 0o750); err != nil {
+		return err
+	}
+
+	f, err := safeopen.CreateBeneath(b.Dir, filepath.FromSlash(key))
+	if err != nil {
+		return err
+	}
+
+	// Don't leave half a file behind if the copy fails part way, e.g. the client went away.
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	return f.Close()
+}
+
+func (b *LocalBackend) Open(key string) (io.ReadSeekCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	f, err := safeopen.OpenBeneath(b.Dir, filepath.FromSlash(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (b *LocalBackend) Stat(key string) (ObjectInfo, error) {
+	if !validKey(key) {
+		return ObjectInfo{}, ErrInvalidKey
+	}
+
+	fi, err := os.Stat(filepath.Join(b.Dir, filepath.FromSlash(key)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (b *LocalBackend) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	err := os.Remove(filepath.Join(b.Dir, filepath.FromSlash(key)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (b *LocalBackend) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(b.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A missing upload directory just means nothing has been stored yet.
+			if errors.Is(err, fs.ErrNotExist) && path == b.Dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+// validKey makes sure a key can't be used to walk outside the storage root.
+func validKey(key string) bool {
+	return key != "" && filepath.IsLocal(filepath.FromSlash(key))
+}
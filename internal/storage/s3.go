@@ -0,0 +1,519 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPartSize is used for multipart uploads when PartSize isn't set, S3
+// won't accept parts (other than the last one) smaller than 5MB.
+const defaultPartSize = 8 << 20
+
+// S3Backend stores files in an S3 compatible bucket (AWS, MinIO, Ceph...) so that
+// several web nodes can share the same uploads. Requests use path style
+// addressing and are signed with AWS Signature Version 4.
+//
+// Timeout is how long any one request can take, apart from reading an object which can take as long
+// as the download does, so it has to go on each request rather than on Client.
+type S3Backend struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PartSize  int
+	Timeout   time.Duration
+	Client    *http.Client
+}
+
+func (b *S3Backend) Put(key string, r io.Reader) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	// Read the first part, if the whole file fits in it we can skip the
+	// multipart dance and do a single PUT.
+	buf := make([]byte, b.partSize())
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		ctx, cancel := b.context()
+		defer cancel()
+
+		resp, err := b.do(ctx, http.MethodPut, key, nil, buf[:n], nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return s3Error(resp)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return b.putMultipart(key, buf, r)
+}
+
+func (b *S3Backend) putMultipart(key string, buf []byte, r io.Reader) error {
+	var initiated struct {
+		UploadId string
+	}
+
+	if err := b.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &initiated); err != nil {
+		return err
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+
+	var (
+		parts    []part
+		uploadId = initiated.UploadId
+		n        = len(buf)
+	)
+
+	for number := 1; n > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+
+		etag, err := b.putPart(key, query, buf[:n])
+		if err != nil {
+			b.abortMultipart(key, uploadId)
+			return err
+		}
+
+		parts = append(parts, part{PartNumber: number, ETag: etag})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			b.abortMultipart(key, uploadId)
+			return err
+		}
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		b.abortMultipart(key, uploadId)
+		return err
+	}
+
+	if err := b.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, complete, nil); err != nil {
+		b.abortMultipart(key, uploadId)
+		return err
+	}
+
+	return nil
+}
+
+// putPart sends one part of a multipart upload and returns its ETag.
+func (b *S3Backend) putPart(key string, query url.Values, payload []byte) (string, error) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	resp, err := b.do(ctx, http.MethodPut, key, query, payload, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp)
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// abortMultipart is best effort, if it fails the bucket lifecycle rules have to
+// clean up the parts.
+func (b *S3Backend) abortMultipart(key, uploadId string) {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	resp, err := b.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (b *S3Backend) Open(key string) (io.ReadSeekCloser, error) {
+	info, err := b.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{b: b, key: key, size: info.Size}, nil
+}
+
+func (b *S3Backend) Stat(key string) (ObjectInfo, error) {
+	if !validKey(key) {
+		return ObjectInfo{}, ErrInvalidKey
+	}
+
+	ctx, cancel := b.context()
+	defer cancel()
+
+	resp, err := b.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, ErrNotFound
+	default:
+		return ObjectInfo{}, s3Error(resp)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (b *S3Backend) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	ctx, cancel := b.context()
+	defer cancel()
+
+	resp, err := b.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error(resp)
+	}
+}
+
+func (b *S3Backend) List(prefix string) ([]ObjectInfo, error) {
+	var (
+		objects []ObjectInfo
+		token   string
+	)
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+
+		if err := b.doXML(http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return objects, nil
+}
+
+func (b *S3Backend) partSize() int {
+	if b.PartSize > 0 {
+		return b.PartSize
+	}
+	return defaultPartSize
+}
+
+// context is for a request that has to be done within Timeout, if there is one.
+func (b *S3Backend) context() (context.Context, context.CancelFunc) {
+	if b.Timeout > 0 {
+		return context.WithTimeout(context.Background(), b.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (b *S3Backend) client() *http.Client {
+	if b.Client != nil {
+		return b.Client
+	}
+	return http.DefaultClient
+}
+
+// doXML sends the request and decodes an XML response into dst (if it isn't
+// nil). S3 can answer a CompleteMultipartUpload with a 200 and an <Error> body,
+// so we check for that too.
+func (b *S3Backend) doXML(method, key string, query url.Values, payload []byte, dst any) error {
+	ctx, cancel := b.context()
+	defer cancel()
+
+	resp, err := b.do(ctx, method, key, query, payload, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("storage: s3 %s %s: %s", method, key, body)
+	}
+
+	if dst == nil {
+		return nil
+	}
+
+	return xml.Unmarshal(body, dst)
+}
+
+// do builds, signs and sends a request for key (or the bucket itself when key is
+// empty), ctx has to last until the body has been read.
+func (b *S3Backend) do(ctx context.Context, method, key string, query url.Values, payload []byte, header http.Header) (*http.Response, error) {
+	path := "/" + awsEscape(b.Bucket, false)
+	if key != "" {
+		path += "/" + awsEscape(key, true)
+	}
+
+	rawQuery := canonicalQuery(query)
+
+	u, err := url.Parse(strings.TrimRight(b.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.RawPath = u.EscapedPath() + path
+	u.Path, err = url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = rawQuery
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	b.sign(req, u.EscapedPath(), rawQuery, payload, time.Now())
+
+	return b.client().Do(req)
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (b *S3Backend) sign(req *http.Request, path, rawQuery string, payload []byte, now time.Time) {
+	var (
+		amzDate     = now.UTC().Format("20060102T150405Z")
+		date        = amzDate[:8]
+		scope       = date + "/" + b.Region + "/s3/aws4_request"
+		payloadHash = sha256Hex(payload)
+	)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, rawQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretKey), date)
+	key = hmacSHA256(key, b.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+// s3Object is a lazy reader over an object, every seek that moves the offset
+// drops the open body and the next read starts a new ranged GET. That is what
+// lets http.ServeContent answer range requests straight from the bucket.
+type s3Object struct {
+	b      *S3Backend
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+
+		// The body is read for as long as the download takes, so this one isn't limited by Timeout
+		resp, err := o.b.do(context.Background(), http.MethodGet, o.key, nil, nil, header)
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return 0, s3Error(resp)
+		}
+
+		// A server that ignores the range sends the whole object, which is only right from the start.
+		if resp.StatusCode == http.StatusOK && o.offset > 0 {
+			resp.Body.Close()
+			return 0, fmt.Errorf("storage: range from %d of %s ignored", o.offset, o.key)
+		}
+
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+
+	if errors.Is(err, io.EOF) && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+
+	if abs != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("storage: s3 %s %s: %s %s", resp.Request.Method, resp.Request.URL.Path,
+		resp.Status, bytes.TrimSpace(body))
+}
+
+// canonicalQuery encodes the query sorted by key the way SigV4 expects, we use
+// the same string on the wire so there is nothing to get out of sync.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent encodes everything but the RFC 3986 unreserved characters,
+// optionally leaving slashes alone for object keys.
+func awsEscape(s string, keepSlash bool) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+
+	return sb.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("storage: object not found")
+	ErrInvalidKey = errors.New("storage: invalid object key")
+)
+
+// Backend is the interface every place we keep uploaded files has to implement.
+// Keys are slash separated relative paths, e.g. "report.pdf" or "parts/abc/0001".
+type Backend interface {
+	Put(key string, r io.Reader) error
+	Open(key string) (io.ReadSeekCloser, error)
+	Stat(key string) (ObjectInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// NewKey returns a random key for a new object. Keys never depend on the name
+// the user uploaded the file with, so two uploads can't clobber each other.
+func NewKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
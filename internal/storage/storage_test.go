@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+)
+
+// fakeS3 is a tiny in memory stand-in for MinIO, it only knows about a single
+// bucket and the handful of calls S3Backend makes.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-access/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		http.Error(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+
+	if r.URL.Path == "/"+f.bucket {
+		f.list(w, query.Get("prefix"))
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+
+		var object []byte
+		for _, n := range numbers {
+			object = append(object, parts[n]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+
+	case r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+
+	case r.Method == http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var start int
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(object[start:])
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+	}
+
+	var result struct {
+		XMLName  xml.Name  `xml:"ListBucketResult"`
+		Contents []content `xml:"Contents"`
+	}
+
+	for k, v := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			result.Contents = append(result.Contents, content{Key: k, Size: len(v), LastModified: time.Now()})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3(t *testing.T) *S3Backend {
+	srv := httptest.NewServer(newFakeS3("uploads"))
+	t.Cleanup(srv.Close)
+
+	return &S3Backend{
+		Endpoint:  srv.URL,
+		Bucket:    "uploads",
+		Region:    "us-east-1",
+		AccessKey: "test-access",
+		SecretKey: "test-secret",
+		PartSize:  16,
+		Client:    srv.Client(),
+	}
+}
+
+func TestBackends(t *testing.T) {
+	backends := map[string]Backend{
+		"Local": &LocalBackend{Dir: t.TempDir()},
+		"S3":    newTestS3(t),
+	}
+
+	// Longer than the test PartSize so the S3 backend has to go multipart.
+	content := "The quick brown fox jumps over the lazy dog"
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			if err := b.Put("docs/fox.txt", strings.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Put("small.txt", strings.NewReader("tiny")); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := b.Stat("docs/fox.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, info.Size, int64(len(content)))
+
+			f, err := b.Open("docs/fox.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			// Jump into the middle of the object, the same way http.ServeContent
+			// does for a range request.
+			if _, err := f.Seek(16, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, string(got), content[16:])
+
+			objects, err := b.List("docs/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, len(objects), 1)
+			assert.Equal(t, objects[0].Key, "docs/fox.txt")
+
+			if err := b.Delete("docs/fox.txt"); err != nil {
+				t.Fatal(err)
+			}
+			_, err = b.Stat("docs/fox.txt")
+			assert.Equal(t, errors.Is(err, ErrNotFound), true)
+
+			_, err = b.Open("missing.txt")
+			assert.Equal(t, errors.Is(err, ErrNotFound), true)
+
+			err = b.Put("../escape.txt", bytes.NewReader(nil))
+			assert.Equal(t, errors.Is(err, ErrInvalidKey), true)
+		})
+	}
+}
+
+func TestS3Timeout(t *testing.T) {
+	fake := newFakeS3("uploads")
+	fake.objects["slow.txt"] = []byte("The quick brown fox jumps over the lazy dog")
+
+	// The object trickles out over longer than the timeout, and asking about missing.txt takes
+	// longer than it too.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/slow.txt"):
+			w.WriteHeader(http.StatusPartialContent)
+			for _, c := range fake.objects["slow.txt"] {
+				w.Write([]byte{c})
+				w.(http.Flusher).Flush()
+				time.Sleep(5 * time.Millisecond)
+			}
+		case strings.HasSuffix(r.URL.Path, "/missing.txt"):
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			fake.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	b := &S3Backend{
+		Endpoint:  srv.URL,
+		Bucket:    "uploads",
+		Region:    "us-east-1",
+		AccessKey: "test-access",
+		SecretKey: "test-secret",
+		Timeout:   50 * time.Millisecond,
+		Client:    srv.Client(),
+	}
+
+	f, err := b.Open("slow.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(got), "The quick brown fox jumps over the lazy dog")
+
+	_, err = b.Stat("missing.txt")
+	assert.Equal(t, errors.Is(err, context.DeadlineExceeded), true)
+}
+
+func TestS3RangeIgnored(t *testing.T) {
+	fake := newFakeS3("uploads")
+	fake.objects["file.txt"] = []byte("The quick brown fox jumps over the lazy dog")
+
+	// A server that always sends the whole object, whatever range is asked for.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			r.Header.Del("Range")
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	b := &S3Backend{
+		Endpoint:  srv.URL,
+		Bucket:    "uploads",
+		Region:    "us-east-1",
+		AccessKey: "test-access",
+		SecretKey: "test-secret",
+		Client:    srv.Client(),
+	}
+
+	f, err := b.Open("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// From the start the whole object is what's wanted.
+	got, err := io.ReadAll(f)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(got), "The quick brown fox jumps over the lazy dog")
+
+	// From anywhere else it isn't, rather than the start of the file passed off as the middle.
+	if _, err = f.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.ReadAll(f)
+	assert.StringContains(t, fmt.Sprint(err), "range from 4 of file.txt ignored")
+}
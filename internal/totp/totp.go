@@ -0,0 +1,141 @@
+// Package totp makes and checks the time-based one-time passwords (RFC 6238) that authenticator
+// apps show, six digits that change every 30 seconds. Each code is an HMAC-SHA1 of how many 30
+// second periods have gone by since 1970, keyed with a secret shared with the app when it's set up,
+// usually by scanning a QR code of the URI from URI.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is how long a code is.
+	Digits = 6
+	// Period is how long a code lasts.
+	Period = 30 * time.Second
+	// Skew is how many periods either side of now a code is still taken for, to allow for clocks
+	// that are a little out and for the time it takes to type one in.
+	Skew = 1
+)
+
+// secretSize is the size of a new secret, 160 bits as RFC 4226 recommends for HMAC-SHA1.
+const secretSize = 20
+
+var ErrInvalidSecret = errors.New("totp: invalid secret")
+
+// secretEncoding is how secrets are written down, base32 without padding is what authenticator
+// apps expect.
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret, base32 encoded.
+func NewSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return secretEncoding.EncodeToString(b), nil
+}
+
+// decodeSecret reads a base32 secret, the way people might type one in as well (lower case, with
+// spaces or padding).
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.NewReplacer(" ", "", "-", "", "=", "").Replace(secret))
+
+	key, err := secretEncoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+
+	return key, nil
+}
+
+// Step is the number of the period t is in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, Step(t)), nil
+}
+
+// Validate checks code against secret at time t, allowing for Skew. It returns the step the code
+// was for so the caller can refuse to take the same code, or an older one, twice.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// URI is the otpauth:// URI authenticator apps are set up with, it's what goes in the QR code.
+// issuer is the name of this site and account who the secret is for, both are only shown to the
+// user in the app.
+func URI(issuer, account, secret string) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+	}
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(int(Period/time.Second)))
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// hotp is the HMAC-based one-time password (RFC 4226) for counter.
+func hotp(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, 31 bits from the offset the last nibble gives
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range Digits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, n%mod)
+}
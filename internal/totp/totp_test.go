@@ -0,0 +1,102 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	//Internal
+	"fileshare/internal/assert"
+)
+
+// rfcSecret is the SHA1 secret from the RFC 6238 test vectors, "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The RFC's codes are eight digits, ours are the last six of them.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			code, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+			assert.Equal(t, err, nil)
+			assert.Equal(t, code, tt.want)
+		})
+	}
+
+	// Secrets can be typed in lower case with spaces.
+	code, err := Code(strings.ToLower("GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ"), time.Unix(59, 0))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, code, "287082")
+
+	_, err = Code("not base32!", time.Now())
+	assert.Equal(t, err, ErrInvalidSecret)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	code := func(at time.Time) string {
+		c, err := Code(rfcSecret, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "Now", code: code(now), wantStep: step, wantOK: true},
+		{name: "Last Period", code: code(now.Add(-Period)), wantStep: step - 1, wantOK: true},
+		{name: "Next Period", code: code(now.Add(Period)), wantStep: step + 1, wantOK: true},
+		{name: "Too Old", code: code(now.Add(-2 * Period)), wantOK: false},
+		{name: "Spaces", code: " 050 471 ", wantStep: step, wantOK: true},
+		{name: "Wrong", code: "123456", wantOK: false},
+		{name: "Too Short", code: "05047", wantOK: false},
+		{name: "Blank", code: "", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := Validate(rfcSecret, tt.code, now)
+			assert.Equal(t, ok, tt.wantOK)
+			assert.Equal(t, gotStep, tt.wantStep)
+		})
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(secret), 32)
+
+	other, err := NewSecret()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, secret != other, true)
+
+	// A new secret works straight away.
+	code, err := Code(secret, time.Now())
+	assert.Equal(t, err, nil)
+	_, ok := Validate(secret, code, time.Now())
+	assert.Equal(t, ok, true)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("FileServ", "alice@example.com", rfcSecret)
+	assert.Equal(t, uri, "otpauth://totp/FileServ:alice@example.com?algorithm=SHA1&digits=6&issuer=FileServ&period=30&secret="+rfcSecret)
+}
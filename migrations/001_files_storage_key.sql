@@ -0,0 +1,11 @@
+-- Uploads are now stored under a generated key instead of the name they were
+-- uploaded with. Files that are already on disk were saved under their DocName,
+-- so that becomes their key.
+alter table files
+    add StorageKey varchar(255) null after DocName;
+
+update files
+set StorageKey = DocName;
+
+alter table files
+    modify StorageKey varchar(255) not null;
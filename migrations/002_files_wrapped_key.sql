@@ -0,0 +1,5 @@
+-- Uploads are encrypted at rest with a per-file data key, which is stored here
+-- wrapped with the master key. Files uploaded before this have no key and are
+-- served as they are.
+alter table files
+    add WrappedKey varbinary(128) null after StorageKey;
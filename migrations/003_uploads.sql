@@ -0,0 +1,30 @@
+-- Resumable uploads that are still in progress, and the chunks they have stored
+-- so far. A files row is only made once an upload is complete.
+create table uploads
+(
+    Id             char(32)     not null
+        primary key,
+    UserId         int          not null,
+    UploadLength   bigint       not null,
+    UploadOffset   bigint       not null,
+    DocName        text         not null,
+    SenderName     text         not null,
+    SenderEmail    text         not null,
+    RecipientName  text         not null,
+    RecipientEmail text         not null,
+    Expires        int          not null,
+    CreatedAt      datetime     not null
+);
+
+create table upload_parts
+(
+    UploadId   char(32)       not null,
+    PartOffset bigint         not null,
+    Size       bigint         not null,
+    StorageKey varchar(255)   not null,
+    WrappedKey varbinary(128) not null,
+    primary key (UploadId, PartOffset),
+    constraint upload_parts_uploads_fk
+        foreign key (UploadId) references uploads (Id)
+            on delete cascade
+);
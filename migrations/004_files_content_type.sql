@@ -0,0 +1,4 @@
+-- The type of each file is worked out when it is uploaded so downloads can
+-- send it, older files are served as a plain download.
+alter table files
+    add ContentType varchar(255) not null default 'application/octet-stream' after WrappedKey;
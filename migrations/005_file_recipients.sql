@@ -0,0 +1,26 @@
+-- A file can be shared with any number of people, each one gets a row here
+-- that also keeps track of whether they have downloaded it. Existing files
+-- move their one recipient over.
+create table file_recipients
+(
+    FileId       int          not null,
+    Name         text         not null,
+    Email        varchar(255) not null,
+    Downloads    int          not null default 0,
+    DownloadedAt datetime     null,
+    primary key (FileId, Email),
+    constraint file_recipients_files_fk
+        foreign key (FileId) references files (Id)
+            on delete cascade
+);
+
+create index file_recipients_email_idx
+    on file_recipients (Email);
+
+insert into file_recipients (FileId, Name, Email)
+select Id, RecipientName, RecipientEmail
+from files;
+
+alter table files
+    drop column RecipientName,
+    drop column RecipientEmail;
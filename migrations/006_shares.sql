@@ -0,0 +1,14 @@
+-- Files uploaded together are grouped into a share, so they can be looked at
+-- and downloaded as one. A file sent on its own has no share.
+create table shares
+(
+    Id        int auto_increment
+        primary key,
+    CreatedAt datetime not null
+);
+
+alter table files
+    add ShareId int null after Id,
+    add constraint files_shares_fk
+        foreign key (ShareId) references shares (Id)
+            on delete set null;
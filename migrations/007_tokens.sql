@@ -0,0 +1,21 @@
+-- Files and shares are looked up by a random token in their links rather than
+-- their ID, so the links can't be guessed. Existing rows get a new token.
+alter table files
+    add Token char(43) null after ShareId;
+
+alter table shares
+    add Token char(43) null after Id;
+
+update files
+set Token = replace(replace(trim(trailing '=' from to_base64(random_bytes(32))), '+', '-'), '/', '_');
+
+update shares
+set Token = replace(replace(trim(trailing '=' from to_base64(random_bytes(32))), '+', '-'), '/', '_');
+
+alter table files
+    modify Token char(43) not null,
+    add constraint files_uc_token unique (Token);
+
+alter table shares
+    modify Token char(43) not null,
+    add constraint shares_uc_token unique (Token);
@@ -0,0 +1,17 @@
+-- Recipients are sent a one-time magic link that signs them in instead of a
+-- password, only a hash of each link's token is kept. The passwords that used
+-- to be kept on each file go.
+create table login_tokens
+(
+    TokenHash binary(32)   not null
+        primary key,
+    UserId    int          not null,
+    Path      varchar(255) not null,
+    Expires   datetime     not null
+);
+
+create index login_tokens_expires_idx
+    on login_tokens (Expires);
+
+alter table files
+    drop column Password;
@@ -0,0 +1,9 @@
+-- Senders can limit how many times a file is downloaded by its recipients,
+-- MaxDownloads is null for no limit. Uploads that are still in progress keep
+-- the limit until they're finished.
+alter table files
+    add MaxDownloads int null after SenderEmail,
+    add Downloads    int not null default 0 after MaxDownloads;
+
+alter table uploads
+    add MaxDownloads int not null default 0 after RecipientEmail;
@@ -0,0 +1,25 @@
+-- A record of who did what: uploads, views, downloads, deletes, logins and
+-- changes to users. Rows are only ever added.
+create table audit_events
+(
+    Id         bigint auto_increment
+        primary key,
+    Action     varchar(32)  not null,
+    ActorId    int          null,
+    ActorEmail varchar(255) not null,
+    IP         varchar(45)  not null,
+    UserAgent  varchar(512) not null,
+    TargetType varchar(16)  not null,
+    Target     varchar(64)  not null,
+    Detail     text         not null,
+    CreatedAt  datetime     not null
+);
+
+create index audit_events_actor_idx
+    on audit_events (ActorEmail);
+
+create index audit_events_target_idx
+    on audit_events (Target);
+
+create index audit_events_created_idx
+    on audit_events (CreatedAt);
@@ -0,0 +1,4 @@
+-- Senders are emailed the first time each recipient downloads one of their
+-- files, unless they turn it off.
+alter table users
+    add notify_downloads tinyint(1) default 1 not null;
@@ -0,0 +1,4 @@
+-- Recipients that haven't downloaded a file are reminded before it expires,
+-- RemindedAt is when so they aren't reminded twice.
+alter table file_recipients
+    add RemindedAt datetime null after DownloadedAt;
@@ -0,0 +1,27 @@
+-- Replacing a file keeps what it replaced, every upload of a file is a
+-- version. The files row has the content of the latest one and Version says
+-- which that is. Files from before this have their content as version 1, the
+-- size and checksum of those weren't kept so they're null.
+create table file_versions
+(
+    FileId      int            not null,
+    Version     int            not null,
+    DocName     text           not null,
+    StorageKey  varchar(255)   not null,
+    WrappedKey  varbinary(128) null,
+    ContentType varchar(255)   not null default 'application/octet-stream',
+    Size        bigint         null,
+    Checksum    char(64)       null,
+    UploadedAt  datetime       not null,
+    primary key (FileId, Version),
+    constraint file_versions_files_fk
+        foreign key (FileId) references files (Id)
+            on delete cascade
+);
+
+alter table files
+    add Version int not null default 1 after ContentType;
+
+insert into file_versions (FileId, Version, DocName, StorageKey, WrappedKey, ContentType, UploadedAt)
+select Id, 1, DocName, StorageKey, WrappedKey, ContentType, CreatedAt
+from files;
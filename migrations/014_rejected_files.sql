@@ -0,0 +1,5 @@
+-- Uploads are scanned for viruses, an infected file is kept in quarantine
+-- and never shared. Rejected is what the scanner found in it, null for a
+-- file that's fine.
+alter table files
+    add Rejected varchar(255) null after Downloads;
@@ -0,0 +1,15 @@
+-- What admins allow to be uploaded, a single row like config. Lists are
+-- comma separated and sizes are bytes, 0 for no limit. Until a row is saved
+-- the app uses its built in default.
+create table upload_policy
+(
+    id                 tinyint      not null
+        primary key,
+    allowed_extensions text         not null,
+    blocked_extensions text         not null,
+    allowed_types      text         not null,
+    blocked_types      text         not null,
+    guest_max_size     bigint       not null,
+    user_max_size      bigint       not null,
+    admin_max_size     bigint       not null
+);
@@ -0,0 +1,11 @@
+-- The size and SHA-256 of the latest version go on the files row along with
+-- the rest of its content, so downloads can send and check the checksum
+-- without looking up the version. Null for files uploaded before checksums
+-- were taken.
+alter table files
+    add Size     bigint   null after Version,
+    add Checksum char(64) null after Size;
+
+update files f join file_versions v on v.FileId = f.Id and v.Version = f.Version
+set f.Size     = v.Size,
+    f.Checksum = v.Checksum;
@@ -0,0 +1,33 @@
+-- Two-factor sign in with an authenticator app (TOTP). Secret is the base32
+-- secret the app was set up with and LastStep the time step of the last code
+-- used, so a code can't be used twice. Recovery codes are kept as SHA-256
+-- hashes and deleted when they're used.
+create table two_factor
+(
+    UserId    int         not null
+        primary key,
+    Secret    varchar(64) not null,
+    LastStep  bigint      not null default 0,
+    CreatedAt datetime    not null,
+    constraint two_factor_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
+
+create table recovery_codes
+(
+    UserId   int        not null,
+    CodeHash binary(32) not null,
+    primary key (UserId, CodeHash),
+    constraint recovery_codes_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
+
+-- How admins want people to sign in, a single row like upload_policy.
+create table security_policy
+(
+    id                tinyint    not null
+        primary key,
+    require_admin_2fa tinyint(1) not null default 0
+);
@@ -0,0 +1,19 @@
+-- Passkeys (WebAuthn credentials) people sign in with instead of a password.
+-- Credential is the whole credential record as JSON, CredentialId is kept on
+-- its own too so the same one can't be registered twice.
+create table passkeys
+(
+    id           int auto_increment
+        primary key,
+    UserId       int             not null,
+    CredentialId varbinary(1023) not null,
+    Name         varchar(100)    not null,
+    Credential   json            not null,
+    CreatedAt    datetime        not null,
+    LastUsedAt   datetime        null,
+    constraint passkeys_uc_credential
+        unique (CredentialId),
+    constraint passkeys_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
@@ -0,0 +1,15 @@
+-- Tokens for the links that let people reset a forgotten password. Like magic
+-- links only a hash of each token is kept, and a user only has one at a time.
+create table password_resets
+(
+    TokenHash binary(32) not null
+        primary key,
+    UserId    int        not null,
+    Expires   datetime   not null,
+    constraint password_resets_users_fk
+        foreign key (UserId) references users (id)
+            on delete cascade
+);
+
+create index password_resets_expires_idx
+    on password_resets (Expires);
@@ -0,0 +1,10 @@
+-- CreatedAt is when a file was sent, it's shown as that and used for the
+-- Last-Modified of downloads. It was updated with every change to the row, so
+-- counting a download or extending a file moved it (and to server time rather
+-- than UTC). It's set once when the file is sent now, and put back to when the
+-- first version was uploaded, which the updates didn't touch.
+alter table files
+    modify CreatedAt datetime not null;
+
+update files f join file_versions v on v.FileId = f.Id and v.Version = 1
+set f.CreatedAt = v.UploadedAt;
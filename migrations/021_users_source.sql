@@ -0,0 +1,5 @@
+-- Where an account is managed. Blank for accounts with a password here,
+-- otherwise what they sign in with, e.g. 'sso' for the OpenID Connect
+-- provider. Accounts managed somewhere else can't sign in with a password here.
+alter table users
+    add source varchar(16) default '' not null after notify_downloads;
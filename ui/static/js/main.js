@@ -3,12 +3,333 @@ document.addEventListener("DOMContentLoaded", function () {
   const loginButton = document.getElementById("logIn");
 
   //signUpButton redirect action
-  signUpButton.addEventListener("click", function () {
-    window.location.href = "/user/signup";
-  });
+  if (signUpButton) {
+    signUpButton.addEventListener("click", function () {
+      window.location.href = "/user/signup";
+    });
+  }
 
   //loginButton Redirect Action
-  loginButton.addEventListener("click", function () {
-    window.location.href = "/user/login";
-  });
+  if (loginButton) {
+    loginButton.addEventListener("click", function () {
+      window.location.href = "/user/login";
+    });
+  }
+
+  //Add an empty row for another recipient, copied from the first one
+  const addRecipient = document.getElementById("addRecipient");
+  if (addRecipient) {
+    addRecipient.addEventListener("click", function () {
+      const row = document.querySelector("#recipients .recipient");
+      const copy = row.cloneNode(true);
+      copy.querySelectorAll("input").forEach(function (input) {
+        input.value = "";
+      });
+      addRecipient.before(copy);
+    });
+  }
+
+  //Send uploads in chunks so big files survive a dropped connection, without
+  //JavaScript (or with several files, which go together as a share) the form
+  //is just posted as normal
+  const createForm = document.getElementById("createForm");
+  if (createForm) {
+    createForm.addEventListener("submit", function (event) {
+      const files = createForm.querySelector("input[name=uploadFile]").files;
+      if (files.length !== 1) {
+        return;
+      }
+      const file = files[0];
+
+      event.preventDefault();
+      resumableUpload(createForm, file).catch(function (err) {
+        uploadStatus("Upload failed: " + err.message);
+      });
+    });
+  }
+
+  //Passkeys, signing in with one and adding a new one
+  const passkeyLogin = document.getElementById("passkeyLogin");
+  if (passkeyLogin) {
+    passkeyLogin.addEventListener("submit", function (event) {
+      event.preventDefault();
+      passkeySignIn(passkeyLogin).catch(passkeyFailed);
+    });
+  }
+
+  const passkeyRegister = document.getElementById("passkeyRegister");
+  if (passkeyRegister) {
+    passkeyRegister.addEventListener("submit", function (event) {
+      event.preventDefault();
+      passkeyAdd(passkeyRegister).catch(passkeyFailed);
+    });
+  }
 });
+
+const tusVersion = "1.0.0";
+const chunkSize = 8 * 1024 * 1024;
+const maxRetries = 5;
+
+function uploadStatus(message) {
+  document.getElementById("uploadStatus").textContent = message;
+}
+
+//base64 encode a string as UTF-8 for the Upload-Metadata header
+function encodeMetadataValue(value) {
+  let binary = "";
+  new TextEncoder().encode(value).forEach(function (b) {
+    binary += String.fromCharCode(b);
+  });
+  return btoa(binary);
+}
+
+//The values of every field with the name, as a comma separated list
+function fieldList(form, name) {
+  return Array.from(form.querySelectorAll("input[name=" + name + "]"))
+    .map(function (input) {
+      return input.value.trim();
+    })
+    .filter(function (value) {
+      return value !== "";
+    })
+    .join(", ");
+}
+
+function uploadMetadata(form, file) {
+  const values = {
+    filename: file.name,
+    recipientName: fieldList(form, "recipientName"),
+    recipientEmail: fieldList(form, "recipientEmail"),
+    senderName: form.elements["senderName"].value,
+    senderEmail: form.elements["senderEmail"].value,
+    expires: form.elements["expires"].value,
+    maxDownloads: form.elements["maxDownloads"].value,
+  };
+
+  return Object.keys(values)
+    .map(function (key) {
+      return key + " " + encodeMetadataValue(values[key]);
+    })
+    .join(",");
+}
+
+async function uploadOffset(location) {
+  const res = await fetch(location, {
+    method: "HEAD",
+    headers: { "Tus-Resumable": tusVersion },
+  });
+  if (!res.ok) {
+    return null;
+  }
+  return parseInt(res.headers.get("Upload-Offset"), 10);
+}
+
+async function resumableUpload(form, file) {
+  const csrfToken = form.elements["csrf_token"].value;
+
+  //Remember where the upload lives so picking the same file again after a
+  //failure carries on from where it got to
+  const resumeKey = ["upload", file.name, file.size, file.lastModified].join(":");
+  let location = localStorage.getItem(resumeKey);
+  let offset = location ? await uploadOffset(location) : null;
+
+  if (offset === null) {
+    const res = await fetch("/files/uploads", {
+      method: "POST",
+      headers: {
+        "Tus-Resumable": tusVersion,
+        "Upload-Length": file.size,
+        "Upload-Metadata": uploadMetadata(form, file),
+        "X-CSRF-Token": csrfToken,
+      },
+    });
+
+    if (res.status === 422) {
+      const errors = await res.json();
+      uploadStatus(Object.values(errors.FieldErrors || {}).join(" "));
+      return;
+    }
+    if (!res.ok) {
+      throw new Error(res.statusText);
+    }
+
+    location = res.headers.get("Location");
+    localStorage.setItem(resumeKey, location);
+    offset = 0;
+  }
+
+  let retries = 0;
+
+  for (;;) {
+    let res;
+    try {
+      res = await fetch(location, {
+        method: "PATCH",
+        headers: {
+          "Tus-Resumable": tusVersion,
+          "Content-Type": "application/offset+octet-stream",
+          "Upload-Offset": offset,
+          "X-CSRF-Token": csrfToken,
+        },
+        body: file.slice(offset, offset + chunkSize),
+      });
+    } catch (err) {
+      res = null;
+    }
+
+    //The start of the file showed it isn't allowed, the server has dropped the upload
+    if (res && res.status === 422) {
+      localStorage.removeItem(resumeKey);
+      const errors = await res.json();
+      uploadStatus(Object.values(errors.FieldErrors || {}).join(" "));
+      return;
+    }
+
+    if (!res || !res.ok) {
+      //Wait a moment, then ask the server where we got to and go again
+      if (++retries > maxRetries) {
+        throw new Error(res ? res.statusText : "connection lost");
+      }
+      await new Promise(function (resolve) {
+        setTimeout(resolve, 1000 * retries);
+      });
+
+      const current = await uploadOffset(location);
+      if (current === null) {
+        throw new Error("upload no longer exists");
+      }
+      offset = current;
+      continue;
+    }
+
+    retries = 0;
+    offset = parseInt(res.headers.get("Upload-Offset"), 10);
+    uploadStatus("Uploaded " + Math.floor((offset / file.size) * 100) + "%");
+
+    if (offset >= file.size) {
+      localStorage.removeItem(resumeKey);
+      window.location.href = res.headers.get("Content-Location") || "/";
+      return;
+    }
+  }
+}
+
+//The server sends the binary parts of the passkey options base64url encoded, the
+//browser wants them as ArrayBuffers, and the other way round for what it gives back
+function fromBase64url(value) {
+  const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+  const binary = atob(base64.padEnd(base64.length + ((4 - (base64.length % 4)) % 4), "="));
+  return Uint8Array.from(binary, function (c) {
+    return c.charCodeAt(0);
+  }).buffer;
+}
+
+function toBase64url(buffer) {
+  let binary = "";
+  new Uint8Array(buffer).forEach(function (b) {
+    binary += String.fromCharCode(b);
+  });
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function passkeyStatus(message) {
+  document.getElementById("passkeyStatus").textContent = message;
+}
+
+function passkeyFailed(err) {
+  //Cancelling the browser's prompt isn't worth an error message
+  if (err.name === "NotAllowedError" || err.name === "AbortError") {
+    passkeyStatus("");
+    return;
+  }
+  passkeyStatus(err.message);
+}
+
+async function passkeyPost(path, form, body) {
+  const res = await fetch(path, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": form.elements["csrf_token"].value,
+    },
+    body: body ? JSON.stringify(body) : null,
+  });
+
+  const result = await res.json().catch(function () {
+    return { error: res.statusText };
+  });
+  if (!res.ok) {
+    throw new Error(result.error || res.statusText);
+  }
+  return result;
+}
+
+//Go wherever the server says once a ceremony is finished
+function passkeyDone(result) {
+  window.location.href = result.redirect || "/";
+}
+
+async function passkeySignIn(form) {
+  if (!window.PublicKeyCredential) {
+    throw new Error("This browser doesn't support passkeys");
+  }
+
+  const options = await passkeyPost("/user/passkey/login", form);
+  const publicKey = options.publicKey;
+  publicKey.challenge = fromBase64url(publicKey.challenge);
+  (publicKey.allowCredentials || []).forEach(function (c) {
+    c.id = fromBase64url(c.id);
+  });
+
+  const credential = await navigator.credentials.get({ publicKey: publicKey });
+
+  passkeyDone(
+    await passkeyPost("/user/passkey/login/finish", form, {
+      id: credential.id,
+      rawId: toBase64url(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: toBase64url(credential.response.clientDataJSON),
+        authenticatorData: toBase64url(credential.response.authenticatorData),
+        signature: toBase64url(credential.response.signature),
+        userHandle: credential.response.userHandle
+          ? toBase64url(credential.response.userHandle)
+          : null,
+      },
+      clientExtensionResults: credential.getClientExtensionResults(),
+    }),
+  );
+}
+
+async function passkeyAdd(form) {
+  if (!window.PublicKeyCredential) {
+    throw new Error("This browser doesn't support passkeys");
+  }
+
+  const options = await passkeyPost("/user/passkeys/register", form);
+  const publicKey = options.publicKey;
+  publicKey.challenge = fromBase64url(publicKey.challenge);
+  publicKey.user.id = fromBase64url(publicKey.user.id);
+  (publicKey.excludeCredentials || []).forEach(function (c) {
+    c.id = fromBase64url(c.id);
+  });
+
+  const credential = await navigator.credentials.create({ publicKey: publicKey });
+  const name = encodeURIComponent(form.elements["name"].value);
+
+  passkeyDone(
+    await passkeyPost("/user/passkeys/register/finish?name=" + name, form, {
+      id: credential.id,
+      rawId: toBase64url(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: toBase64url(credential.response.clientDataJSON),
+        attestationObject: toBase64url(credential.response.attestationObject),
+        transports: credential.response.getTransports
+          ? credential.response.getTransports()
+          : [],
+      },
+      clientExtensionResults: credential.getClientExtensionResults(),
+    }),
+  );
+}